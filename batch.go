@@ -0,0 +1,144 @@
+package toyboltdb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxBatchSize is the batch size used when DB.MaxBatchSize is not set.
+	DefaultMaxBatchSize = 1000
+
+	// DefaultMaxBatchDelay is the batch delay used when DB.MaxBatchDelay is not set.
+	DefaultMaxBatchDelay = 10 * time.Millisecond
+)
+
+// errTrySolo is sent to a Batch() caller whose function should be run in a
+// transaction of its own.
+var errTrySolo = errors.New("batch function should be run solo")
+
+// Batch executes a function within a RWTransaction that is shared with
+// other goroutines calling Batch() at the same time. Concurrent writers are
+// combined so that they share a single commit instead of queueing for one
+// each as they would with Update().
+//
+// A batch is started once MaxBatchSize calls have joined it or MaxBatchDelay
+// has passed since the first one did. If a function returns an error then the
+// rest of the batch is run again without it and it is retried on its own,
+// where its error is returned as Update() would. If the shared commit fails
+// then every function is retried on its own.
+//
+// Functions may therefore be run more than once and must be idempotent.
+// Changes made to the transaction are only committed if Batch() returns nil.
+func (db *DB) Batch(fn func(*RWTransaction) error) error {
+	errCh := make(chan error, 1)
+
+	db.batchlock.Lock()
+	if db.batch == nil {
+		db.batch = &batch{db: db}
+		db.batch.timer = time.AfterFunc(db.maxBatchDelay(), db.batch.trigger)
+	}
+	db.batch.calls = append(db.batch.calls, call{fn: fn, err: errCh})
+	if len(db.batch.calls) >= db.maxBatchSize() {
+		// Wake up the batch; it's ready to run.
+		go db.batch.trigger()
+		db.batch = nil
+	}
+	db.batchlock.Unlock()
+
+	err := <-errCh
+	if err == errTrySolo {
+		err = db.Update(fn)
+	}
+	return err
+}
+
+// maxBatchSize returns MaxBatchSize or its default.
+func (db *DB) maxBatchSize() int {
+	if db.MaxBatchSize <= 0 {
+		return DefaultMaxBatchSize
+	}
+	return db.MaxBatchSize
+}
+
+// maxBatchDelay returns MaxBatchDelay or its default.
+func (db *DB) maxBatchDelay() time.Duration {
+	if db.MaxBatchDelay <= 0 {
+		return DefaultMaxBatchDelay
+	}
+	return db.MaxBatchDelay
+}
+
+// batch is a group of Batch() calls that run in one transaction.
+type batch struct {
+	db    *DB
+	timer *time.Timer
+	start sync.Once
+	calls []call
+}
+
+// call is a single Batch() call waiting on its result.
+type call struct {
+	fn  func(*RWTransaction) error
+	err chan<- error
+}
+
+// trigger runs the batch if it hasn't already been run.
+func (b *batch) trigger() {
+	b.start.Do(b.run)
+}
+
+// run executes the calls in a transaction and sends each caller its result.
+func (b *batch) run() {
+	// Stop taking new calls. A full batch has been detached already.
+	b.db.batchlock.Lock()
+	b.timer.Stop()
+	if b.db.batch == b {
+		b.db.batch = nil
+	}
+	b.db.batchlock.Unlock()
+
+	for len(b.calls) > 0 {
+		failIdx := -1
+		err := b.db.Update(func(t *RWTransaction) error {
+			for i, c := range b.calls {
+				if err := safelyCall(c.fn, t); err != nil {
+					failIdx = i
+					return err
+				}
+			}
+			return nil
+		})
+
+		// Drop the failed call, let it run on its own and retry the rest.
+		if failIdx >= 0 {
+			c := b.calls[failIdx]
+			b.calls[failIdx], b.calls = b.calls[len(b.calls)-1], b.calls[:len(b.calls)-1]
+			c.err <- errTrySolo
+			continue
+		}
+
+		// If the commit failed then retry every call on its own so that
+		// none of them is failed by another.
+		if err != nil {
+			err = errTrySolo
+		}
+		for _, c := range b.calls {
+			c.err <- err
+		}
+		break
+	}
+}
+
+// safelyCall calls fn and returns a panic as an error so that one call can't
+// take the batch down with it.
+func safelyCall(fn func(*RWTransaction) error, t *RWTransaction) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("batch function panicked: %v", p)
+		}
+	}()
+	return fn(t)
+}
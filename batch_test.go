@@ -0,0 +1,133 @@
+package toyboltdb
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensure that concurrent batch calls all commit and share transactions.
+func TestDBBatch(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		}))
+
+		var mu sync.Mutex
+		ids := make(map[int]bool)
+		n := 200
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := db.Batch(func(txn *RWTransaction) error {
+					mu.Lock()
+					ids[txn.ID()] = true
+					mu.Unlock()
+					return txn.Put("widgets", []byte(fmt.Sprintf("%04d", i)), []byte("bar"))
+				})
+				assert.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+		assert.True(t, len(ids) < n)
+
+		_ = db.View(func(txn *Transaction) error {
+			for i := 0; i < n; i++ {
+				value, _ := txn.Get("widgets", []byte(fmt.Sprintf("%04d", i)))
+				assert.Equal(t, value, []byte("bar"), "key %d", i)
+			}
+			return nil
+		})
+	})
+}
+
+// Ensure that a batch starts once it is full without waiting for the delay.
+func TestDBBatchMaxSize(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		db.MaxBatchSize = 2
+		db.MaxBatchDelay = time.Hour
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		}))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.NoError(t, db.Batch(func(txn *RWTransaction) error {
+					return txn.Put("widgets", []byte(fmt.Sprintf("%d", i)), []byte("bar"))
+				}))
+			}(i)
+		}
+		wg.Wait()
+	})
+}
+
+// Ensure that a failing or panicking call doesn't fail the rest of its batch.
+func TestDBBatchError(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		db.MaxBatchDelay = 50 * time.Millisecond
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		}))
+
+		exp := fmt.Errorf("bad call")
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := db.Batch(func(txn *RWTransaction) error {
+					if err := txn.Put("widgets", []byte(fmt.Sprintf("%02d", i)), []byte("bar")); err != nil {
+						return err
+					}
+					if i == 5 {
+						return exp
+					}
+					return nil
+				})
+				if i == 5 {
+					assert.Equal(t, err, exp)
+				} else {
+					assert.NoError(t, err)
+				}
+			}(i)
+		}
+
+		// A panic in the shared transaction fails only the call that panicked.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var panicked bool
+			assert.NoError(t, db.Batch(func(txn *RWTransaction) error {
+				if !panicked {
+					panicked = true
+					panic("boom")
+				}
+				return txn.Put("widgets", []byte("solo"), []byte("bar"))
+			}))
+			assert.True(t, panicked)
+		}()
+		wg.Wait()
+
+		_ = db.View(func(txn *Transaction) error {
+			value, _ := txn.Get("widgets", []byte("solo"))
+			assert.Equal(t, value, []byte("bar"))
+			for i := 0; i < 20; i++ {
+				value, _ := txn.Get("widgets", []byte(fmt.Sprintf("%02d", i)))
+				if i == 5 {
+					assert.Nil(t, value)
+				} else {
+					assert.Equal(t, value, []byte("bar"), "key %d", i)
+				}
+			}
+			return nil
+		})
+	})
+}
@@ -1,6 +1,7 @@
 package toyboltdb
 
 import (
+	"bytes"
 	"sort"
 	"unsafe"
 )
@@ -10,8 +11,9 @@ import (
 // It's also like a **table**.
 //
 // All keys inside the bucket are unique.
-// The Bucket type is not typically used directly.
-// Instead the bucket name is typically passed into the Get(), Put(), or Delete() functions.
+// The bucket name is typically passed into the Get(), Put(), or Delete()
+// functions of a transaction. A Bucket can also be used directly to avoid
+// looking up the name on every call, such as in a hot loop.
 type Bucket struct {
 	*bucket
 	name        string
@@ -20,8 +22,9 @@ type Bucket struct {
 
 // bucket represents the **on-file** representation of a bucket.
 type bucket struct {
-	rootPageID pageID
-	sequence   uint64
+	rootPageID   pageID
+	sequence     uint64
+	modifiedTxID txID // last transaction that changed the bucket
 }
 
 // Name returns the name of the bucket.
@@ -29,13 +32,266 @@ func (b *Bucket) Name() string {
 	return b.name
 }
 
+// NameBytes returns the name of the bucket as bytes.
+func (b *Bucket) NameBytes() []byte {
+	return []byte(b.name)
+}
+
 // Cursor creates a new cursor for this bucket.
 func (b *Bucket) Cursor() *Cursor {
 	return &Cursor{
 		transaction: b.transaction,
+		bucket:      b.bucket,
+		name:        b.name,
 		rootPageID:  b.rootPageID,
-		stack:       make([]pageElementRef, 0),
+		stack:       make([]pageElementRef, 0, cursorStackSize),
+	}
+}
+
+// Get retrieves the value for a key in the bucket.
+// Returns a nil value if the key does not exist.
+func (b *Bucket) Get(key []byte) []byte {
+	b.transaction.db.opCounts(b.name).get.Add(1)
+	return b.Cursor().Get(key)
+}
+
+// Put sets the value for a key in the bucket.
+// If the key exist then its previous value will be overwritten.
+// The key and value are copied so the caller is free to reuse them after Put returns.
+// Returns an error if the bucket belongs to a read-only Transaction, if the key is blank,
+// if the key is too large, if the value is too large, or if the bucket's key validator rejects the key.
+func (b *Bucket) Put(key []byte, value []byte) error {
+	_, err := b.put(key, value, 0)
+	return err
+}
+
+// PutFlags sets the value for a key in the bucket like Put and marks it with
+// flags that GetFlags() reports. Only the high 16 bits can be set; the rest
+// are reserved. Put() clears the flags of the value it overwrites.
+// Returns ErrInvalidFlags if a reserved flag is set.
+func (b *Bucket) PutFlags(key []byte, value []byte, flags uint32) error {
+	if flags&reservedLeafFlags != 0 {
+		return ErrInvalidFlags
+	}
+	_, err := b.put(key, value, flags)
+	return err
+}
+
+// GetFlags retrieves the value for a key in the bucket along with the flags
+// it was put with. Returns a nil value and zero flags if the key does not exist.
+func (b *Bucket) GetFlags(key []byte) ([]byte, uint32) {
+	b.transaction.db.opCounts(b.name).get.Add(1)
+	c := b.Cursor()
+	v := c.Get(key)
+	if v == nil {
+		return nil, 0
+	}
+	return v, c.flags()
+}
+
+// put sets the value and flags for a key and returns the value it replaced, if any.
+// The previous value may point into the mmap so callers that keep it must copy it.
+func (b *Bucket) put(key []byte, value []byte, flags uint32) ([]byte, error) {
+	t := b.transaction.rwtransaction
+	if t == nil {
+		return nil, ErrTransactionNotWritable
+	}
+
+	// Validate the key and data size.
+	if err := t.db.ValidateEntry(key, value); err != nil {
+		return nil, err
+	}
+
+	// Check the key against the bucket's validator, if any.
+	if fn := t.db.KeyValidators[b.name]; fn != nil {
+		if err := fn(key); err != nil {
+			return nil, err
+		}
+	}
+	t.evict()
+
+	// Move cursor to correct position, reading in the nodes on the way.
+	c := b.Cursor()
+	n, old := c.searchNode(t, key)
+
+	// Copy the key/value since the node holds onto them until commit and
+	// callers may reuse their buffers between calls.
+	key, value = bytes.Clone(key), bytes.Clone(value)
+
+	// Insert the key/value.
+	n.put(key, key, value, 0, flags)
+	t.stats.LogicalBytes += len(key) + len(value)
+	b.modifiedTxID = t.meta.txID
+	t.db.opCounts(b.name).put.Add(1)
+
+	return old, nil
+}
+
+// Delete removes a key from the bucket.
+// If the key does not exist then nothing is done and a nil error is returned.
+// Returns an error if the bucket belongs to a read-only Transaction.
+func (b *Bucket) Delete(key []byte) error {
+	t := b.transaction.rwtransaction
+	if t == nil {
+		return ErrTransactionNotWritable
 	}
+	t.evict()
+	t.db.opCounts(b.name).del.Add(1)
+
+	// Move cursor to correct position.
+	c := b.Cursor()
+	value := c.Get(key)
+
+	// Delete the node if we have a matching key.
+	if value != nil {
+		t.stats.LogicalBytes += len(key) + len(value)
+		b.modifiedTxID = t.meta.txID
+	}
+	n := c.node(t)
+	n.del(key)
+
+	// Drop an emptied leaf right away so that large deletes don't hold
+	// every touched node until commit. The last child of a branch is kept.
+	if len(n.children) == 0 && n.parent != nil && n.parent.numChildren() > 1 {
+		n.parent.del(n.key)
+		t.free(n)
+	}
+
+	return nil
+}
+
+// ForEach executes a function for each key/value pair in the bucket, in key order.
+// An error returned from the function stops the iteration and is returned.
+func (b *Bucket) ForEach(fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachCursor executes a function for each key/value pair in the bucket
+// like ForEach but also passes the cursor so the function can move it, such
+// as to skip a range of keys with Seek(). Iteration resumes after the element
+// that the cursor is left on, or at it if the function moved the cursor off
+// the current key. Moving the cursor backwards visits keys again.
+func (b *Bucket) ForEachCursor(fn func(c *Cursor, k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.resume(k) {
+		if err := fn(c, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachPrefix executes a function for each key/value pair in the bucket
+// whose key starts with a given prefix, in key order. An empty prefix visits
+// every key. See Cursor.SeekPrefix().
+// An error returned from the function stops the iteration and is returned.
+func (b *Bucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.SeekPrefix(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KV is a key/value pair passed to ForEachBatch().
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// ForEachBatch executes a function for each batch of up to batchSize
+// key/value pairs in the bucket, in key order, so that the cost of the call
+// is spread over the batch. A batchSize below 1 is taken as 1.
+// The slice is reused for the next batch so the function must copy the pairs
+// it keeps. The keys and values themselves stay valid for the life of the
+// transaction like those passed to ForEach().
+// An error returned from the function stops the iteration and is returned.
+func (b *Bucket) ForEachBatch(batchSize int, fn func(kvs []KV) error) error {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	kvs := make([]KV, 0, batchSize)
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		kvs = append(kvs, KV{Key: k, Value: v})
+		if len(kvs) == batchSize {
+			if err := fn(kvs); err != nil {
+				return err
+			}
+			kvs = kvs[:0]
+		}
+	}
+	if len(kvs) > 0 {
+		return fn(kvs)
+	}
+	return nil
+}
+
+// NextSequence returns an autoincrementing integer for the bucket.
+// Returns an error if the bucket belongs to a read-only Transaction.
+func (b *Bucket) NextSequence() (uint64, error) {
+	t := b.transaction.rwtransaction
+	if t == nil {
+		return 0, ErrTransactionNotWritable
+	}
+
+	// Increment and return the sequence.
+	b.sequence++
+	b.modifiedTxID = t.meta.txID
+
+	return b.sequence, nil
+}
+
+// BucketStats records statistics about the shape of a bucket's tree.
+type BucketStats struct {
+	BranchPageN int // number of branch pages
+	LeafPageN   int // number of leaf pages
+	KeyN        int // number of keys
+	Depth       int // number of branch levels plus one
+
+	BranchInuse int // bytes used on branch pages
+	LeafInuse   int // bytes used on leaf pages
+}
+
+// Stats walks the bucket's tree and returns statistics about its shape.
+// Changes within a RWTransaction are not counted until they are committed.
+func (b *Bucket) Stats() BucketStats {
+	var s BucketStats
+	b.transaction.forEachPage(b.rootPageID, 1, func(p *page, depth int) {
+		s.Depth = max(s.Depth, depth)
+		if (p.flags & leafPageFlag) != 0 {
+			s.LeafPageN++
+			s.KeyN += int(p.count)
+			s.LeafInuse += pageHeaderSize + int(p.count)*leafPageElementSize
+			for i := uint16(0); i < p.count; i++ {
+				e := p.leafPageElement(i)
+				s.LeafInuse += int(e.ksize + e.vsize)
+			}
+		} else if (p.flags & branchPageFlag) != 0 {
+			s.BranchPageN++
+			s.BranchInuse += pageHeaderSize + int(p.count)*branchPageElementSize
+			for i := uint16(0); i < p.count; i++ {
+				s.BranchInuse += int(p.branchPageElement(i).ksize)
+			}
+		}
+	})
+	return s
+}
+
+// KeyN returns the number of keys in the bucket.
+// The element counts of the leaves are summed without reading the keys, so
+// it is much cheaper than iterating. Unlike Stats(), changes that a
+// RWTransaction hasn't committed yet are counted.
+func (b *Bucket) KeyN() int {
+	return b.Cursor().count(b.rootPageID)
 }
 
 // buckets represents a **in-memory** buckets page.
@@ -82,6 +338,11 @@ func (b *buckets) read(p *page) {
 	b.pageID = p.id
 	b.bucketMap = make(map[string]*bucket)
 
+	// A new database starts with an empty page so there is nothing to read.
+	if p.count == 0 {
+		return
+	}
+
 	var bucketMap []*bucket
 	var keys []string
 
@@ -104,8 +365,9 @@ func (b *buckets) read(p *page) {
 	// Associate keys and items.
 	for index, key := range keys {
 		b.bucketMap[key] = &bucket{
-			rootPageID: bucketMap[index].rootPageID,
-			sequence:   bucketMap[index].sequence,
+			rootPageID:   bucketMap[index].rootPageID,
+			sequence:     bucketMap[index].sequence,
+			modifiedTxID: bucketMap[index].modifiedTxID,
 		}
 	}
 }
@@ -120,6 +382,9 @@ func (b *buckets) write(p *page) {
 	// Initialize page.
 	p.flags |= bucketsPageFlag
 	p.count = uint16(len(b.bucketMap))
+	if p.count == 0 {
+		return
+	}
 
 	// Sort keys.
 	var keys []string
@@ -155,3 +420,10 @@ func (b *buckets) updateRootPageID(oldid, newid pageID) {
 		}
 	}
 }
+
+// bucketsByName sorts a list of buckets by name.
+type bucketsByName []*Bucket
+
+func (s bucketsByName) Len() int           { return len(s) }
+func (s bucketsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bucketsByName) Less(i, j int) bool { return s[i].name < s[j].name }
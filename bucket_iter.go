@@ -0,0 +1,37 @@
+//go:build go1.23
+
+package toyboltdb
+
+import "iter"
+
+// All returns an iterator over the key/value pairs in the bucket, in key order.
+// The key and value point into the database and are only valid for the
+// current step of the loop so they must be copied to be kept.
+func (b *Bucket) All() iter.Seq2[[]byte, []byte] {
+	return b.Range(nil, nil)
+}
+
+// Range returns an iterator over the key/value pairs in the bucket with keys
+// from min, inclusive, up to max, exclusive, in key order. A nil min starts at
+// the first key and a nil max runs to the last key.
+// The key and value point into the database and are only valid for the
+// current step of the loop so they must be copied to be kept.
+func (b *Bucket) Range(min, max []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		c := b.Cursor()
+		var k, v []byte
+		if min == nil {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(min)
+		}
+		for ; k != nil; k, v = c.Next() {
+			if max != nil && b.transaction.db.compare(k, max) >= 0 {
+				return
+			}
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+//go:build go1.23
+
+package toyboltdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensure that a bucket can be ranged over and that a break stops the iteration.
+func TestBucketAll(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			txn.CreateBucket("woojits")
+			for _, i := range []int{5, 1, 4, 2, 3} {
+				txn.Put("widgets", []byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("bar%d", i)))
+			}
+			return nil
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			b := txn.Bucket("widgets")
+			var keys []string
+			for k, v := range b.All() {
+				assert.Equal(t, string(v), "bar"+string(k))
+				keys = append(keys, string(k))
+			}
+			assert.Equal(t, keys, []string{"1", "2", "3", "4", "5"})
+
+			keys = nil
+			for k := range b.All() {
+				keys = append(keys, string(k))
+				if len(keys) == 2 {
+					break
+				}
+			}
+			assert.Equal(t, keys, []string{"1", "2"})
+
+			for range txn.Bucket("woojits").All() {
+				t.Error("unexpected key")
+			}
+			return nil
+		})
+	})
+}
+
+// Ensure that a range includes its lower bound and excludes its upper bound.
+func TestBucketRange(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 1000; i++ {
+				k := []byte(fmt.Sprintf("%04d", i))
+				txn.Put("widgets", k, k)
+			}
+			return nil
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			b := txn.Bucket("widgets")
+			keys := func(min, max string) []string {
+				var lo, hi []byte
+				if min != "" {
+					lo = []byte(min)
+				}
+				if max != "" {
+					hi = []byte(max)
+				}
+				var keys []string
+				for k := range b.Range(lo, hi) {
+					keys = append(keys, string(k))
+				}
+				return keys
+			}
+			assert.Equal(t, keys("0100", "0103"), []string{"0100", "0101", "0102"})
+			assert.Equal(t, keys("00995", "0101"), []string{"0100"})
+			assert.Equal(t, keys("", "0002"), []string{"0000", "0001"})
+			assert.Equal(t, keys("0998", ""), []string{"0998", "0999"})
+			assert.Equal(t, len(keys("", "")), 1000)
+			assert.Nil(t, keys("0100", "0100"))
+			assert.Nil(t, keys("1000", ""))
+
+			// A break stops the iteration.
+			var n int
+			for range b.Range([]byte("0500"), nil) {
+				if n++; n == 10 {
+					break
+				}
+			}
+			assert.Equal(t, n, 10)
+			return nil
+		})
+	})
+}
@@ -1,6 +1,9 @@
 package toyboltdb
 
 import (
+	"fmt"
+	"os"
+	"sync"
 	"testing"
 	"unsafe"
 
@@ -68,3 +71,479 @@ func TestBucketsWrite(t *testing.T) {
 	assert.Equal(t, b.get("foo").rootPageID, pageID(2))
 	assert.Equal(t, b.get("bar").rootPageID, pageID(3))
 }
+
+// Ensure that an empty buckets page round-trips to an empty set of buckets.
+func TestBucketsReadWriteEmpty(t *testing.T) {
+	b := &buckets{bucketMap: make(map[string]*bucket)}
+
+	// Fill the page with garbage so that reading past the header would show.
+	var buf [4096]byte
+	for i := range buf {
+		buf[i] = 0xFF
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	p.id = 3
+	p.flags = 0
+	b.write(p)
+	assert.Equal(t, p.count, uint16(0))
+	assert.Equal(t, p.flags, uint16(bucketsPageFlag))
+
+	b2 := &buckets{}
+	b2.read(p)
+	assert.Equal(t, b2.pageID, pageID(3))
+	assert.NotNil(t, b2.bucketMap)
+	assert.Equal(t, len(b2.bucketMap), 0)
+	assert.Equal(t, b2.size(), pageHeaderSize)
+}
+
+// Ensure that a new database starts with no buckets.
+func TestBucketsEmptyDB(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.View(func(txn *Transaction) error {
+			assert.Equal(t, len(txn.Buckets()), 0)
+			return nil
+		})
+	})
+}
+
+// Ensure that a bucket reports the shape of its tree.
+func TestBucketStats(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		stats := func() (s BucketStats) {
+			_ = db.View(func(txn *Transaction) error {
+				s = txn.Bucket("widgets").Stats()
+				return nil
+			})
+			return s
+		}
+		put := func(from, to int) {
+			assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+				txn.CreateBucketIfNotExists("widgets")
+				for i := from; i < to; i++ {
+					if err := txn.Put("widgets", []byte(fmt.Sprintf("%05d", i)), make([]byte, 100)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+
+		// A single leaf.
+		put(0, 10)
+		s := stats()
+		assert.Equal(t, s.KeyN, 10)
+		assert.Equal(t, s.Depth, 1)
+		assert.Equal(t, s.LeafPageN, 1)
+		assert.Equal(t, s.BranchPageN, 0)
+		assert.Equal(t, s.LeafInuse, pageHeaderSize+10*(leafPageElementSize+5+100))
+		assert.Equal(t, s.BranchInuse, 0)
+
+		// The tree gets deeper as it splits.
+		put(10, 1000)
+		s = stats()
+		assert.Equal(t, s.KeyN, 1000)
+		assert.Equal(t, s.Depth, 2)
+		assert.True(t, s.LeafPageN > 1)
+		assert.Equal(t, s.BranchPageN, 1)
+		assert.Equal(t, s.BranchInuse, pageHeaderSize+s.LeafPageN*(branchPageElementSize+5))
+
+		put(1000, 20000)
+		s = stats()
+		assert.Equal(t, s.KeyN, 20000)
+		assert.Equal(t, s.Depth, 3)
+	})
+}
+
+// Ensure that a bucket's keys are counted, including uncommitted changes.
+func TestBucketKeyN(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			b := txn.Bucket("widgets")
+			assert.Equal(t, b.KeyN(), 0)
+			for i := 0; i < 5000; i++ {
+				b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, 100))
+			}
+			assert.Equal(t, b.KeyN(), 5000)
+			return nil
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			assert.Equal(t, txn.Bucket("widgets").KeyN(), 5000)
+			return nil
+		})
+
+		// Deletes, including of missing keys, and overwrites in a write transaction.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			b := txn.Bucket("widgets")
+			for i := 1000; i < 3000; i++ {
+				b.Delete([]byte(fmt.Sprintf("%05d", i)))
+			}
+			b.Delete([]byte("foo"))
+			b.Put([]byte("00000"), []byte("bar"))
+			b.Put([]byte("foo"), []byte("bar"))
+			assert.Equal(t, b.KeyN(), 3001)
+			return nil
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			assert.Equal(t, txn.Bucket("widgets").KeyN(), 3001)
+			assert.Equal(t, txn.Bucket("widgets").Stats().KeyN, 3001)
+			return nil
+		})
+	})
+}
+
+// Ensure that a bucket can be read and written directly.
+func TestBucketGetPutDelete(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			txn.CreateBucket("woojits")
+			b := txn.Bucket("widgets")
+			for i := 0; i < 1000; i++ {
+				k := []byte(fmt.Sprintf("%04d", i))
+				assert.NoError(t, b.Put(k, k))
+				assert.NoError(t, txn.Put("woojits", k, k))
+			}
+			for i := 0; i < 1000; i += 3 {
+				k := []byte(fmt.Sprintf("%04d", i))
+				assert.NoError(t, b.Delete(k))
+				assert.NoError(t, txn.Delete("woojits", k))
+			}
+			assert.Equal(t, b.Put(nil, []byte("bar")), ErrKeyRequired)
+			return nil
+		}))
+
+		// The results match the transaction level functions.
+		_ = db.View(func(txn *Transaction) error {
+			b := txn.Bucket("widgets")
+			for i := 0; i < 1000; i++ {
+				k := []byte(fmt.Sprintf("%04d", i))
+				value, _ := txn.Get("woojits", k)
+				assert.Equal(t, b.Get(k), value)
+			}
+			assert.Nil(t, b.Get([]byte("0000")))
+			assert.Equal(t, b.Get([]byte("0001")), []byte("0001"))
+			a, _ := txn.BucketHash("widgets")
+			w, _ := txn.BucketHash("woojits")
+			assert.Equal(t, a, w)
+
+			// A read-only bucket can't be written.
+			assert.Equal(t, b.Put([]byte("foo"), []byte("bar")), ErrTransactionNotWritable)
+			assert.Equal(t, b.Delete([]byte("0001")), ErrTransactionNotWritable)
+			return nil
+		})
+	})
+}
+
+// Ensure that value flags survive a commit, a reopen, and compaction.
+func TestBucketPutFlags(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			b := txn.Bucket("widgets")
+			for i := 0; i < 1000; i++ {
+				k := []byte(fmt.Sprintf("%04d", i))
+				assert.NoError(t, b.PutFlags(k, k, uint32(i)<<16))
+			}
+			assert.Equal(t, b.PutFlags([]byte("foo"), []byte("bar"), bucketLeafFlag), ErrInvalidFlags)
+
+			// The flags are read back from the uncommitted nodes.
+			v, flags := b.GetFlags([]byte("0002"))
+			assert.Equal(t, v, []byte("0002"))
+			assert.Equal(t, flags, uint32(2<<16))
+
+			// Put clears the flags.
+			assert.NoError(t, b.Put([]byte("0003"), []byte("bar")))
+			return nil
+		}))
+		check := func(db *DB) {
+			_ = db.View(func(txn *Transaction) error {
+				b := txn.Bucket("widgets")
+				for i := 0; i < 1000; i++ {
+					k := []byte(fmt.Sprintf("%04d", i))
+					_, flags := b.GetFlags(k)
+					if i == 3 {
+						assert.Equal(t, flags, uint32(0))
+					} else {
+						assert.Equal(t, flags, uint32(i)<<16)
+					}
+				}
+				v, flags := b.GetFlags([]byte("foo"))
+				assert.Nil(t, v)
+				assert.Equal(t, flags, uint32(0))
+				return nil
+			})
+		}
+		check(db)
+
+		db.Close()
+		assert.NoError(t, db.Open(path, 0666))
+		check(db)
+
+		// Compaction copies the flags.
+		_, err := db.Compact(path + ".compact")
+		assert.NoError(t, err)
+		defer os.Remove(path + ".compact")
+		var dst DB
+		assert.NoError(t, dst.Open(path+".compact", 0666))
+		defer dst.Close()
+		check(&dst)
+	})
+}
+
+// Ensure that a bucket iterates its keys in order.
+func TestBucketForEach(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			b := txn.Bucket("widgets")
+			for _, i := range []int{5, 1, 4, 2, 3} {
+				b.Put([]byte(fmt.Sprintf("%d", i)), []byte("bar"))
+			}
+			return nil
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			b := txn.Bucket("widgets")
+			var keys []string
+			assert.NoError(t, b.ForEach(func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			}))
+			assert.Equal(t, keys, []string{"1", "2", "3", "4", "5"})
+
+			// An error stops the iteration.
+			exp := fmt.Errorf("stop")
+			var n int
+			assert.Equal(t, b.ForEach(func(k, v []byte) error {
+				n++
+				return exp
+			}), exp)
+			assert.Equal(t, n, 1)
+			return nil
+		})
+	})
+}
+
+// Ensure that a bucket is iterated in batches of keys, in order.
+func TestBucketForEachBatch(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			txn.CreateBucket("woojits")
+			for i := 0; i < 1000; i++ {
+				k := []byte(fmt.Sprintf("%04d", i))
+				txn.Put("widgets", k, k)
+			}
+			return nil
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			var sizes []int
+			var keys []string
+			assert.NoError(t, txn.ForEachBatch("widgets", 300, func(kvs []KV) error {
+				sizes = append(sizes, len(kvs))
+				for _, kv := range kvs {
+					assert.Equal(t, kv.Value, kv.Key)
+					keys = append(keys, string(kv.Key))
+				}
+				return nil
+			}))
+			assert.Equal(t, sizes, []int{300, 300, 300, 100})
+			if assert.Equal(t, len(keys), 1000) {
+				assert.Equal(t, keys[0], "0000")
+				assert.Equal(t, keys[999], "0999")
+			}
+
+			// An empty bucket calls nothing and a batch size below 1 is taken as 1.
+			assert.NoError(t, txn.ForEachBatch("woojits", 10, func(kvs []KV) error {
+				t.Error("unexpected batch")
+				return nil
+			}))
+			var n int
+			exp := fmt.Errorf("stop")
+			assert.Equal(t, txn.Bucket("widgets").ForEachBatch(0, func(kvs []KV) error {
+				assert.Equal(t, len(kvs), 1)
+				if n++; n == 3 {
+					return exp
+				}
+				return nil
+			}), exp)
+			assert.Equal(t, n, 3)
+			assert.Equal(t, txn.ForEachBatch("no_such_bucket", 10, nil), ErrBucketNotFound)
+			return nil
+		})
+	})
+}
+
+// Ensure that a bucket iteration resumes from wherever the callback moved the cursor.
+func TestBucketForEachCursor(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 100; i++ {
+				for j := 0; j < 50; j++ {
+					if err := txn.Put("widgets", []byte(fmt.Sprintf("%02d/%02d", i, j)), make([]byte, 20)); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}))
+
+		_ = db.View(func(txn *Transaction) error {
+			// Visit the first key under each prefix by seeking past the rest.
+			var keys []string
+			assert.NoError(t, txn.ForEachCursor("widgets", func(c *Cursor, k, v []byte) error {
+				keys = append(keys, string(k))
+				c.Seek([]byte(fmt.Sprintf("%s0", k[:2])))
+				return nil
+			}))
+			assert.Equal(t, len(keys), 100)
+			assert.Equal(t, keys[0], "00/00")
+			assert.Equal(t, keys[99], "99/00")
+
+			// Peeking ahead doesn't skip the peeked key.
+			var n int
+			assert.NoError(t, txn.Bucket("widgets").ForEachCursor(func(c *Cursor, k, v []byte) error {
+				n++
+				c.Next()
+				return nil
+			}))
+			assert.Equal(t, n, 5000)
+
+			assert.Equal(t, txn.ForEachCursor("no_such_bucket", nil), ErrBucketNotFound)
+			return nil
+		})
+
+		// Deleting through the cursor visits every key once.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			var n int
+			err := txn.ForEachCursor("widgets", func(c *Cursor, k, v []byte) error {
+				n++
+				return c.Delete()
+			})
+			assert.Equal(t, n, 5000)
+			return err
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			k, _ := txn.Bucket("widgets").Cursor().First()
+			assert.Nil(t, k)
+			return nil
+		})
+	})
+}
+
+// Ensure that a bucket's sequence increases across transactions.
+func TestBucketNextSequence(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			b := txn.Bucket("widgets")
+			for i := uint64(1); i <= 3; i++ {
+				seq, err := b.NextSequence()
+				assert.NoError(t, err)
+				assert.Equal(t, seq, i)
+			}
+			return nil
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			seq, err := txn.NextSequence("widgets")
+			assert.Equal(t, seq, 4)
+			assert.NoError(t, err)
+			seq2, err := txn.Bucket("widgets").NextSequence()
+			assert.Equal(t, seq2, uint64(5))
+			return err
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			_, err := txn.Bucket("widgets").NextSequence()
+			assert.Equal(t, err, ErrTransactionNotWritable)
+			return nil
+		})
+	})
+}
+
+// Ensure that Put rejects keys that fail the bucket's key validator.
+func TestBucketKeyValidator(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		errBadKey := fmt.Errorf("key must be 16 bytes")
+		db.KeyValidators = map[string]func([]byte) error{
+			"events": func(key []byte) error {
+				if len(key) != 16 {
+					return errBadKey
+				}
+				return nil
+			},
+		}
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("events")
+			txn.CreateBucket("widgets")
+			assert.Equal(t, txn.Put("events", []byte("foo"), []byte("bar")), errBadKey)
+			assert.Equal(t, txn.Bucket("events").Put([]byte("foo"), []byte("bar")), errBadKey)
+			assert.NoError(t, txn.Put("events", make([]byte, 16), []byte("bar")))
+
+			// Other buckets aren't affected.
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			b := txn.Bucket("events")
+			assert.Nil(t, b.Get([]byte("foo")))
+			assert.Equal(t, b.Get(make([]byte, 16)), []byte("bar"))
+			return nil
+		})
+	})
+}
+
+// Ensure that operations are counted per bucket.
+func TestBucketOpStats(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			txn.CreateBucket("woojits")
+			txn.Put("widgets", []byte("foo"), []byte("bar"))
+			txn.Put("widgets", []byte("baz"), []byte("bat"))
+			txn.Put("widgets", nil, []byte("bat"))
+			txn.Delete("widgets", []byte("baz"))
+			txn.Put("woojits", []byte("foo"), []byte("bar"))
+			txn.Put("woojits", []byte("baz"), []byte("bat"))
+
+			// Deletes through a cursor are counted too.
+			c := txn.Bucket("woojits").Cursor()
+			c.Seek([]byte("baz"))
+			return c.Delete()
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			txn.Get("widgets", []byte("foo"))
+			txn.Bucket("widgets").Get([]byte("no_such_key"))
+			txn.Get("woojits", []byte("foo"))
+			return nil
+		})
+
+		stats := db.BucketOpStats()
+		assert.Equal(t, len(stats), 2)
+		assert.Equal(t, stats["widgets"], BucketOpStats{GetN: 2, PutN: 2, DeleteN: 1})
+		assert.Equal(t, stats["woojits"], BucketOpStats{GetN: 1, PutN: 2, DeleteN: 1})
+	})
+}
+
+// Ensure that concurrent reads are all counted.
+func TestBucketOpStatsConcurrent(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		}))
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = db.View(func(txn *Transaction) error {
+					for j := 0; j < 1000; j++ {
+						txn.Get("widgets", []byte("foo"))
+					}
+					return nil
+				})
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, db.BucketOpStats()["widgets"].GetN, 8000)
+	})
+}
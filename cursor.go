@@ -6,6 +6,10 @@ import (
 	"sort"
 )
 
+// cursorStackSize is the initial capacity of a cursor's stack.
+// It is deeper than any practical tree so descending never grows the stack.
+const cursorStackSize = 32
+
 // Cursor:
 // This object is simply for traversing the B+tree of on-disk pages or in-memory nodes.
 // It can seek to a specific key, move to the first or last value, or it can move forward or backward.
@@ -13,152 +17,413 @@ import (
 //
 // Cursor represents an iterator that can traverse over all key/value pairs in a **bucket** in sorted order.
 // Cursors can be obtained from a Transaction and are valid as long as the Transaction is open.
+//
+// Within a RWTransaction the cursor reads the transaction's in-memory nodes
+// in place of their pages so that uncommitted changes are visible.
 type Cursor struct {
 	transaction *Transaction
+	bucket      *bucket
+	name        string
 	rootPageID  pageID
 	stack       []pageElementRef
+	deleted     bool // the current element was deleted and replaced by the next one
 }
 
 // First moves the cursor to the first item in the bucket and returns its key and value.
 // If the bucket is empty then a nil key is returned.
 func (c *Cursor) First() (key []byte, value []byte) {
+	c.deleted = false
 	if len(c.stack) > 0 {
 		c.stack = c.stack[:0] // delete all elements
 	}
-	c.stack = append(c.stack, pageElementRef{page: c.transaction.page(c.rootPageID), index: 0})
+	p, n := c.pageNode(c.rootPageID)
+	c.stack = append(c.stack, pageElementRef{page: p, node: n, index: 0})
 	c.first()
+
+	// If we land on an empty leaf then move to the next value.
+	if c.stack[len(c.stack)-1].count() == 0 {
+		return c.Next()
+	}
+	return c.keyValue()
+}
+
+// Last moves the cursor to the last item in the bucket and returns its key and value.
+// If the bucket is empty then a nil key is returned.
+func (c *Cursor) Last() (key []byte, value []byte) {
+	c.deleted = false
+	c.stack = c.stack[:0] // delete all elements
+	p, n := c.pageNode(c.rootPageID)
+	ref := pageElementRef{page: p, node: n}
+	ref.index = max(ref.count()-1, 0)
+	c.stack = append(c.stack, ref)
+	c.last()
+
+	// If we land on an empty leaf then move to the previous value.
+	if c.stack[len(c.stack)-1].count() == 0 {
+		return c.Prev()
+	}
 	return c.keyValue()
 }
 
 // Next moves the cursor to the next item in the bucket and returns its key and value.
 // If the cursor is at the end of the bucket then a nil key returned.
 func (c *Cursor) Next() (key []byte, value []byte) {
-	// Attempt to move over one element until we're successful.
-	// Move up the stack as we hit the end of each page in our stack.
-	for i := len(c.stack) - 1; i >= 0; i-- {
-		elem := &c.stack[i]
-		if elem.index < elem.page.count-1 {
-			elem.index++
-			break
+	// After a Delete() the cursor already points at the next element.
+	if c.deleted {
+		c.deleted = false
+		if ref := &c.stack[len(c.stack)-1]; ref.index < ref.count() {
+			return c.keyValue()
 		}
-		c.stack = c.stack[:i]
 	}
 
-	// If we've hit the end then return nil.
-	if len(c.stack) == 0 {
-		return nil, nil
+	for {
+		// Attempt to move over one element until we're successful.
+		// Move up the stack as we hit the end of each page in our stack.
+		i := len(c.stack) - 1
+		for ; i >= 0; i-- {
+			elem := &c.stack[i]
+			if elem.index < elem.count()-1 {
+				elem.index++
+				break
+			}
+		}
+		c.stack = c.stack[:i+1]
+
+		// If we've hit the end then return nil.
+		if len(c.stack) == 0 {
+			return nil, nil
+		}
+
+		// Move down the stack to find the first element of the first leaf under this branch.
+		// Skip over any leaf that has been emptied within the transaction.
+		c.first()
+		if c.stack[len(c.stack)-1].count() == 0 {
+			continue
+		}
+		return c.keyValue()
 	}
+}
 
-	// Move down the stack to find the first element of the first leaf under this branch.
-	c.first()
-	return c.keyValue()
+// Prev moves the cursor to the previous item in the bucket and returns its key and value.
+// If the cursor is at the beginning of the bucket then a nil key returned.
+func (c *Cursor) Prev() (key []byte, value []byte) {
+	c.deleted = false
+	for {
+		// Attempt to move back one element until we're successful.
+		// Move up the stack as we hit the beginning of each page in our stack.
+		i := len(c.stack) - 1
+		for ; i >= 0; i-- {
+			elem := &c.stack[i]
+			if elem.index > 0 {
+				elem.index--
+				break
+			}
+		}
+		c.stack = c.stack[:i+1]
+
+		// If we've hit the beginning then return nil.
+		if len(c.stack) == 0 {
+			return nil, nil
+		}
+
+		// Move down the stack to find the last element of the last leaf under this branch.
+		// Skip over any leaf that has been emptied within the transaction.
+		c.last()
+		if c.stack[len(c.stack)-1].count() == 0 {
+			continue
+		}
+		return c.keyValue()
+	}
 }
 
 // Get moves the cursor to a given key and returns its value.
 // If the key does not exist then the cursor is left at the closest key and a nil key is returned.
 func (c *Cursor) Get(key []byte) (value []byte) {
+	c.deleted = false
 	// Start from root page and traverse to correct page.
 	c.stack = c.stack[:0] // delete all elements
-	c.search(key, c.transaction.page(c.rootPageID))
-	p, index := c.top()
+	c.search(key, c.rootPageID)
+	ref := &c.stack[len(c.stack)-1]
 
 	// If the cursor is pointing to the end of page then return nil.
-	if index == p.count {
+	if ref.index >= ref.count() {
 		return nil
 	}
 
 	// If our target node isn't the same key as what's passed in then return nil.
-	if !bytes.Equal(key, c.leafElement().key()) {
+	k, v := c.keyValue()
+	if c.transaction.db.compare(key, k) != 0 {
 		return nil
 	}
 
-	return c.leafElement().value()
+	return v
+}
+
+// Seek moves the cursor to a given key and returns its key and value.
+// If the key does not exist then the cursor is moved to the next key, in sorted order.
+// If there are no keys at or after the given key then a nil key is returned.
+func (c *Cursor) Seek(key []byte) (k []byte, v []byte) {
+	c.deleted = false
+	c.stack = c.stack[:0] // delete all elements
+	c.search(key, c.rootPageID)
+
+	// If we're past the end of the leaf then move to the next one.
+	ref := &c.stack[len(c.stack)-1]
+	if ref.index >= ref.count() {
+		return c.Next()
+	}
+	return c.keyValue()
+}
+
+// SeekPrefix moves the cursor to the first key that starts with a given
+// prefix and returns its key and value. Keys with the prefix are only
+// grouped together with the default byte order comparator.
+// If no key starts with the prefix then a nil key is returned. An empty
+// prefix matches every key.
+func (c *Cursor) SeekPrefix(prefix []byte) (k []byte, v []byte) {
+	k, v = c.Seek(prefix)
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		return nil, nil
+	}
+	return k, v
+}
+
+// Delete removes the key/value pair that the cursor is on from the bucket.
+// A following Next() moves to the element after the deleted one.
+// Returns an error if the cursor belongs to a read-only Transaction or isn't on an element.
+func (c *Cursor) Delete() error {
+	t := c.transaction.rwtransaction
+	if t == nil {
+		return ErrTransactionNotWritable
+	}
+	if len(c.stack) == 0 {
+		return ErrCursorNotPositioned
+	}
+	ref := &c.stack[len(c.stack)-1]
+	if c.deleted || ref.index >= ref.count() {
+		return ErrCursorNotPositioned
+	}
+	t.evict()
+	t.db.opCounts(c.name).del.Add(1)
+
+	// Delete the key from the leaf node.
+	key, value := c.keyValue()
+	t.stats.LogicalBytes += len(key) + len(value)
+	c.bucket.modifiedTxID = t.meta.txID
+	n := c.node(t)
+	n.del(key)
+
+	// Point the cursor at the node. The element that followed the deleted
+	// one now has its index so Next() returns it without moving.
+	*ref = pageElementRef{node: n, index: ref.index}
+	c.deleted = true
+	return nil
+}
+
+// Remaining returns the number of keys from the cursor's current position,
+// inclusive, to the end of the bucket.
+// Leaf elements are counted from the page headers without reading keys or values.
+func (c *Cursor) Remaining() int {
+	if len(c.stack) == 0 {
+		return 0
+	}
+
+	// Count the rest of the current leaf page.
+	ref := &c.stack[len(c.stack)-1]
+	n := ref.count() - ref.index
+	if n < 0 {
+		n = 0
+	}
+
+	// Count every leaf under the branch elements to the right of our path.
+	for i := len(c.stack) - 2; i >= 0; i-- {
+		ref := &c.stack[i]
+		for j := ref.index + 1; j < ref.count(); j++ {
+			n += c.count(ref.childPageID(j))
+		}
+	}
+	return n
+}
+
+// resume returns the element to visit after key when the cursor may have
+// been moved since it returned key. If the cursor is still on key then it
+// moves to the next element, otherwise the element it is on is returned.
+func (c *Cursor) resume(key []byte) ([]byte, []byte) {
+	if len(c.stack) == 0 {
+		return nil, nil
+	} else if c.deleted {
+		return c.Next()
+	}
+	k, v := c.keyValue()
+	if k == nil || c.transaction.db.compare(k, key) == 0 {
+		return c.Next()
+	}
+	return k, v
 }
 
 // first moves the cursor to the first leaf element under the last page in the stack.
 func (c *Cursor) first() {
-	p := c.stack[len(c.stack)-1].page
 	for {
 		// Exit when we hit a leaf page.
-		if (p.flags & leafPageFlag) != 0 {
+		ref := &c.stack[len(c.stack)-1]
+		if ref.isLeaf() {
 			break
 		}
 
 		// Keep adding pages pointing to the first element to the stack.
-		p = c.transaction.page(p.branchPageElement(c.stack[len(c.stack)-1].index).pageID)
-		c.stack = append(c.stack, pageElementRef{page: p, index: 0})
+		p, n := c.pageNode(ref.childPageID(ref.index))
+		c.stack = append(c.stack, pageElementRef{page: p, node: n, index: 0})
+	}
+}
+
+// last moves the cursor to the last leaf element under the last page in the stack.
+func (c *Cursor) last() {
+	for {
+		// Exit when we hit a leaf page.
+		ref := &c.stack[len(c.stack)-1]
+		if ref.isLeaf() {
+			break
+		}
+
+		// Keep adding pages pointing to the last element to the stack.
+		p, n := c.pageNode(ref.childPageID(ref.index))
+		next := pageElementRef{page: p, node: n}
+		next.index = max(next.count()-1, 0)
+		c.stack = append(c.stack, next)
 	}
 }
 
 // keyValue returns the key and value of the current leaf element.
 func (c *Cursor) keyValue() ([]byte, []byte) {
 	ref := &c.stack[len(c.stack)-1]
-	if ref.index >= ref.page.count {
+	if ref.index >= ref.count() {
 		return nil, nil
 	}
-	e := ref.page.leafPageElement(ref.index)
+
+	// Retrieve value from node.
+	if ref.node != nil {
+		inode := &ref.node.children[ref.index]
+		return inode.key, inode.value
+	}
+
+	// Or retrieve value from page.
+	e := ref.page.leafPageElement(uint16(ref.index))
 	return e.key(), e.value()
 }
 
-// top returns the page and leaf node that the cursor is currently pointing at.
-func (c *Cursor) top() (*page, uint16) {
-	ptr := c.stack[len(c.stack)-1]
-	return ptr.page, ptr.index
+// flags returns the flags of the current leaf element.
+func (c *Cursor) flags() uint32 {
+	ref := &c.stack[len(c.stack)-1]
+	if ref.index >= ref.count() {
+		return 0
+	}
+	if ref.node != nil {
+		return ref.node.children[ref.index].flags
+	}
+	return ref.page.leafPageElement(uint16(ref.index)).flags
 }
 
-// element returns the leaf element that the cursor is currently positioned on.
-func (c *Cursor) leafElement() *leafPageElement {
-	ref := c.stack[len(c.stack)-1]
-	return ref.page.leafPageElement(ref.index)
+// pageNode returns the in-memory node for a page if the transaction has one.
+// Otherwise it returns the page.
+func (c *Cursor) pageNode(id pageID) (*page, *node) {
+	if t := c.transaction.rwtransaction; t != nil {
+		if n := t.nodes[id]; n != nil {
+			return nil, n
+		}
+	}
+	return c.transaction.page(id), nil
+}
+
+// count recursively sums the number of leaf elements under a page.
+func (c *Cursor) count(id pageID) int {
+	p, n := c.pageNode(id)
+	ref := pageElementRef{page: p, node: n}
+	if ref.isLeaf() {
+		return ref.count()
+	}
+	var count int
+	for i := 0; i < ref.count(); i++ {
+		count += c.count(ref.childPageID(i))
+	}
+	return count
 }
 
 // search recursively performs a binary search against a given page until it finds a given key.
-func (c *Cursor) search(key []byte, p *page) {
-	if (p.flags & (branchPageFlag | leafPageFlag)) == 0 {
+func (c *Cursor) search(key []byte, id pageID) {
+	p, n := c.pageNode(id)
+	if p != nil && (p.flags&(branchPageFlag|leafPageFlag)) == 0 {
 		panic(fmt.Sprintf("assertion failed: invalid page type: %s", p.typ()))
 	}
-	e := pageElementRef{page: p}
+	e := pageElementRef{page: p, node: n}
 	c.stack = append(c.stack, e)
 
 	// If we're on a leaf page then find the specific node.
-	if (p.flags & leafPageFlag) != 0 {
-		c.nsearch(key, p)
+	if e.isLeaf() {
+		c.nsearch(key)
 		return
 	}
 
-	// Binary search for the correct range.
-	inodes := p.branchPageElements()
+	index := c.bsearch(e, key)
+	c.stack[len(c.stack)-1].index = index
+
+	// Recursively search to the next page.
+	c.search(key, e.childPageID(index))
+}
+
+// searchNode moves the cursor to a given key like Get() and returns the leaf
+// node that holds the key along with the key's current value, or nil if it
+// doesn't exist. The nodes along the path are read in as the cursor descends
+// so that the leaf can be changed without walking the tree a second time.
+func (c *Cursor) searchNode(t *RWTransaction, key []byte) (*node, []byte) {
+	c.deleted = false
+	c.stack = c.stack[:0] // delete all elements
 
+	n := t.node(c.rootPageID, nil)
+	for !n.isLeaf {
+		e := pageElementRef{node: n}
+		e.index = c.bsearch(e, key)
+		c.stack = append(c.stack, e)
+		n = n.childAt(e.index)
+	}
+	c.stack = append(c.stack, pageElementRef{node: n})
+	c.nsearch(key)
+
+	// Only return the value of an exact match.
+	k, v := c.keyValue()
+	if k == nil || c.transaction.db.compare(key, k) != 0 {
+		return n, nil
+	}
+	return n, v
+}
+
+// bsearch returns the index of the branch element whose child may hold a given key.
+func (c *Cursor) bsearch(e pageElementRef, key []byte) int {
+	// Binary search for the correct range.
 	var exact bool
-	index := sort.Search(int(p.count), func(i int) bool {
+	index := sort.Search(e.count(), func(i int) bool {
 		// TODO(benbjohnson): Optimize this range search. It's a bit hacky right now.
 		// sort.Search() finds the lowest index where f() != -1 but we need the highest index.
-		ret := bytes.Compare(inodes[i].key(), key)
+		ret := c.transaction.db.compare(e.key(i), key)
 		if ret == 0 {
 			exact = true
 		}
-		return ret != -1
+		return ret >= 0
 	})
 	// false
 	if !exact && index > 0 {
 		index--
 	}
-	c.stack[len(c.stack)-1].index = uint16(index)
-
-	// Recursively search to the next page.
-	c.search(key, c.transaction.page(inodes[index].pageID))
+	return index
 }
 
-// nsearch searches a leaf node for the index of the node that matches key.
-func (c *Cursor) nsearch(key []byte, p *page) {
+// nsearch searches the leaf at the top of the stack for the index of the node that matches key.
+func (c *Cursor) nsearch(key []byte) {
 	e := &c.stack[len(c.stack)-1]
 
 	// Binary search for the correct leaf node index.
-	inodes := p.leafPageElements()
-	index := sort.Search(int(p.count), func(i int) bool {
-		return bytes.Compare(inodes[i].key(), key) != -1
+	e.index = sort.Search(e.count(), func(i int) bool {
+		return c.transaction.db.compare(e.key(i), key) >= 0
 	})
-	e.index = uint16(index)
 }
 
 // node returns the node that the cursor is currently positioned on.
@@ -167,22 +432,28 @@ func (c *Cursor) node(t *RWTransaction) *node {
 		panic("assertion failed: accessing a node with a zero-length cursor stack")
 	}
 
+	// If the top of the stack is a leaf node then just return it, unless it
+	// has been evicted from the transaction's cache since.
+	if ref := &c.stack[len(c.stack)-1]; ref.node != nil && ref.isLeaf() && t.nodes[ref.node.pageID] == ref.node {
+		return ref.node
+	}
+
 	// Start from root and traverse down the hierarchy.
-	n := t.node(c.stack[0].page.id, nil)
+	n := t.node(c.stack[0].pageID(), nil)
 	for _, ref := range c.stack[:len(c.stack)-1] {
 		if n.isLeaf {
 			panic("assertion failed: expected branch node")
 		}
-		if ref.page.id != n.pageID {
-			panic(fmt.Sprintf("assertion failed: node/page mismatch a: %d != %d", ref.page.id, n.childAt(int(ref.index)).pageID))
+		if id := ref.pageID(); id != n.pageID {
+			panic(fmt.Sprintf("assertion failed: node/page mismatch a: %d != %d", id, n.pageID))
 		}
-		n = n.childAt(int(ref.index))
+		n = n.childAt(ref.index)
 	}
 	if !n.isLeaf {
 		panic("assertion failed: expected leaf node")
 	}
-	if n.pageID != c.stack[len(c.stack)-1].page.id {
-		panic(fmt.Sprintf("assertion failed: node/page mismatch b: %d != %d", n.pageID, c.stack[len(c.stack)-1].page.id))
+	if id := c.stack[len(c.stack)-1].pageID(); n.pageID != id {
+		panic(fmt.Sprintf("assertion failed: node/page mismatch b: %d != %d", n.pageID, id))
 	}
 	return n
 }
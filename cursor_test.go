@@ -0,0 +1,389 @@
+package toyboltdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensure that a cursor can count the keys remaining from its position.
+func TestCursorRemaining(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 1000; i++ {
+				txn.Put("widgets", []byte(fmt.Sprintf("%04d", i)), make([]byte, 100))
+			}
+			return nil
+		})
+
+		_ = db.View(func(txn *Transaction) error {
+			c := txn.Bucket("widgets").Cursor()
+			assert.Equal(t, c.Remaining(), 0)
+
+			c.First()
+			assert.Equal(t, c.Remaining(), 1000)
+			for i := 0; i < 10; i++ {
+				c.Next()
+			}
+			assert.Equal(t, c.Remaining(), 990)
+
+			c.Get([]byte("0500"))
+			assert.Equal(t, c.Remaining(), 500)
+			c.Get([]byte("0999"))
+			assert.Equal(t, c.Remaining(), 1)
+
+			c.Next()
+			assert.Equal(t, c.Remaining(), 0)
+			return nil
+		})
+	})
+}
+
+// Ensure that descending the tree doesn't grow the cursor's stack.
+func TestCursorStackPresized(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 1000; i++ {
+				txn.Put("widgets", []byte(fmt.Sprintf("%0500d", i)), []byte("bar"))
+			}
+			return nil
+		})
+
+		_ = db.View(func(txn *Transaction) error {
+			c := txn.Bucket("widgets").Cursor()
+			assert.Equal(t, cap(c.stack), cursorStackSize)
+			c.Get([]byte(fmt.Sprintf("%0500d", 500)))
+			assert.True(t, len(c.stack) > 2)
+			assert.Equal(t, cap(c.stack), cursorStackSize)
+			return nil
+		})
+	})
+}
+
+// Ensure that searching for a node positions the cursor like Get and returns its leaf.
+func TestCursorSearchNode(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 1000; i += 2 {
+				txn.Put("widgets", []byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+			}
+			return nil
+		})
+
+		_ = db.Update(func(txn *RWTransaction) error {
+			c := txn.Bucket("widgets").Cursor()
+			n, v := c.searchNode(txn, []byte("0500"))
+			assert.Equal(t, v, []byte("v500"))
+			assert.True(t, len(c.stack) > 1)
+			assert.Equal(t, c.node(txn), n)
+			k, _ := c.keyValue()
+			assert.Equal(t, k, []byte("0500"))
+
+			// A missing key leaves the cursor where it would be inserted.
+			n, v = c.searchNode(txn, []byte("0501"))
+			assert.Nil(t, v)
+			assert.Equal(t, c.node(txn), n)
+			k, _ = c.keyValue()
+			assert.Equal(t, k, []byte("0502"))
+			return nil
+		})
+	})
+}
+
+// Benchmark point lookups through a cursor.
+func BenchmarkCursorGet(b *testing.B) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 10000; i++ {
+				txn.Put("widgets", []byte(fmt.Sprintf("%05d", i)), []byte("bar"))
+			}
+			return nil
+		})
+
+		_ = db.View(func(txn *Transaction) error {
+			bucket := txn.Bucket("widgets")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if bucket.Cursor().Get([]byte(fmt.Sprintf("%05d", i%10000))) == nil {
+					b.Fatal("key not found")
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// Ensure that a cursor can iterate over a bucket in reverse.
+func TestCursorLastPrev(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 1000; i++ {
+				txn.Put("widgets", []byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("%d", i)))
+			}
+			return nil
+		})
+
+		_ = db.View(func(txn *Transaction) error {
+			c := txn.Bucket("widgets").Cursor()
+			k, v := c.Last()
+			assert.Equal(t, k, []byte("0999"))
+			assert.Equal(t, v, []byte("999"))
+
+			n := 1
+			prev := k
+			for k, _ = c.Prev(); k != nil; k, _ = c.Prev() {
+				assert.True(t, string(k) < string(prev))
+				prev = k
+				n++
+			}
+			assert.Equal(t, n, 1000)
+			assert.Equal(t, prev, []byte("0000"))
+
+			// Moving past the beginning leaves the stack empty and Last() still works.
+			assert.Equal(t, len(c.stack), 0)
+			k, _ = c.Prev()
+			assert.Nil(t, k)
+			k, _ = c.Last()
+			assert.Equal(t, k, []byte("0999"))
+
+			// Next and Prev can be mixed.
+			k, _ = c.Prev()
+			assert.Equal(t, k, []byte("0998"))
+			k, _ = c.Next()
+			assert.Equal(t, k, []byte("0999"))
+			return nil
+		})
+	})
+}
+
+// Ensure that Last() on an empty bucket returns nil.
+func TestCursorLastEmpty(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		})
+		_ = db.View(func(txn *Transaction) error {
+			c := txn.Bucket("widgets").Cursor()
+			k, v := c.Last()
+			assert.Nil(t, k)
+			assert.Nil(t, v)
+			k, _ = c.Prev()
+			assert.Nil(t, k)
+			return nil
+		})
+	})
+}
+
+// Ensure that reverse iteration sees uncommitted changes and skips emptied leaves.
+func TestCursorLastPrevUncommitted(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 1000; i++ {
+				txn.Put("widgets", []byte(fmt.Sprintf("%04d", i)), []byte("bar"))
+			}
+			return nil
+		})
+		_ = db.Update(func(txn *RWTransaction) error {
+			for i := 500; i < 1000; i++ {
+				txn.Delete("widgets", []byte(fmt.Sprintf("%04d", i)))
+			}
+			c := txn.Bucket("widgets").Cursor()
+			k, _ := c.Last()
+			assert.Equal(t, k, []byte("0499"))
+			var n int
+			for ; k != nil; k, _ = c.Prev() {
+				n++
+			}
+			assert.Equal(t, n, 500)
+			return nil
+		})
+	})
+}
+
+// Ensure that a cursor can seek to a key or the next one after it.
+func TestCursorSeek(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 1000; i += 2 {
+				txn.Put("widgets", []byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("%d", i)))
+			}
+			return nil
+		})
+
+		_ = db.View(func(txn *Transaction) error {
+			c := txn.Bucket("widgets").Cursor()
+
+			// Exact match.
+			k, v := c.Seek([]byte("0500"))
+			assert.Equal(t, k, []byte("0500"))
+			assert.Equal(t, v, []byte("500"))
+
+			// Missing keys land on the next key, including across pages.
+			for i := 1; i < 998; i += 2 {
+				k, _ = c.Seek([]byte(fmt.Sprintf("%04d", i)))
+				assert.Equal(t, k, []byte(fmt.Sprintf("%04d", i+1)))
+			}
+
+			// Before the first key and past the last key.
+			k, _ = c.Seek([]byte(""))
+			assert.Equal(t, k, []byte("0000"))
+			k, v = c.Seek([]byte("0999"))
+			assert.Nil(t, k)
+			assert.Nil(t, v)
+
+			// A range scan from a seek.
+			var keys []string
+			for k, _ := c.Seek([]byte("0101")); k != nil && string(k) <= "0110"; k, _ = c.Next() {
+				keys = append(keys, string(k))
+			}
+			assert.Equal(t, keys, []string{"0102", "0104", "0106", "0108", "0110"})
+			return nil
+		})
+	})
+}
+
+// Ensure that a cursor can seek to the first key with a prefix.
+func TestCursorSeekPrefix(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for _, k := range []string{"ap", "app", "apple", "apples", "apply", "b", "\xff", "\xff\xff\x01"} {
+				txn.Put("widgets", []byte(k), []byte("bar"))
+			}
+			return nil
+		})
+
+		_ = db.View(func(txn *Transaction) error {
+			b := txn.Bucket("widgets")
+			k, v := b.Cursor().SeekPrefix([]byte("appl"))
+			assert.Equal(t, k, []byte("apple"))
+			assert.Equal(t, v, []byte("bar"))
+			k, v = b.Cursor().SeekPrefix([]byte("apz"))
+			assert.Nil(t, k)
+			assert.Nil(t, v)
+			k, _ = b.Cursor().SeekPrefix([]byte("c"))
+			assert.Nil(t, k)
+
+			prefixed := func(prefix string) []string {
+				var keys []string
+				assert.NoError(t, b.ForEachPrefix([]byte(prefix), func(k, v []byte) error {
+					keys = append(keys, string(k))
+					return nil
+				}))
+				return keys
+			}
+			assert.Equal(t, prefixed("app"), []string{"app", "apple", "apples", "apply"})
+			assert.Equal(t, prefixed("apple"), []string{"apple", "apples"})
+			assert.Equal(t, prefixed("apples"), []string{"apples"})
+			assert.Nil(t, prefixed("applz"))
+			assert.Equal(t, prefixed("\xff"), []string{"\xff", "\xff\xff\x01"})
+			assert.Equal(t, prefixed("\xff\xff"), []string{"\xff\xff\x01"})
+			assert.Equal(t, len(prefixed("")), 8)
+
+			// An error stops the iteration.
+			exp := fmt.Errorf("stop")
+			var n int
+			assert.Equal(t, b.ForEachPrefix([]byte("app"), func(k, v []byte) error {
+				n++
+				return exp
+			}), exp)
+			assert.Equal(t, n, 1)
+			return nil
+		})
+	})
+}
+
+// Ensure that a cursor can delete keys while iterating.
+func TestCursorDelete(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 1000; i++ {
+				txn.Put("widgets", []byte(fmt.Sprintf("%04d", i)), []byte("bar"))
+			}
+			return nil
+		})
+
+		// Delete every other key.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			c := txn.Bucket("widgets").Cursor()
+			var i int
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				assert.Equal(t, k, []byte(fmt.Sprintf("%04d", i)))
+				if i%2 == 0 {
+					assert.NoError(t, c.Delete())
+					assert.Equal(t, c.Delete(), ErrCursorNotPositioned)
+				}
+				i++
+			}
+			assert.Equal(t, i, 1000)
+			return nil
+		}))
+
+		_ = db.View(func(txn *Transaction) error {
+			var keys []string
+			txn.ForEach("widgets", func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+			assert.Equal(t, len(keys), 500)
+			for i, k := range keys {
+				assert.Equal(t, k, fmt.Sprintf("%04d", i*2+1))
+			}
+			return nil
+		})
+	})
+}
+
+// Ensure that Prev() after a delete moves to the element before the deleted one.
+func TestCursorDeletePrev(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			txn.Put("widgets", []byte("bar"), []byte("0"))
+			txn.Put("widgets", []byte("baz"), []byte("1"))
+			txn.Put("widgets", []byte("foo"), []byte("2"))
+
+			c := txn.Bucket("widgets").Cursor()
+			c.Seek([]byte("baz"))
+			assert.NoError(t, c.Delete())
+			assert.Equal(t, c.Remaining(), 1)
+			k, _ := c.Prev()
+			assert.Equal(t, k, []byte("bar"))
+			k, _ = c.Next()
+			assert.Equal(t, k, []byte("foo"))
+			return nil
+		})
+	})
+}
+
+// Ensure that a cursor can't delete without a writable transaction or a position.
+func TestCursorDeleteErrors(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			txn.Put("widgets", []byte("foo"), []byte("bar"))
+
+			c := txn.Bucket("widgets").Cursor()
+			assert.Equal(t, c.Delete(), ErrCursorNotPositioned)
+			c.Seek([]byte("zzz"))
+			assert.Equal(t, c.Delete(), ErrCursorNotPositioned)
+			return nil
+		})
+		_ = db.View(func(txn *Transaction) error {
+			c := txn.Bucket("widgets").Cursor()
+			c.First()
+			assert.Equal(t, c.Delete(), ErrTransactionNotWritable)
+			return nil
+		})
+	})
+}
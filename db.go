@@ -1,22 +1,60 @@
 package toyboltdb
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
 const (
 	minMmapSize = 1 << 22 // 4MB
 	maxMmapStep = 1 << 30 // 1GB
+
+	// flockRetryInterval is how long Open sleeps between attempts to lock the data file.
+	flockRetryInterval = 50 * time.Millisecond
+
+	// waitTxIDInterval is how often WaitForTxID polls the meta pages.
+	waitTxIDInterval = 10 * time.Millisecond
+)
+
+const (
+	// DefaultFillPercent is the fill target for split pages when DB.FillPercent is not set.
+	DefaultFillPercent = 0.5
+
+	minFillPercent = 0.1
+	maxFillPercent = 1.0
+
+	// DefaultWriteRetryBackoff is the wait before the first retry of a write
+	// when DB.WriteRetryBackoff is not set.
+	DefaultWriteRetryBackoff = time.Millisecond
+)
+
+// MetaChoice selects the meta page that Open treats as active.
+// The values aren't page indexes: the zero value is ForceMetaAuto so that a
+// DB picks its meta page itself unless told otherwise, ForceMeta0 is 1 and
+// ForceMeta1 is 2.
+type MetaChoice int
+
+const (
+	ForceMetaAuto MetaChoice = iota // the valid meta page with the highest transaction id
+	ForceMeta0                      // meta page 0
+	ForceMeta1                      // meta page 1
 )
 
 const (
 	errMsgStat         = "stat error"
 	errMsgMeta         = "meta error"
+	errMsgMetaRead     = "meta read error"
 	errMsgFileTooSmall = "file size too small"
 	errMsgMmapStat     = "mmap stat error"
 )
@@ -25,6 +63,123 @@ const (
 // All data access is performed through transactions which can be obtained through the DB.
 // All the functions on DB will return a ErrDatabaseNotOpen if accessed before Open() is called.
 type DB struct {
+	// When enabled, the data file is opened with O_DIRECT so page writes bypass
+	// the OS page cache. Reads still go through the mmap.
+	// This must be set before calling Open().
+	DirectIO bool
+
+	// Comparator orders the keys within buckets. Defaults to bytes.Compare.
+	// The on-disk order depends on it, so the file records ComparatorName and
+	// reopening with a different comparator returns ErrComparatorMismatch.
+	// Both must be set before calling Open().
+	Comparator     func(a, b []byte) int
+	ComparatorName string
+
+	// FillPercent is how full, as a fraction of the page size, pages are
+	// packed when a node is split during commit. A higher fill suits append
+	// mostly workloads. It is clamped to the range 0.1 to 1.0 and defaults to
+	// DefaultFillPercent. It is read at commit so it can be changed between
+	// write transactions.
+	FillPercent float64
+
+	// MaxOverflowPages caps the number of overflow pages that a single entry
+	// may need. Put() returns ErrValueTooLarge for larger entries. Zero means
+	// no cap beyond MaxValueSize.
+	MaxOverflowPages int
+
+	// ForceMetaChoice makes Open use meta page 0 or 1, with ForceMeta0 or
+	// ForceMeta1, regardless of transaction ids and skips validating the
+	// other meta page. This is unsafe and only meant for recovering a
+	// database whose newest meta page is bad. The first commit overwrites the
+	// other meta page and from then on the newest meta page is used again.
+	// This must be set before calling Open().
+	ForceMetaChoice MetaChoice
+
+	// Timeout is how long Open waits for a file lock held by another
+	// process. Zero waits forever and a negative value fails right away
+	// with ErrDatabaseInUse. This must be set before calling Open().
+	Timeout time.Duration
+
+	// InitialMmapSize is the minimum size, in bytes, that the data file is
+	// memory-mapped at. Mapping a file that will grow large up front avoids
+	// remapping, which blocks all transactions, as it grows.
+	// This must be set before calling Open().
+	InitialMmapSize int
+
+	// When enabled, the meta page is written without O_SYNC and the data
+	// file isn't synced before it. This is meant for bulk loads that can be
+	// redone from scratch: it is much faster but durability is given up and
+	// a crash may lose the last transactions or corrupt the database. Call
+	// Sync() once the load is done, before closing the database.
+	// This must be set before calling Open().
+	NoSync bool
+
+	// When enabled, a write transaction never grows the memory map. An
+	// allocation past the end of the map returns ErrDatabaseFull instead, so
+	// the map must be grown ahead of time with GrowTo().
+	// This must be set before calling Open().
+	NoAutoGrow bool
+
+	// ExpectPageSize makes Open fail with ErrPageSizeMismatch if the data
+	// file's page size is different, such as for a file created on a machine
+	// with another OS page size. A new file is only created if the OS page
+	// size matches. Zero accepts any page size.
+	// This must be set before calling Open().
+	ExpectPageSize int
+
+	// NodeCacheLimit is the number of nodes a write transaction caches
+	// before it evicts the ones it hasn't changed. Modified nodes and the
+	// branches above them stay cached until commit. Zero means no limit.
+	// It is read by each write so it can be changed between transactions.
+	NodeCacheLimit int
+
+	// MaxBatchSize is the largest number of calls that Batch() runs in one
+	// transaction. Defaults to DefaultMaxBatchSize when zero.
+	MaxBatchSize int
+
+	// MaxBatchDelay is how long Batch() waits for more calls before it
+	// starts a transaction. Defaults to DefaultMaxBatchDelay when zero.
+	MaxBatchDelay time.Duration
+
+	// KeyValidators maps bucket names to functions that check each key that
+	// is put into the bucket. Put() returns the validator's error and leaves
+	// the bucket unchanged if it rejects a key. Validators are not stored in
+	// the data file so they must be set every time the database is opened.
+	KeyValidators map[string]func(key []byte) error
+
+	// MaxPendingPageN is the number of pending pages, freed but still in use
+	// by open read transactions, above which starting a write transaction
+	// logs a warning. A read transaction that is never closed lets pending
+	// pages, and the memory that tracks them, grow without bound. Zero means
+	// no limit. It is read by each write so it can be changed between
+	// transactions.
+	MaxPendingPageN int
+
+	// When enabled, starting a write transaction while more than
+	// MaxPendingPageN pages are pending fails with ErrTooManyPendingPages
+	// instead of logging a warning, so that writers back off until the
+	// readers close.
+	StrictMaxPendingPageN bool
+
+	// WriteRetries is how many times a commit retries a write of the data
+	// file that failed with EINTR or EAGAIN, or that was cut short, before
+	// the commit fails. The rest of the write is retried. This helps on
+	// network filesystems where writes fail now and then. Zero means no
+	// retries. It is read by each write so it can be changed between
+	// transactions.
+	WriteRetries int
+
+	// WriteRetryBackoff is how long a commit waits before retrying a write.
+	// The wait doubles for each retry of the same write. Defaults to
+	// DefaultWriteRetryBackoff when zero.
+	WriteRetryBackoff time.Duration
+
+	// OnRemap is called after the data file has been remapped, with the new
+	// map size and the time taken. Transactions are blocked while remapping
+	// so frequent remaps point to a file that would benefit from pre-growing.
+	// It is called with the database locked and must not start a transaction.
+	OnRemap func(size int, d time.Duration)
+
 	os       _os
 	syscall  _syscall
 	path     string
@@ -33,15 +188,92 @@ type DB struct {
 	mmapdata []byte // mmap
 	meta0    *meta
 	meta1    *meta
+	force    MetaChoice // ForceMetaChoice in effect until the first commit
+	advice   int        // madvise advice for the mmap, protected by the mmaplock
 	pageSize int
 	isOpened bool
+	readOnly bool
 	rwtx     *RWTransaction
 	txs      []*Transaction
 	freelist *freelist
+	stats    dbStats
+	opstats  sync.Map // bucket name to *bucketOpCounts
+
+	// Whether the MaxPendingPageN warning was logged since going over it,
+	// protected by the metalock.
+	pendingWarned bool
 
 	rwlock   sync.Mutex   // Allows only one writer at a time.
 	metalock sync.Mutex   // Protects meta page access.
 	mmaplock sync.RWMutex // Protects mmap access during remapping.
+
+	batchlock sync.Mutex // Protects the batch being filled.
+	batch     *batch
+}
+
+// dbStats holds the counters reported by Stats(). They are atomics so that
+// Stats() can be sampled without taking the locks that transactions take.
+// They are updated at points where the matching lock is already held.
+type dbStats struct {
+	remapN    atomic.Int64
+	remapTime atomic.Int64
+	txN       atomic.Int64
+	commitN   atomic.Int64
+	openTxN   atomic.Int64
+
+	// Only set while the database is open.
+	freePageN    atomic.Int64
+	pendingPageN atomic.Int64
+	pageSize     atomic.Int64
+	highWater    atomic.Int64
+}
+
+// bucketOpCounts holds the counters reported by BucketOpStats() for a bucket.
+// They are atomics so that counting a Get() doesn't take a lock.
+type bucketOpCounts struct {
+	get atomic.Int64
+	put atomic.Int64
+	del atomic.Int64
+}
+
+// Options represents the options that can be set when opening a database.
+// See the DB fields of the same name for details.
+type Options struct {
+	// Timeout is how long to wait for a file lock held by another process.
+	Timeout time.Duration
+
+	// ReadOnly opens the database for reading only, as OpenReadOnly() does.
+	ReadOnly bool
+
+	// InitialMmapSize is the minimum size that the data file is mapped at.
+	InitialMmapSize int
+
+	// NoSync skips syncing data and meta page writes.
+	NoSync bool
+
+	// NoAutoGrow makes writes that would grow the map fail instead.
+	NoAutoGrow bool
+
+	// ExpectPageSize is the page size that the data file must have.
+	ExpectPageSize int
+}
+
+// Stats represents statistics about the database.
+type Stats struct {
+	RemapN    int           // number of times the data file was remapped
+	RemapTime time.Duration // total time spent remapping
+	TxN       int           // total number of read transactions started
+	CommitN   int           // total number of write transactions committed
+
+	// The following are only set while the database is open.
+	// Freelist counts and the high water mark are as of the last write
+	// transaction.
+	FreePageN       int // number of free pages
+	PendingPageN    int // number of pages freed but still in use by open transactions
+	PendingAlloc    int // bytes allocated in pending pages
+	OpenTxN         int // number of open read transactions
+	PageSize        int // page size in bytes
+	HighWaterPageID int // id of the first page past the end of the data
 }
 
 func (db *DB) Path() string {
@@ -67,7 +299,81 @@ func (db *DB) String() string {
 // - read or create meta0, meta1, freelist, (empty leaf) bucket pages
 // - mmap
 // - reference the above pages to the db
+//
+// Returns ErrTimeout if the file is still locked by another DB after Timeout.
 func (db *DB) Open(path string, mode os.FileMode) error {
+	return db.OpenWithOptions(path, mode, nil)
+}
+
+// OpenAndSeed opens a data file like Open() and, if nothing has been
+// committed to it yet, runs seed in a write transaction that is committed
+// before returning. This is the case when Open() has just created the file.
+// Seeding is skipped for a database that already has data.
+// If seed or its commit fails then the database is closed and the error is
+// returned. Nothing seed wrote is kept, so the next OpenAndSeed() seeds again.
+func (db *DB) OpenAndSeed(path string, mode os.FileMode, seed func(*RWTransaction) error) error {
+	if err := db.Open(path, mode); err != nil {
+		return err
+	}
+
+	t, err := db.rwtxBegin()
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	// A new file's meta pages hold transactions 0 and 1.
+	if t.meta.txID > 2 {
+		t.Rollback()
+		return nil
+	}
+
+	if err := seed(t); err != nil {
+		t.Rollback()
+		db.Close()
+		return err
+	}
+	if err := t.Commit(); err != nil {
+		db.Close()
+		return err
+	}
+	return nil
+}
+
+// OpenReadOnly opens an existing data file at the given path for reading only.
+// The file is opened O_RDONLY so it can live on read-only media. Read
+// transactions work as usual while write transactions return ErrDatabaseReadOnly.
+// No file lock is taken so that any number of read-only DBs, in this process
+// or in others, can open the file while one writer has it open.
+func (db *DB) OpenReadOnly(path string, mode os.FileMode) error {
+	opts := db.options()
+	opts.ReadOnly = true
+	return db.OpenWithOptions(path, mode, opts)
+}
+
+// OpenWithOptions opens a data file like Open() but with the given options.
+// The options are stored on the DB's fields of the same name. Passing nil
+// options keeps the fields as they are, which is equivalent to the default
+// Options unless the fields were set.
+func (db *DB) OpenWithOptions(path string, mode os.FileMode, opts *Options) error {
+	if opts == nil {
+		opts = db.options()
+	}
+	return db.open(path, mode, opts)
+}
+
+// options returns the Options that the DB's fields are currently set to.
+func (db *DB) options() *Options {
+	return &Options{
+		Timeout:         db.Timeout,
+		InitialMmapSize: db.InitialMmapSize,
+		NoSync:          db.NoSync,
+		NoAutoGrow:      db.NoAutoGrow,
+		ExpectPageSize:  db.ExpectPageSize,
+	}
+}
+
+func (db *DB) open(path string, mode os.FileMode, opts *Options) error {
 	var err error
 	db.metalock.Lock()
 	defer db.metalock.Unlock()
@@ -86,53 +392,199 @@ func (db *DB) Open(path string, mode os.FileMode) error {
 		return ErrDatabaseOpen
 	}
 
+	// A custom comparator must be identifiable so it can be checked on reopen.
+	if db.Comparator != nil && db.ComparatorName == "" {
+		return ErrComparatorNameRequired
+	}
+
+	// Resolve the options.
+	db.Timeout = opts.Timeout
+	db.InitialMmapSize = opts.InitialMmapSize
+	db.NoSync = opts.NoSync
+	db.NoAutoGrow = opts.NoAutoGrow
+	db.ExpectPageSize = opts.ExpectPageSize
+	readOnly := opts.ReadOnly
+
 	// Open data file and separate **sync handler** for metadata writes.
+	// A read-only database has no meta file since it never writes.
 	db.path = path
-	if db.file, err = db.os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, mode); err != nil {
-		db.close()
-		return err
+	db.force = db.ForceMetaChoice
+	db.readOnly = readOnly
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	} else if db.DirectIO {
+		flag |= oDirect
 	}
-	if db.metafile, err = db.os.OpenFile(db.path, os.O_RDWR|os.O_SYNC, mode); err != nil {
+	// Handles are only kept on success so that close() never sees a nil file.
+	f, err := db.os.OpenFile(db.path, flag, mode)
+	if err != nil {
 		db.close()
 		return err
 	}
 
+	// Lock the data file so that other processes can't write to it at the
+	// same time. A read-only DB doesn't take the lock so that it can read
+	// alongside the writer and pick up its commits.
+	if !readOnly {
+		if err := db.flock(f, syscall.LOCK_EX); err != nil {
+			_ = f.Close()
+			db.close()
+			return err
+		}
+	}
+	db.file = f
+	if !readOnly {
+		flag := os.O_RDWR | os.O_SYNC
+		if db.NoSync {
+			flag = os.O_RDWR
+		}
+		if f, err = db.os.OpenFile(db.path, flag, mode); err != nil {
+			db.close()
+			return err
+		}
+		db.metafile = f
+	}
+
 	// Initialize the database if it doesn't exist.
 	if info, err := db.file.Stat(); err != nil {
+		db.close()
 		return fmt.Errorf("%s: %w", errMsgStat, err)
+	} else if info.Size() == 0 && readOnly {
+		// A read-only database can't be initialized.
+		db.close()
+		return ErrInvalid
 	} else if info.Size() == 0 {
 		// Initialize new files with meta pages.
+		if db.ExpectPageSize != 0 && db.os.Getpagesize() != db.ExpectPageSize {
+			db.close()
+			return ErrPageSizeMismatch
+		}
 		if err := db.init(); err != nil {
+			db.close()
 			return err
 		}
 	} else {
 		// Read the first meta page to determine the page size.
-		var buf [0x1000]byte // QQQ 0x1000 -> 4096 4KiB the default page size?
-		if _, err := db.file.ReadAt(buf[:], 0); err == nil {
-			// pageID 0
-			m := db.pageInBuffer(buf[:], 0).meta()
-			if err := m.validate(); err != nil {
-				return fmt.Errorf("%s: %w", errMsgMeta, err)
+		// Meta page 1 is read instead if meta page 0 is corrupt or if it is
+		// forced. The buffer is aligned so the read also works with DirectIO.
+		buf := alignedBuffer(0x1000, 0x1000) // QQQ 0x1000 -> 4096 4KiB the default page size?
+		if err := db.readFull(buf[:], 0); err != nil {
+			db.close()
+			return fmt.Errorf("%s: %w", errMsgMetaRead, err)
+		}
+		// pageID 0
+		m := db.pageInBuffer(buf[:], 0).meta()
+		err := m.validate()
+		if db.force == ForceMeta1 {
+			err = db.readMeta1(buf, m)
+		} else if err != nil && db.force == ForceMetaAuto {
+			if db.readMeta1(buf, m) == nil {
+				err = nil
 			}
-			db.pageSize = int(m.pageSize)
+		}
+		if err != nil {
+			db.close()
+			return fmt.Errorf("%s: %w", errMsgMeta, err)
+		}
+		if m.comparator != db.comparatorID() {
+			db.close()
+			return ErrComparatorMismatch
+		}
+		db.pageSize = int(m.pageSize)
+		if db.ExpectPageSize != 0 && db.pageSize != db.ExpectPageSize {
+			db.close()
+			return ErrPageSizeMismatch
 		}
 	}
 
 	// Memory map the data file.
-	if err := db.mmap(0); err != nil {
+	// The tree is mostly read at random so readahead is turned off until
+	// Madvise() is called.
+	db.advice = syscall.MADV_RANDOM
+	if err := db.mmap(db.InitialMmapSize); err != nil {
 		db.close()
 		return err
 	}
 
 	// Read in the freelist.
+	// The page and its overflow must lie within the mapped data.
+	id := db.meta().freelistPageID
+	if (int(id)+1)*db.pageSize > len(db.mmapdata) {
+		db.close()
+		return ErrInvalid
+	}
+	p := db.page(id)
+	if (int(id)+int(p.overflow)+1)*db.pageSize > len(db.mmapdata) {
+		db.close()
+		return ErrInvalid
+	}
 	db.freelist = &freelist{pendingPageIDMap: make(map[txID][]pageID)}
-	db.freelist.read(db.page(db.meta().freelistPageID))
+	if err := db.freelist.read(p, db.pageSize); err != nil {
+		db.close()
+		return err
+	}
+
+	// Drop the meta pages and the live freelist and buckets pages in case a
+	// corrupt freelist lists them so that they are never allocated.
+	db.freelist.remove(0, 2)
+	db.freelist.remove(id, int(p.overflow)+1)
+	if id := db.meta().bucketsPageID; (int(id)+1)*db.pageSize <= len(db.mmapdata) {
+		db.freelist.remove(id, int(db.page(id).overflow)+1)
+	}
+	db.countFreelist()
 
 	// Mark the database as opened and return.
 	db.isOpened = true
 	return nil
 }
 
+// readMeta1 reads meta page 1 into buf over meta page 0, which m points to.
+// Meta page 1 lies one page in, at the page size that the file was created
+// with rather than the OS page size. That is taken from meta page 0 if its
+// header is intact, otherwise each valid page size is tried in turn.
+func (db *DB) readMeta1(buf []byte, m *meta) error {
+	var sizes []int
+	if m.magic == magic && m.version == version && validPageSize(int(m.pageSize)) {
+		sizes = append(sizes, int(m.pageSize))
+	} else {
+		for n := minPageSize; n <= maxPageSize; n *= 2 {
+			sizes = append(sizes, n)
+		}
+	}
+
+	err := ErrInvalid
+	for _, n := range sizes {
+		if err = db.readFull(buf, int64(n)); err != nil {
+			continue
+		}
+		if err = m.validate(); err == nil && int(m.pageSize) != n {
+			err = ErrInvalidPageSize
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// flock obtains a file lock on the data file. While another process holds
+// the lock it retries until Timeout has elapsed.
+func (db *DB) flock(f file, how int) error {
+	start := time.Now()
+	for {
+		err := db.syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return err
+		} else if db.Timeout < 0 {
+			return ErrDatabaseInUse
+		} else if db.Timeout > 0 && time.Since(start) >= db.Timeout {
+			return ErrTimeout
+		}
+		time.Sleep(flockRetryInterval)
+	}
+}
+
 // init creates a new database file and initializes its meta pages.
 //
 // | M(0) | M(1) | F(2) | D(3)        | | | | | |
@@ -142,6 +594,9 @@ func (db *DB) Open(path string, mode os.FileMode) error {
 func (db *DB) init() error {
 	// Set the page size to the OS page size.
 	db.pageSize = db.os.Getpagesize()
+	if !validPageSize(db.pageSize) {
+		return ErrInvalidPageSize
+	}
 
 	// Create two meta pages on a buffer.
 	buf := make([]byte, db.pageSize*4) // M,M,F,D
@@ -159,13 +614,14 @@ func (db *DB) init() error {
 		m.bucketsPageID = 3
 		m.pageID = 4
 		m.txID = txID(i) // tx 0, tx 1
+		m.comparator = db.comparatorID()
+		m.checksum = m.sum64()
 	}
 
 	// Write an empty freelist at page 3.
 	p := db.pageInBuffer(buf[:], pageID(2))
 	p.id = pageID(2)
-	p.flags = freelistPageFlag
-	p.count = 0
+	(&freelist{}).write(p)
 
 	// Write an empty leaf page at page 4.
 	p = db.pageInBuffer(buf[:], pageID(3))
@@ -181,33 +637,72 @@ func (db *DB) init() error {
 	return nil
 }
 
+// readFull reads len(b) bytes from the data file at a given offset. A read
+// that comes back short is continued from where it stopped. Returns
+// io.ErrUnexpectedEOF if the file ends first.
+func (db *DB) readFull(b []byte, off int64) error {
+	for len(b) > 0 {
+		n, err := db.file.ReadAt(b, off)
+		b, off = b[n:], off+int64(n)
+		if len(b) == 0 {
+			// ReadAt may return io.EOF along with the last bytes.
+			return nil
+		} else if err == io.EOF || (err == nil && n == 0) {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // mmap opens the underlying memory-mapped file and initializes the meta references.
-// minsz is the minimum size that the new mmap can be.
+// minsz is the minimum size that the new mmap can be. The map covers the
+// whole file as well.
 func (db *DB) mmap(minsz int) error {
+	return db.mmapFile(minsz, true)
+}
+
+// mmapFile is like mmap but only covers the whole file if wholeFile is set.
+// Otherwise the map is sized from minsz alone so that it can be smaller than
+// a file with unused pages at its end.
+func (db *DB) mmapFile(minsz int, wholeFile bool) error {
 	db.mmaplock.Lock()
 	defer db.mmaplock.Unlock()
 
-	// Dereference all mmap references before unmapping.
-	if db.rwtx != nil {
-		db.rwtx.dereference()
-	}
-
-	// Unmap existing data before continuing.
-	db.munmap()
+	// The first map made by Open() isn't counted as a remap.
+	remap, start := db.mmapdata != nil, time.Now()
 
+	// Check the file before unmapping so that the current map stays usable
+	// if the file has been removed.
 	info, err := db.file.Stat()
 	if err != nil {
 		return fmt.Errorf("%s: %w", errMsgMmapStat, err)
+	} else if fileRemoved(info) {
+		return ErrFileRemoved
 	} else if int(info.Size()) < db.pageSize*2 {
 		return errors.New(errMsgFileTooSmall)
 	}
 
 	// Ensure the size is at least the minimum size.
-	var size = int(info.Size())
-	if size < minsz {
-		size = minsz
+	// This is checked before unmapping so that a size that's too large for
+	// the platform leaves the current map usable.
+	var size = minsz
+	if wholeFile && size < int(info.Size()) {
+		size = int(info.Size())
+	}
+	size, err = db.mmapSize(size)
+	if err != nil {
+		return err
 	}
-	size = db.mmapSize(minsz)
+
+	// Dereference all mmap references before unmapping.
+	if db.rwtx != nil {
+		db.rwtx.dereference()
+	}
+
+	// Unmap existing data before continuing.
+	db.munmap()
 
 	// mmap() syscall: allocate new memory space to a running process
 	// Memory-map the data file as a byte slice.
@@ -215,15 +710,107 @@ func (db *DB) mmap(minsz int) error {
 		return err
 	}
 
+	// The advice is only a hint so a platform without madvise goes without.
+	_ = db.syscall.Madvise(db.mmapdata, db.advice)
+	if remap {
+		d := time.Since(start)
+		db.stats.remapN.Add(1)
+		db.stats.remapTime.Add(int64(d))
+		if db.OnRemap != nil {
+			db.OnRemap(size, d)
+		}
+	}
+
 	// Save references to the meta pages.
 	db.meta0 = db.page(0).meta()
 	db.meta1 = db.page(1).meta()
 	// Validate the meta pages.
-	if err := db.meta0.validate(); err != nil {
-		return fmt.Errorf("meta0 error: %w", err)
+	// Only one of them needs to be valid since a torn write leaves the
+	// other one intact. A forced meta page must be valid itself.
+	err0, err1 := db.meta0.validate(), db.meta1.validate()
+	switch db.force {
+	case ForceMeta0:
+		err1 = nil
+	case ForceMeta1:
+		err0 = nil
+	default:
+		if err0 == nil || err1 == nil {
+			return nil
+		}
+	}
+	if err0 != nil {
+		return fmt.Errorf("meta0 error: %w", err0)
+	} else if err1 != nil {
+		return fmt.Errorf("meta1 error: %w", err1)
+	}
+	return nil
+}
+
+// grow remaps the data file to at least the given size if it isn't already.
+// It holds the writer lock so no RWTransaction has nodes referencing the mmap.
+func (db *DB) grow(size int) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+
+	if !db.isOpened {
+		return ErrDatabaseNotOpen
+	}
+	if size <= len(db.mmapdata) {
+		return nil
+	}
+	return db.mmap(size)
+}
+
+// Madvise tells the kernel how the memory map is about to be read, such as
+// syscall.MADV_SEQUENTIAL before scanning a large bucket so that pages are
+// read ahead. The map is advised syscall.MADV_RANDOM when the database is
+// opened, which suits point lookups. The advice is kept when the data file is
+// remapped.
+func (db *DB) Madvise(advice int) error {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	if !db.isOpened {
+		return ErrDatabaseNotOpen
+	}
+
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	if err := db.syscall.Madvise(db.mmapdata, advice); err != nil {
+		return err
 	}
-	if err := db.meta1.validate(); err != nil {
-		return fmt.Errorf("meta1 error: %w", err)
+	db.advice = advice
+	return nil
+}
+
+// GrowTo remaps the data file to at least the given size in bytes so that
+// writes up to that size don't need to remap. It waits for the current
+// writer and for open read transactions, so it is meant to be called at a
+// quiet time when NoAutoGrow is set.
+func (db *DB) GrowTo(size int) error {
+	return db.grow(size)
+}
+
+// CompactFreelist tidies the freelist without moving any bucket data.
+// The free page ids are sorted and deduplicated, and free pages at the end of
+// the data file are given back by lowering the high-water mark so that the
+// freelist that allocations scan gets smaller. The freelist is rewritten by
+// committing under the writer lock. Pages still in use by open read
+// transactions can't be given back. The data file itself is not truncated.
+func (db *DB) CompactFreelist() error {
+	// The first commit moves the freelist and buckets pages to the lowest
+	// free pages. Once their old pages are released, the second commit can
+	// give back the free pages at the end.
+	for i := 0; i < 2; i++ {
+		t, err := db.rwtxBegin()
+		if err != nil {
+			return err
+		}
+		t.compact = true
+		if err := t.Commit(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -240,21 +827,36 @@ func (db *DB) munmap() {
 
 // mmapSize determines the appropriate size for the mmap given the current size
 // of the database. The minimum size is 4MB and doubles until it reaches 1GB.
-func (db *DB) mmapSize(size int) int {
-	if size < minMmapSize {
-		return minMmapSize
-	} else if size < maxMmapStep {
+// From there it grows by 1GB at a time, up to the largest map the platform
+// allows. Returns ErrMmapTooLarge if size is past that.
+func (db *DB) mmapSize(size int) (int, error) {
+	if size > maxMapSize {
+		return 0, ErrMmapTooLarge
+	} else if size < minMmapSize {
+		return minMmapSize, nil
+	}
+
+	requested := size
+	if size < maxMmapStep {
 		size *= 2
-	} else {
+	} else if size <= maxMapSize-maxMmapStep {
 		size += maxMmapStep
+	} else {
+		size = maxMapSize
 	}
 
-	// Ensure that the mmap size is a multiple of the page size.
-	if (size % db.pageSize) != 0 {
+	// Ensure that the mmap size is a multiple of the page size, without
+	// going past the largest map the platform allows.
+	if limit := maxMapSize / db.pageSize * db.pageSize; size > limit {
+		size = limit
+	} else if (size % db.pageSize) != 0 {
 		size = ((size / db.pageSize) + 1) * db.pageSize
 	}
+	if size < requested {
+		return 0, ErrMmapTooLarge
+	}
 
-	return size
+	return size, nil
 }
 
 // Close releases all database resources.
@@ -265,14 +867,45 @@ func (db *DB) Close() {
 	db.close()
 }
 
+// Sync flushes the data file to disk.
+// Commit() calls it before writing the meta page, unless NoSync is set.
+func (db *DB) Sync() error {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	if !db.isOpened {
+		return ErrDatabaseNotOpen
+	}
+	return db.file.Sync()
+}
+
+// close undoes everything in Open().
+// It is also used to clean up after Open() fails part way through so that
+// the DB can be opened again.
 func (db *DB) close() {
 	db.isOpened = false
+	db.stats.freePageN.Store(0)
+	db.stats.pendingPageN.Store(0)
+	db.stats.pageSize.Store(0)
+	db.stats.highWater.Store(0)
 
-	// TODO(benbjohnson): Undo everything in Open().
 	db.freelist = nil
 	db.path = ""
 
 	db.munmap()
+	db.meta0, db.meta1 = nil, nil
+
+	// Close the file handles.
+	if db.metafile != nil {
+		_ = db.metafile.Close()
+		db.metafile = nil
+	}
+	if db.file != nil {
+		if !db.readOnly {
+			_ = db.syscall.Flock(int(db.file.Fd()), syscall.LOCK_UN)
+		}
+		_ = db.file.Close()
+		db.file = nil
+	}
 }
 
 // txBegin creates a read-only transaction.
@@ -283,22 +916,53 @@ func (db *DB) txBegin() (*Transaction, error) {
 	db.metalock.Lock()
 	defer db.metalock.Unlock()
 
-	// Exit if the database is not open yet.
-	if !db.isOpened {
-		return nil, ErrDatabaseNotOpen
-	}
+	var m *meta
+	for {
+		// Exit if the database is not open yet.
+		if !db.isOpened {
+			return nil, ErrDatabaseNotOpen
+		}
 
-	// Obtain a read-only lock on the mmap. When the mmap is remapped it will
-	// obtain a write lock so all transactions must finish before it can be
-	// remapped.
-	db.mmaplock.RLock()
+		// Obtain a read-only lock on the mmap. When the mmap is remapped it will
+		// obtain a write lock so all transactions must finish before it can be
+		// remapped.
+		db.mmaplock.RLock()
+
+		// Copy the meta once so that the size check and the transaction see
+		// the same one even if another process commits in between.
+		var err error
+		m, err = db.metaCopy()
+		if err != nil {
+			db.mmaplock.RUnlock()
+			return nil, fmt.Errorf("%s: %w", errMsgMeta, err)
+		}
+
+		// Remap if another process has committed pages beyond the end of our mmap.
+		// The shared mapping sees their meta pages but not the grown file.
+		size := int(m.pageID) * db.pageSize
+		if size <= len(db.mmapdata) {
+			break
+		}
+
+		// The remap is done under the writer lock so it can't unmap pages that
+		// an open RWTransaction is still referencing. Then check again.
+		db.mmaplock.RUnlock()
+		db.metalock.Unlock()
+		err = db.grow(size)
+		db.metalock.Lock()
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Create a transaction associated with the database.
 	t := &Transaction{}
-	t.init(db)
+	t.init(db, m)
 
 	// Keep track of transaction until it closes.
 	db.txs = append(db.txs, t)
+	db.stats.txN.Add(1)
+	db.stats.openTxN.Add(1)
 
 	return t, nil
 }
@@ -306,16 +970,19 @@ func (db *DB) txBegin() (*Transaction, error) {
 // txEnd removes a transaction from the database.
 // This is called from Close() on the transaction.
 func (db *DB) txEnd(t *Transaction) {
-	db.metalock.Lock()
-	defer db.metalock.Unlock()
-
 	// Release the read lock on the mmap.
+	// This happens before taking the metalock so that a remap in txBegin(),
+	// which holds the metalock, can wait for open transactions to close.
 	db.mmaplock.RUnlock()
 
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+
 	// Remove the transaction.
 	for i, tx := range db.txs {
 		if tx == t {
 			db.txs = append(db.txs[:i], db.txs[i+1:]...)
+			db.stats.openTxN.Add(-1)
 			break
 		}
 	}
@@ -325,22 +992,23 @@ func (db *DB) txEnd(t *Transaction) {
 // Only one read/write transaction is allowed at a time.
 // You must call Commit() or Rollback() on the transaction to close it.
 func (db *DB) rwtxBegin() (*RWTransaction, error) {
+	// Obtain writer lock. This is released by the RWTransaction when it closes.
+	// It is taken before the metalock so that a waiting writer doesn't block
+	// readers or the commit of the current writer.
+	db.rwlock.Lock()
+
 	db.metalock.Lock()
 	defer db.metalock.Unlock()
 
-	// Exit if the database is not open yet.
+	// Exit if the database is not open yet or can't be written.
 	if !db.isOpened {
+		db.rwlock.Unlock()
 		return nil, ErrDatabaseNotOpen
+	} else if db.readOnly {
+		db.rwlock.Unlock()
+		return nil, ErrDatabaseReadOnly
 	}
 
-	// Obtain writer lock. This is released by the RWTransaction when it closes.
-	db.rwlock.Lock()
-
-	// Create a transaction associated with the database.
-	t := &RWTransaction{nodes: make(map[pageID]*node)}
-	t.init(db)
-	db.rwtx = t
-
 	// Free any pages associated with closed read-only transactions.
 	var minid txID = 0xFFFFFFFFFFFFFFFF
 	for _, t := range db.txs {
@@ -351,10 +1019,46 @@ func (db *DB) rwtxBegin() (*RWTransaction, error) {
 	if minid > 0 {
 		db.freelist.release(minid - 1)
 	}
+	db.countFreelist()
+
+	// Hold back writers while readers pin too many freed pages.
+	if err := db.checkPendingPages(); err != nil {
+		db.rwlock.Unlock()
+		return nil, err
+	}
+
+	// Create a transaction associated with the database.
+	m, err := db.metaCopy()
+	if err != nil {
+		db.rwlock.Unlock()
+		return nil, fmt.Errorf("%s: %w", errMsgMeta, err)
+	}
+	t := &RWTransaction{nodes: make(map[pageID]*node)}
+	t.init(db, m)
+	db.rwtx = t
 
 	return t, nil
 }
 
+// checkPendingPages returns ErrTooManyPendingPages or logs a warning when
+// more than MaxPendingPageN pages are pending. The warning is logged once
+// each time the limit is passed. The metalock must be held.
+func (db *DB) checkPendingPages() error {
+	pendingPageN := int(db.stats.pendingPageN.Load())
+	if db.MaxPendingPageN <= 0 || pendingPageN <= db.MaxPendingPageN {
+		db.pendingWarned = false
+		return nil
+	}
+	if db.StrictMaxPendingPageN {
+		return ErrTooManyPendingPages
+	}
+	if !db.pendingWarned {
+		db.pendingWarned = true
+		log.Printf("toyboltdb: %d pages are pending, more than MaxPendingPageN (%d); a read transaction may have been left open", pendingPageN, db.MaxPendingPageN)
+	}
+	return nil
+}
+
 // rwtxEnd is called from Commit() or Rollback() on the transaction.
 func (db *DB) rwtxEnd() {
 	db.rwlock.Unlock()
@@ -365,14 +1069,26 @@ func (db *DB) rwtxEnd() {
 // If an error is returned then the entire transaction is rolled back.
 // Any error that is returned from the function or returned from the commit is
 // returned from the Update() method.
+// If the function panics then the transaction is rolled back and the panic
+// is passed on.
 func (db *DB) Update(fn func(*RWTransaction) error) error {
 	t, err := db.rwtxBegin()
 	if err != nil {
 		return err
 	}
 
+	// Roll back if the function panics so that the writer lock is released.
+	var done bool
+	defer func() {
+		if !done {
+			t.Rollback()
+		}
+	}()
+	err = fn(t)
+	done = true
+
 	// If an error is returned from the function then rollback and return error.
-	if err := fn(t); err != nil {
+	if err != nil {
 		t.Rollback()
 		return err
 	}
@@ -380,8 +1096,50 @@ func (db *DB) Update(fn func(*RWTransaction) error) error {
 	return t.Commit()
 }
 
+// UpdateContext executes a function within a RWTransaction like Update() but
+// gives up once the context is done. The function isn't called if the context
+// is done before the transaction starts, and the transaction is rolled back
+// instead of committed if it is done by the time the function returns.
+// The function itself isn't interrupted so it should check the context if it
+// runs for long. Returns the context's error if it gave up.
+func (db *DB) UpdateContext(ctx context.Context, fn func(*RWTransaction) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.Update(func(t *RWTransaction) error {
+		// The context may be done while waiting for the writer lock.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
+// ViewContext executes a function within a Transaction like View() but gives
+// up once the context is done. The function isn't called if the context is
+// done before the transaction starts. Returns the context's error if it is
+// done by the time the function returns, even if the function succeeded.
+func (db *DB) ViewContext(ctx context.Context, fn func(*Transaction) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.View(func(t *Transaction) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
 // View executes a function within the context of a Transaction.
 // Any error that is returned from the function is returned from the View() method.
+// If the function panics then the transaction is closed and the panic is passed on.
 func (db *DB) View(fn func(*Transaction) error) error {
 	t, err := db.txBegin()
 	if err != nil {
@@ -393,12 +1151,499 @@ func (db *DB) View(fn func(*Transaction) error) error {
 	return fn(t)
 }
 
+// Backup writes a copy of the database as of a single read transaction to a
+// new data file at a given path, replacing any file already there.
+// Writers can keep committing while the copy is taken.
+func (db *DB) Backup(path string) error {
+	return db.View(func(t *Transaction) error {
+		f, err := db.os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return err
+		}
+		_, err = t.WriteTo(io.NewOffsetWriter(f, 0))
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+}
+
+// BackupAndVerify writes a backup to a given path like Backup() and then
+// opens it read-only and runs Check() on it. The problems that Check()
+// finds are returned together as one error. The backup is left in place
+// either way so that a bad one can be looked into.
+func (db *DB) BackupAndVerify(path string) error {
+	if err := db.Backup(path); err != nil {
+		return err
+	}
+
+	backup := &DB{Comparator: db.Comparator, ComparatorName: db.ComparatorName}
+	if err := backup.OpenReadOnly(path, 0666); err != nil {
+		return fmt.Errorf("backup open: %w", err)
+	}
+	defer backup.Close()
+	if errs := backup.Check(); len(errs) > 0 {
+		return fmt.Errorf("backup check: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// CompactTo copies every bucket into dst, which must be open, one bucket per
+// transaction.
+//
+// Each bucket is read in its own read transaction and written in its own
+// write transaction on dst so writers to the database can commit between
+// buckets. This means buckets may be copied as of different commits.
+// Buckets that already exist in dst are skipped so a compaction that was
+// interrupted can be resumed by calling CompactTo again.
+func (db *DB) CompactTo(dst *DB) error {
+	var names []string
+	if err := db.View(func(t *Transaction) error {
+		for _, b := range t.Buckets() {
+			names = append(names, b.Name())
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err := db.View(func(t *Transaction) error {
+			// Skip buckets that were deleted since the names were read.
+			b := t.Bucket(name)
+			if b == nil {
+				return nil
+			}
+
+			return dst.Update(func(txn *RWTransaction) error {
+				if txn.Bucket(name) != nil {
+					return nil
+				}
+				if err := txn.CreateBucket(name); err != nil {
+					return err
+				}
+				txn.Bucket(name).sequence = b.sequence
+				dstb := txn.Bucket(name)
+				return t.ForEachCursor(name, func(c *Cursor, k, v []byte) error {
+					_, err := dstb.put(k, v, c.flags())
+					return err
+				})
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact copies the database into a new data file at path with CompactTo()
+// and returns the number of bytes saved compared to the current data file.
+// Keys are inserted in sorted order and pages are filled completely so that
+// the new file holds a densely packed tree with no free pages. The new file
+// uses the same comparator. If the file already exists then buckets that it
+// holds are skipped, as with CompactTo().
+func (db *DB) Compact(path string) (int64, error) {
+	dst := &DB{
+		Comparator:     db.Comparator,
+		ComparatorName: db.ComparatorName,
+		FillPercent:    maxFillPercent,
+		os:             db.os,
+		syscall:        db.syscall,
+	}
+	if err := dst.Open(path, 0666); err != nil {
+		return 0, err
+	}
+	err := db.CompactTo(dst)
+	dst.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// Compare the sizes of the two data files.
+	db.metalock.Lock()
+	if !db.isOpened {
+		db.metalock.Unlock()
+		return 0, ErrDatabaseNotOpen
+	}
+	srcInfo, err := db.file.Stat()
+	db.metalock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	dstInfo, err := db.os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return srcInfo.Size() - dstInfo.Size(), nil
+}
+
+// Remap shrinks the memory map to fit the current high water mark of the data file.
+// The map only grows while writing so this releases address space left over
+// from a large transaction, once its pages are freed and given back with
+// CompactFreelist(). It blocks until all open transactions are closed.
+// The data file itself is not truncated so the map may end before the file
+// does. The pages past the high water mark aren't used until the map grows
+// again.
+func (db *DB) Remap() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+
+	// Exit if the database is not open yet.
+	if !db.isOpened {
+		return ErrDatabaseNotOpen
+	}
+
+	// Only remap if the map would get smaller.
+	// The map is never shrunk below InitialMmapSize.
+	size := max(int(db.meta().pageID)*db.pageSize, db.InitialMmapSize)
+	if sz, err := db.mmapSize(size); err != nil || sz >= len(db.mmapdata) {
+		return err
+	}
+	return db.mmapFile(size, false)
+}
+
+// Stats returns statistics about the database.
+// The counters are kept across Close() and Open().
+// No lock is taken so it can be sampled often without slowing down
+// transactions. Each field is read on its own so fields that change together
+// may be from slightly different moments.
+func (db *DB) Stats() Stats {
+	s := &db.stats
+	pageSize, pendingPageN := int(s.pageSize.Load()), int(s.pendingPageN.Load())
+	return Stats{
+		RemapN:    int(s.remapN.Load()),
+		RemapTime: time.Duration(s.remapTime.Load()),
+		TxN:       int(s.txN.Load()),
+		CommitN:   int(s.commitN.Load()),
+
+		FreePageN:       int(s.freePageN.Load()),
+		PendingPageN:    pendingPageN,
+		PendingAlloc:    pendingPageN * pageSize,
+		OpenTxN:         int(s.openTxN.Load()),
+		PageSize:        pageSize,
+		HighWaterPageID: int(s.highWater.Load()),
+	}
+}
+
+// BucketOpStats represents the number of operations made on a bucket.
+type BucketOpStats struct {
+	GetN    int // number of Get() calls
+	PutN    int // number of successful Put() calls
+	DeleteN int // number of Delete() calls
+}
+
+// BucketOpStats returns the operation counts for each bucket by name.
+// The counts are kept in memory for the life of the DB and aren't persisted.
+// They include operations in write transactions that were rolled back.
+func (db *DB) BucketOpStats() map[string]BucketOpStats {
+	stats := make(map[string]BucketOpStats)
+	db.opstats.Range(func(name, v any) bool {
+		c := v.(*bucketOpCounts)
+		stats[name.(string)] = BucketOpStats{
+			GetN:    int(c.get.Load()),
+			PutN:    int(c.put.Load()),
+			DeleteN: int(c.del.Load()),
+		}
+		return true
+	})
+	return stats
+}
+
+// opCounts returns a bucket's operation counters, adding them on first use.
+func (db *DB) opCounts(name string) *bucketOpCounts {
+	if c, ok := db.opstats.Load(name); ok {
+		return c.(*bucketOpCounts)
+	}
+	c, _ := db.opstats.LoadOrStore(name, &bucketOpCounts{})
+	return c.(*bucketOpCounts)
+}
+
+// countFreelist records the freelist counts and the high water mark reported
+// by Stats(). The freelist is only read here, under the metalock, at points
+// where no writer is changing it. The metalock must be held.
+func (db *DB) countFreelist() {
+	var pendingPageN int
+	for _, ids := range db.freelist.pendingPageIDMap {
+		pendingPageN += len(ids)
+	}
+	db.stats.freePageN.Store(int64(db.freelist.freeCount()))
+	db.stats.pendingPageN.Store(int64(pendingPageN))
+	db.stats.pageSize.Store(int64(db.pageSize))
+	db.stats.highWater.Store(int64(db.meta().pageID))
+}
+
+// WaitForTxID blocks until a transaction with an id of at least id has been
+// committed. The meta pages are polled so that it also sees commits made by
+// another process that has the file open.
+// Returns the context's error if it is done first.
+func (db *DB) WaitForTxID(ctx context.Context, id int) error {
+	ticker := time.NewTicker(waitTxIDInterval)
+	defer ticker.Stop()
+
+	for {
+		current, err := db.committedTxID()
+		if err != nil {
+			return err
+		} else if current >= id {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// committedTxID returns the id of the last committed transaction.
+func (db *DB) committedTxID() (int, error) {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	if !db.isOpened {
+		return 0, ErrDatabaseNotOpen
+	}
+
+	// The meta pages are read from the mmap so hold it like a reader does.
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	return int(db.meta().txID), nil
+}
+
+// ValidateEntry checks a key/value pair against the limits enforced by Put()
+// without starting a transaction.
+// Returns an error if the key is blank, if the key is too large, or if the value is too large.
+// Once the database is open, a key is also too large if a branch page can't
+// hold minKeysPerPage separators of that size.
+// When MaxOverflowPages is set, a value is also too large if a leaf page
+// holding just this entry would need more overflow pages than that.
+func (db *DB) ValidateEntry(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	} else if db.pageSize > 0 && minKeysPerPage*(branchPageElementSize+len(key)) > db.pageSize-pageHeaderSize {
+		return ErrKeyTooLarge
+	} else if int64(len(value)) > MaxValueSize {
+		return ErrValueTooLarge
+	} else if db.MaxOverflowPages > 0 && db.pageSize > 0 {
+		size := pageHeaderSize + leafPageElementSize + len(key) + len(value)
+		if overflow := size / db.pageSize; overflow > db.MaxOverflowPages {
+			return ErrValueTooLarge
+		}
+	}
+	return nil
+}
+
+// LeakedPageCount returns the number of pages below the high-water mark that
+// are not reachable from any bucket, not free or pending in the freelist, and
+// not a meta, freelist, or buckets page.
+// A non-zero count indicates a bug that failed to free a page.
+// Like FreePageIDs, it waits for the current writer but doesn't start a write
+// transaction. The pages are those of the last commit, so it also works on
+// read-only databases.
+func (db *DB) LeakedPageCount() (int, error) {
+	unlock, err := db.lockFreelist()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	m, err := db.metaCopy()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", errMsgMeta, err)
+	}
+
+	// Another process may have committed pages beyond the end of a read-only
+	// DB's mmap.
+	if size := int(m.pageID) * db.pageSize; size > len(db.mmapdata) {
+		if err := db.mmap(size); err != nil {
+			return 0, err
+		}
+	}
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	t := &Transaction{}
+	t.init(db, m)
+
+	// Mark every page in use along with its overflow. The freelist page holds
+	// both the free and the pending ids.
+	used := map[pageID]bool{0: true, 1: true}
+	mark := func(p *page, _ int) {
+		for i := pageID(0); i <= pageID(p.overflow); i++ {
+			used[p.id+i] = true
+		}
+	}
+	mark(t.page(t.meta.freelistPageID), 0)
+	mark(t.page(t.meta.bucketsPageID), 0)
+	for _, b := range t.buckets.bucketMap {
+		t.forEachPage(b.rootPageID, 0, mark)
+	}
+	ids, err := readFreelistPage(t.page(t.meta.freelistPageID), db.pageSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		used[id] = true
+	}
+
+	// Count everything else below the high-water mark.
+	var n int
+	for id := pageID(2); id < t.meta.pageID; id++ {
+		if !used[id] {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// FreePageIDs returns a copy of the free page ids, highest first.
+// Pages freed by transactions that open read transactions may still see are
+// pending and not included; see PendingPageIDs.
+// The ids are read under the writer lock so it waits for the current writer.
+// No write transaction is started, so it works on read-only databases. There
+// the ids are the ones read at Open, where pending pages count as free.
+func (db *DB) FreePageIDs() ([]int, error) {
+	unlock, err := db.lockFreelist()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	ids := db.freelist.ids()
+	a := make([]int, len(ids))
+	for i, id := range ids {
+		a[i] = int(id)
+	}
+	return a, nil
+}
+
+// PendingPageIDs returns a copy of the pending page ids by the id of the
+// transaction that freed them. They are released to the free list by the
+// first write transaction that starts after every read transaction older
+// than the one that freed them has closed.
+// Like FreePageIDs, it waits for the current writer but doesn't start a
+// write transaction, so reading the ids doesn't release any of them.
+func (db *DB) PendingPageIDs() (map[int][]int, error) {
+	unlock, err := db.lockFreelist()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	m := make(map[int][]int, len(db.freelist.pendingPageIDMap))
+	for txid, ids := range db.freelist.pendingPageIDMap {
+		a := make([]int, len(ids))
+		for i, id := range ids {
+			a[i] = int(id)
+		}
+		m[int(txid)] = a
+	}
+	return m, nil
+}
+
+// lockFreelist takes the writer lock and the metalock so that the freelist
+// can be read without starting a write transaction, which would release
+// pending pages and fail on read-only databases or when too many pages are
+// pending. The returned func releases both locks.
+func (db *DB) lockFreelist() (func(), error) {
+	db.rwlock.Lock()
+	db.metalock.Lock()
+	unlock := func() {
+		db.metalock.Unlock()
+		db.rwlock.Unlock()
+	}
+	if !db.isOpened {
+		unlock()
+		return nil, ErrDatabaseNotOpen
+	}
+	return unlock, nil
+}
+
+// Check verifies the structural integrity of the database as of the last
+// commit. It checks that every page is referenced exactly once by the meta
+// pages, the freelist, the buckets page or a bucket, that no page is past the
+// high-water mark, and that keys are sorted and lie within the range of their
+// branch separators. Each violation is returned as a descriptive error.
+// Returns nil if the database is consistent.
+func (db *DB) Check() []error {
+	t, err := db.txBegin()
+	if err != nil {
+		return []error{err}
+	}
+	defer t.Close()
+	return t.check()
+}
+
+// compare orders two keys using the database's comparator.
+func (db *DB) compare(a, b []byte) int {
+	if db.Comparator == nil {
+		return bytes.Compare(a, b)
+	}
+	return db.Comparator(a, b)
+}
+
+// comparatorID returns the identity of the comparator stored in the meta page.
+func (db *DB) comparatorID() uint32 {
+	if db.ComparatorName == "" {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(db.ComparatorName))
+	if id := h.Sum32(); id != 0 {
+		return id
+	}
+	return 1
+}
+
 // meta retrieves the current meta page reference.
+// This is the meta page with the highest transaction id that passes
+// validation, so a corrupt newest meta page falls back to the other one.
 func (db *DB) meta() *meta {
-	if db.meta0.txID > db.meta1.txID {
+	switch db.force {
+	case ForceMeta0:
 		return db.meta0
+	case ForceMeta1:
+		return db.meta1
+	}
+	newest, older := db.meta1, db.meta0
+	if db.meta0.txID > db.meta1.txID {
+		newest, older = db.meta0, db.meta1
 	}
-	return db.meta1
+	if newest.validate() != nil {
+		return older
+	}
+	return newest
+}
+
+// metaCopy returns a copy of the current meta page. The copy is validated
+// rather than the page since another process committing to the file can
+// change the page while it's copied. A torn copy is replaced by a copy of the
+// other meta page, which that commit doesn't write, unless a meta page is forced.
+func (db *DB) metaCopy() (*meta, error) {
+	cur := db.meta()
+	m := &meta{}
+	cur.copy(m)
+	if err := m.validate(); err != nil {
+		if db.force != ForceMetaAuto {
+			return nil, err
+		}
+		other := db.meta0
+		if cur == db.meta0 {
+			other = db.meta1
+		}
+		other.copy(m)
+		if err := m.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
 }
 
 // page retrieves a page reference from the mmap based on the current page size.
@@ -414,12 +1659,34 @@ func (db *DB) pageInBuffer(b []byte, id pageID) *page {
 // allocate returns a contiguous block of memory starting at a given page.
 func (db *DB) allocate(count int) (*page, error) {
 	// Allocate a temporary buffer for the page.
-	buf := make([]byte, count*db.pageSize)
+	// O_DIRECT writes require the buffer to be aligned to the page size.
+	var buf []byte
+	if db.DirectIO {
+		buf = alignedBuffer(count*db.pageSize, db.pageSize)
+	} else {
+		buf = make([]byte, count*db.pageSize)
+	}
 	p := (*page)(unsafe.Pointer(&buf[0]))
 	p.overflow = uint32(count - 1)
 
 	// Use pages from the freelist **if they are available**.
-	if p.id = db.freelist.allocate(count); p.id != 0 {
+	// They must never include the live freelist or buckets page.
+	// Compacting the freelist takes the lowest pages to free up the end of the file.
+	if db.rwtx.compact {
+		p.id = db.freelist.allocateLow(count)
+	} else {
+		p.id = db.freelist.allocate(count)
+	}
+	if p.id != 0 {
+		for _, id := range []pageID{db.rwtx.meta.freelistPageID, db.rwtx.meta.bucketsPageID} {
+			end := id + pageID(db.rwtx.page(id).overflow)
+			if p.id <= end && id < p.id+pageID(count) {
+				panic(fmt.Sprintf("assertion failed: allocating live page %d", id))
+			}
+		}
+		for i := 0; i < count; i++ {
+			db.rwtx.reused = append(db.rwtx.reused, p.id+pageID(i))
+		}
 		return p, nil
 	}
 
@@ -427,6 +1694,9 @@ func (db *DB) allocate(count int) (*page, error) {
 	p.id = db.rwtx.meta.pageID
 	var minsz = int((p.id+pageID(count))+1) * db.pageSize
 	if minsz >= len(db.mmapdata) {
+		if db.NoAutoGrow {
+			return nil, ErrDatabaseFull
+		}
 		if err := db.mmap(minsz); err != nil {
 			return nil, fmt.Errorf("mmap allocate error: %w", err)
 		}
@@ -437,3 +1707,14 @@ func (db *DB) allocate(count int) (*page, error) {
 
 	return p, nil
 }
+
+// alignedBuffer returns a zeroed byte slice of the given size whose first byte
+// is aligned to a multiple of align.
+func alignedBuffer(size, align int) []byte {
+	buf := make([]byte, size+align)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(align)); rem != 0 {
+		offset = align - rem
+	}
+	return buf[offset : offset+size]
+}
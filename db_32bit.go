@@ -0,0 +1,7 @@
+//go:build 386 || arm || mips || mipsle
+
+package toyboltdb
+
+// maxMapSize is the largest size that the data file can be mapped at.
+// A 32-bit platform can't address more than 2GB.
+const maxMapSize = 0x7FFFFFFF // 2GB
@@ -0,0 +1,6 @@
+//go:build !(386 || arm || mips || mipsle)
+
+package toyboltdb
+
+// maxMapSize is the largest size that the data file can be mapped at.
+const maxMapSize = 0xFFFFFFFFFFFF // 256TB
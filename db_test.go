@@ -1,11 +1,15 @@
 package toyboltdb
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"log"
 	"math"
 	"math/rand"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -33,6 +37,43 @@ func TestDBReopen(t *testing.T) {
 	})
 }
 
+// Ensure that a database that grew past the minimum mmap size is fully mapped when reopened.
+func TestDBReopenAfterGrowth(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		value := make([]byte, 1000)
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+				txn.CreateBucketIfNotExists("widgets")
+				for j := 0; j < 3000; j++ {
+					k := []byte(fmt.Sprintf("%d-%04d", i, j))
+					if err := txn.Put("widgets", k, value); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.True(t, info.Size() > minMmapSize, "size=%d", info.Size())
+
+		db.Close()
+		assert.NoError(t, db.Open(path, 0666))
+		assert.True(t, len(db.mmapdata) >= int(info.Size()), "mmap=%d", len(db.mmapdata))
+		_ = db.View(func(txn *Transaction) error {
+			n := 0
+			assert.NoError(t, txn.ForEach("widgets", func(k, v []byte) error {
+				assert.Equal(t, v, value)
+				n++
+				return nil
+			}))
+			assert.Equal(t, n, 9000)
+			return nil
+		})
+		assert.Nil(t, db.Check())
+	})
+}
+
 // Ensure that the database returns an error if the file handle cannot be open.
 func TestDBOpenFileError(t *testing.T) {
 	withMockDB(func(db *DB, mockos *mockos, mocksyscall *mocksyscall, path string) {
@@ -43,14 +84,132 @@ func TestDBOpenFileError(t *testing.T) {
 	})
 }
 
+// Ensure that the database returns an error if the file is locked by another process.
+func TestDBOpenLocked(t *testing.T) {
+	withMockDB(func(db *DB, mockos *mockos, mocksyscall *mocksyscall, path string) {
+		file := &mockfile{}
+		mockos.On("OpenFile", path, os.O_RDWR|os.O_CREATE, os.FileMode(0666)).Return(file, nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_EX|syscall.LOCK_NB).Return(syscall.EWOULDBLOCK)
+		file.On("Close").Return(nil)
+		db.Timeout = -1
+		err := db.Open(path, 0666)
+		assert.Equal(t, err, ErrDatabaseInUse)
+		file.AssertCalled(t, "Close")
+		mocksyscall.AssertNotCalled(t, "Flock", 0, syscall.LOCK_UN)
+		assert.Nil(t, db.file)
+	})
+}
+
+// Ensure that a file can only be opened by one writer at a time and that
+// readers open it alongside the writer.
+func TestDBOpenLock(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		other := DB{Timeout: -1}
+		assert.Equal(t, other.Open(path, 0666), ErrDatabaseInUse)
+		var reader DB
+		assert.NoError(t, reader.OpenReadOnly(path, 0666))
+		defer reader.Close()
+
+		// The lock is released on close, even while readers are open.
+		db.Close()
+		assert.NoError(t, other.Open(path, 0666))
+		defer other.Close()
+		assert.Equal(t, db.OpenWithOptions(path, 0666, &Options{Timeout: -1}), ErrDatabaseInUse)
+	})
+}
+
+// Ensure that Open waits for a held file lock until the timeout.
+func TestDBOpenTimeout(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		// The lock is released within the timeout.
+		db.syscall = &heldlocksyscall{until: time.Now().Add(100 * time.Millisecond)}
+		db.Timeout = time.Second
+		start := time.Now()
+		assert.NoError(t, db.Open(path, 0666))
+		assert.True(t, time.Since(start) >= 100*time.Millisecond)
+		db.Close()
+
+		// The lock is held past the timeout.
+		db.syscall = &heldlocksyscall{until: time.Now().Add(time.Hour)}
+		db.Timeout = 100 * time.Millisecond
+		assert.Equal(t, db.Open(path, 0666), ErrTimeout)
+		assert.Nil(t, db.file)
+
+		// Zero waits until the lock is released.
+		db.syscall = &heldlocksyscall{until: time.Now().Add(100 * time.Millisecond)}
+		db.Timeout = 0
+		assert.NoError(t, db.Open(path, 0666))
+		db.Close()
+	})
+}
+
+// Ensure that options are applied when opening a database.
+func TestDBOpenWithOptions(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.OpenWithOptions(path, 0666, &Options{InitialMmapSize: minMmapSize * 4}))
+		assert.Equal(t, db.InitialMmapSize, minMmapSize*4)
+		assert.True(t, len(db.mmapdata) >= minMmapSize*4)
+
+		// Remapping keeps the initial size.
+		assert.NoError(t, db.Remap())
+		assert.True(t, len(db.mmapdata) >= minMmapSize*4)
+		db.Close()
+
+		// Read-only.
+		assert.NoError(t, db.OpenWithOptions(path, 0666, &Options{ReadOnly: true}))
+		assert.Equal(t, db.InitialMmapSize, 0)
+		err := db.Update(func(txn *RWTransaction) error { return nil })
+		assert.Equal(t, err, ErrDatabaseReadOnly)
+		db.Close()
+
+		// Nil options keep the fields and open for writing.
+		db.InitialMmapSize = minMmapSize * 2
+		assert.NoError(t, db.OpenWithOptions(path, 0666, nil))
+		assert.Equal(t, db.InitialMmapSize, minMmapSize*2)
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error { return nil }))
+		db.Close()
+	})
+}
+
+// Ensure that the timeout option is used for a held file lock.
+func TestDBOpenWithOptionsTimeout(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		db.syscall = &heldlocksyscall{until: time.Now().Add(time.Hour)}
+		assert.Equal(t, db.OpenWithOptions(path, 0666, &Options{Timeout: 100 * time.Millisecond}), ErrTimeout)
+		assert.Equal(t, db.Timeout, 100*time.Millisecond)
+	})
+}
+
+// Ensure that the meta file is opened without O_SYNC when NoSync is set.
+func TestDBOpenWithOptionsNoSync(t *testing.T) {
+	withMockDB(func(db *DB, mockos *mockos, mocksyscall *mocksyscall, path string) {
+		exp := &os.PathError{}
+		file := &mockfile{}
+		mockos.On("OpenFile", path, os.O_RDWR|os.O_CREATE, os.FileMode(0666)).Return(file, nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_EX|syscall.LOCK_NB).Return(nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_UN).Return(nil)
+		mockos.On("OpenFile", path, os.O_RDWR, os.FileMode(0666)).Return((*mockfile)(nil), exp)
+		file.On("Close").Return(nil)
+		err := db.OpenWithOptions(path, 0666, &Options{NoSync: true})
+		assert.Equal(t, err, exp)
+		assert.True(t, db.NoSync)
+	})
+}
+
 // Ensure that the database returns an error if the meta file handle cannot be open.
 func TestDBOpenMetaFileError(t *testing.T) {
 	withMockDB(func(db *DB, mockos *mockos, mocksyscall *mocksyscall, path string) {
 		exp := &os.PathError{}
-		mockos.On("OpenFile", path, os.O_RDWR|os.O_CREATE, os.FileMode(0666)).Return(&mockfile{}, nil)
+		file := &mockfile{}
+		mockos.On("OpenFile", path, os.O_RDWR|os.O_CREATE, os.FileMode(0666)).Return(file, nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_EX|syscall.LOCK_NB).Return(nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_UN).Return(nil)
 		mockos.On("OpenFile", path, os.O_RDWR|os.O_SYNC, os.FileMode(0666)).Return((*mockfile)(nil), exp)
+		file.On("Close").Return(nil)
 		err := db.Open(path, 0666)
 		assert.Equal(t, err, exp)
+		file.AssertCalled(t, "Close")
+		assert.Nil(t, db.file)
 	})
 }
 
@@ -60,7 +219,11 @@ func TestDBMetaInitWriteError(t *testing.T) {
 		// Mock the file system.
 		file, metafile := &mockfile{}, &mockfile{}
 		mockos.On("OpenFile", path, os.O_RDWR|os.O_CREATE, os.FileMode(0666)).Return(file, nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_EX|syscall.LOCK_NB).Return(nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_UN).Return(nil)
 		mockos.On("OpenFile", path, os.O_RDWR|os.O_SYNC, os.FileMode(0666)).Return(metafile, nil)
+		file.On("Close").Return(nil)
+		metafile.On("Close").Return(nil)
 		mockos.On("Getpagesize").Return(0x10000)
 		file.On("Stat").Return(&mockfileinfo{"", 0, 0666, time.Now(), false, nil}, nil)
 		metafile.On("WriteAt", mock.Anything, int64(0)).Return(0, io.ErrShortWrite)
@@ -68,6 +231,11 @@ func TestDBMetaInitWriteError(t *testing.T) {
 		// Open the database.
 		err := db.Open(path, 0666)
 		assert.Equal(t, err, io.ErrShortWrite)
+
+		// Both file handles are closed on failure.
+		file.AssertCalled(t, "Close")
+		metafile.AssertCalled(t, "Close")
+		assert.False(t, db.isOpened)
 	})
 }
 
@@ -76,12 +244,21 @@ func TestDBFileTooSmall(t *testing.T) {
 	withMockDB(func(db *DB, mockos *mockos, mocksyscall *mocksyscall, path string) {
 		file, metafile := &mockfile{}, &mockfile{}
 		mockos.On("OpenFile", path, os.O_RDWR|os.O_CREATE, os.FileMode(0666)).Return(file, nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_EX|syscall.LOCK_NB).Return(nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_UN).Return(nil)
 		mockos.On("OpenFile", path, os.O_RDWR|os.O_SYNC, os.FileMode(0666)).Return(metafile, nil)
+		file.On("Close").Return(nil)
+		metafile.On("Close").Return(nil)
 		mockos.On("Getpagesize").Return(0x1000)
 		file.On("Stat").Return(&mockfileinfo{"", 0, 0666, time.Now(), false, nil}, nil)
 		metafile.On("WriteAt", mock.Anything, int64(0)).Return(0, nil)
 		err := db.Open(path, 0666)
 		assert.ErrorContains(t, err, errMsgFileTooSmall)
+
+		// Both file handles are closed on failure.
+		file.AssertCalled(t, "Close")
+		metafile.AssertCalled(t, "Close")
+		assert.False(t, db.isOpened)
 	})
 }
 
@@ -91,13 +268,47 @@ func TestDBMmapStatError(t *testing.T) {
 		exp := &os.PathError{}
 		file, metafile := &mockfile{}, &mockfile{}
 		mockos.On("OpenFile", path, os.O_RDWR|os.O_CREATE, os.FileMode(0666)).Return(file, nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_EX|syscall.LOCK_NB).Return(nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_UN).Return(nil)
 		mockos.On("OpenFile", path, os.O_RDWR|os.O_SYNC, os.FileMode(0666)).Return(metafile, nil)
+		file.On("Close").Return(nil)
+		metafile.On("Close").Return(nil)
 		mockos.On("Getpagesize").Return(0x1000)
 		file.On("ReadAt", mock.Anything, int64(0)).Return(0, nil)
 		file.On("Stat").Return((*mockfileinfo)(nil), exp)
 		metafile.On("WriteAt", mock.Anything, int64(0)).Return(0, nil)
 		err := db.Open(path, 0666)
 		assert.ErrorContains(t, err, errMsgStat)
+
+		// Both file handles are closed on failure.
+		file.AssertCalled(t, "Close")
+		metafile.AssertCalled(t, "Close")
+		assert.False(t, db.isOpened)
+	})
+}
+
+// Ensure that the first meta page is read in full even when reads come back short.
+func TestDBOpenShortRead(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.Open(path, 0666))
+		pageSize := db.pageSize
+		db.Close()
+
+		db.os = &shortreados{}
+		assert.NoError(t, db.Open(path, 0666))
+		assert.Equal(t, db.pageSize, pageSize)
+		db.Close()
+	})
+}
+
+// Ensure that a data file too short to hold a meta page returns an error.
+func TestDBOpenTruncatedMeta(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, os.WriteFile(path, make([]byte, 100), 0666))
+		err := db.Open(path, 0666)
+		assert.ErrorContains(t, err, errMsgMetaRead)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.False(t, db.isOpened)
 	})
 }
 
@@ -120,9 +331,14 @@ func TestDBCorruptMeta0(t *testing.T) {
 		// Mock file access.
 		file, metafile := &mockfile{}, &mockfile{}
 		mockos.On("OpenFile", path, os.O_RDWR|os.O_CREATE, os.FileMode(0666)).Return(file, nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_EX|syscall.LOCK_NB).Return(nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_UN).Return(nil)
 		mockos.On("OpenFile", path, os.O_RDWR|os.O_SYNC, os.FileMode(0666)).Return(metafile, nil)
+		file.On("Close").Return(nil)
+		metafile.On("Close").Return(nil)
 		mockos.On("Getpagesize").Return(0x10000)
-		file.On("ReadAt", mock.Anything, int64(0)).Return(0, nil)
+		// Meta page 1 is looked for at every valid page size.
+		file.On("ReadAt", mock.Anything, mock.Anything).Return(0x1000, nil)
 		file.On("Stat").Return(&mockfileinfo{"", 0x10000, 0666, time.Now(), false, nil}, nil)
 		metafile.On("WriteAt", mock.Anything, int64(0)).Return(0, nil)
 		mocksyscall.On("Mmap", 0, int64(0), 0x10000, syscall.PROT_READ, syscall.MAP_SHARED).Return(b, nil)
@@ -130,19 +346,662 @@ func TestDBCorruptMeta0(t *testing.T) {
 		// Open the database.
 		err := db.Open(path, 0666)
 		assert.ErrorContains(t, err, ErrInvalid.Error())
+
+		// Both file handles are closed on failure.
+		file.AssertCalled(t, "Close")
+		metafile.AssertCalled(t, "Close")
+		assert.False(t, db.isOpened)
+	})
+}
+
+// Ensure that meta page 1 is found at the page size the file was created
+// with when the OS page size differs.
+func TestDBMeta1PageSize(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		pageSize := 0x2000
+		if os.Getpagesize() == pageSize {
+			pageSize = 0x4000
+		}
+		db.os = &pagesizeos{pageSize: pageSize}
+		assert.NoError(t, db.Open(path, 0666))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		db.Close()
+		db.os = &sysos{}
+
+		// Meta page 0 is intact so it gives the page size.
+		db.ForceMetaChoice = ForceMeta1
+		assert.NoError(t, db.Open(path, 0666))
+		assert.Equal(t, db.pageSize, pageSize)
+		assert.Equal(t, db.meta(), db.meta1)
+		db.Close()
+		db.ForceMetaChoice = ForceMetaAuto
+
+		// With its magic gone every page size is tried.
+		f, err := os.OpenFile(path, os.O_RDWR, 0666)
+		assert.NoError(t, err)
+		_, err = f.WriteAt(make([]byte, 4), int64(pageHeaderSize))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		assert.NoError(t, db.OpenReadOnly(path, 0666))
+		defer db.Close()
+		assert.Equal(t, db.pageSize, pageSize)
+		_ = db.View(func(txn *Transaction) error {
+			value, _ := txn.Get("widgets", []byte("foo"))
+			assert.Equal(t, value, []byte("bar"))
+			return nil
+		})
+	})
+}
+
+// pagesizeos reports a page size other than the OS one.
+type pagesizeos struct {
+	sysos
+	pageSize int
+}
+
+func (o *pagesizeos) Getpagesize() int {
+	return o.pageSize
+}
+
+// Ensure that a database opens with the other meta page when one fails its checksum.
+func TestDBMetaChecksum(t *testing.T) {
+	for _, id := range []int{0, 1} {
+		withDB(func(db *DB, path string) {
+			assert.NoError(t, db.Open(path, 0666))
+			assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+				return txn.CreateBucket("widgets")
+			}))
+			pageSize := db.pageSize
+			db.Close()
+
+			// Flip a byte in the page size field of the meta page.
+			f, err := os.OpenFile(path, os.O_RDWR, 0666)
+			assert.NoError(t, err)
+			off := int64(id*pageSize + pageHeaderSize + 8)
+			b := make([]byte, 1)
+			_, err = f.ReadAt(b, off)
+			assert.NoError(t, err)
+			b[0] ^= 0xFF
+			_, err = f.WriteAt(b, off)
+			assert.NoError(t, err)
+			f.Close()
+
+			assert.NoError(t, db.Open(path, 0666))
+			defer db.Close()
+			assert.Equal(t, db.meta0.validate() == ErrChecksum, id == 0)
+			assert.Equal(t, db.meta1.validate() == ErrChecksum, id == 1)
+			assert.NoError(t, db.View(func(txn *Transaction) error {
+				assert.NoError(t, txn.meta.validate())
+				return nil
+			}))
+		})
+	}
+}
+
+// Ensure that transactions start from a validated copy of the meta page.
+func TestDBMetaCopy(t *testing.T) {
+	valid := func(id txID) *meta {
+		m := &meta{magic: magic, version: version, pageSize: 4096, txID: id}
+		m.checksum = m.sum64()
+		return m
+	}
+	db := &DB{meta0: valid(2), meta1: valid(3)}
+	m, err := db.metaCopy()
+	assert.NoError(t, err)
+	assert.Equal(t, m.txID, txID(3))
+	assert.False(t, m == db.meta1)
+
+	// A meta page that fails validation isn't copied.
+	db.meta1.pageID++
+	m, err = db.metaCopy()
+	assert.NoError(t, err)
+	assert.Equal(t, m.txID, txID(2))
+
+	// A forced meta page isn't swapped for the other one.
+	db.force = ForceMeta1
+	_, err = db.metaCopy()
+	assert.Equal(t, err, ErrChecksum)
+	db.force = ForceMetaAuto
+
+	db.meta0.pageID++
+	_, err = db.metaCopy()
+	assert.Equal(t, err, ErrChecksum)
+}
+
+// Ensure that a torn write of the newest meta page opens the database at the prior transaction.
+func TestDBCorruptNewestMeta(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.Open(path, 0666))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("baz"), []byte("bat"))
+		}))
+		id, prev := db.meta().txID, db.meta().txID-1
+		pageSize := db.pageSize
+		db.Close()
+
+		// Zero the newest meta page as if its write was torn.
+		f, err := os.OpenFile(path, os.O_RDWR, 0666)
+		assert.NoError(t, err)
+		_, err = f.WriteAt(make([]byte, 16), int64(int(id%2)*pageSize+pageHeaderSize))
+		assert.NoError(t, err)
+		f.Close()
+
+		assert.NoError(t, db.Open(path, 0666))
+		assert.Equal(t, db.meta().txID, prev)
+		_ = db.View(func(txn *Transaction) error {
+			value, _ := txn.Get("widgets", []byte("foo"))
+			assert.Equal(t, value, []byte("bar"))
+			value, _ = txn.Get("widgets", []byte("baz"))
+			assert.Nil(t, value)
+			return nil
+		})
+
+		// The next commit replaces the corrupt meta page.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("baz"), []byte("bat"))
+		}))
+		assert.NoError(t, db.meta0.validate())
+		assert.NoError(t, db.meta1.validate())
+		db.Close()
+
+		// Both meta pages being corrupt is an error.
+		f, err = os.OpenFile(path, os.O_RDWR, 0666)
+		assert.NoError(t, err)
+		_, err = f.WriteAt(make([]byte, 16), int64(pageHeaderSize))
+		assert.NoError(t, err)
+		_, err = f.WriteAt(make([]byte, 16), int64(pageSize+pageHeaderSize))
+		assert.NoError(t, err)
+		f.Close()
+		assert.ErrorContains(t, db.Open(path, 0666), ErrInvalid.Error())
+	})
+}
+
+// Ensure that a meta page fails validation when its checksum doesn't match.
+func TestMetaValidateChecksum(t *testing.T) {
+	m := &meta{magic: magic, version: version, pageSize: 4096, txID: 10}
+	m.checksum = m.sum64()
+	assert.NoError(t, m.validate())
+	m.txID++
+	assert.Equal(t, m.validate(), ErrChecksum)
+}
+
+// Ensure that a freelist page claiming more ids than it can hold returns an error.
+func TestDBCorruptFreelist(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.Open(path, 0666))
+		pageSize := db.pageSize
+		db.Close()
+
+		// Overwrite the freelist page with an implausible count.
+		buf := make([]byte, pageSize)
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		p.id = 2
+		p.flags = freelistPageFlag
+		p.count = 0xFFFF
+		(*[2]pageID)(unsafe.Pointer(&p.ptr))[1] = 1 << 40
+		f, err := os.OpenFile(path, os.O_RDWR, 0666)
+		assert.NoError(t, err)
+		_, err = f.WriteAt(buf, int64(2*pageSize))
+		assert.NoError(t, err)
+		f.Close()
+
+		var db2 DB
+		assert.Equal(t, db2.Open(path, 0666), ErrInvalid)
+	})
+}
+
+// Ensure that a freelist listing live pages doesn't make them allocatable.
+func TestDBCorruptFreelistLivePages(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.Open(path, 0666))
+		pageSize := db.pageSize
+		db.Close()
+
+		// Overwrite the freelist page (2) to list the meta pages, itself and the buckets page (3).
+		// The checksum matches as if a bug had written the ids.
+		buf := make([]byte, pageSize)
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		p.id = 2
+		p.flags = freelistPageFlag
+		p.count = 5
+		ids := []pageID{10, 3, 2, 1, 0}
+		slots := (*[6]pageID)(unsafe.Pointer(&p.ptr))
+		slots[0] = pageID(freelistChecksum(ids))
+		copy(slots[1:], ids)
+		f, err := os.OpenFile(path, os.O_RDWR, 0666)
+		assert.NoError(t, err)
+		_, err = f.WriteAt(buf, int64(2*pageSize))
+		assert.NoError(t, err)
+		f.Close()
+
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+		assert.Equal(t, db.freelist.ids(), []pageID{10})
+	})
+}
+
+// Ensure that a freelist page whose ids don't match its checksum fails to open.
+func TestDBCorruptFreelistChecksum(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.Open(path, 0666))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return nil
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		pageSize, id := db.pageSize, db.meta().freelistPageID
+		db.Close()
+
+		// Flip a bit in the last page id on the freelist page.
+		f, err := os.OpenFile(path, os.O_RDWR, 0666)
+		assert.NoError(t, err)
+		buf := make([]byte, pageSize)
+		_, err = f.ReadAt(buf, int64(id)*int64(pageSize))
+		assert.NoError(t, err)
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		if assert.True(t, p.count > 0) {
+			(*[maxAllocSize / 8]pageID)(unsafe.Pointer(&p.ptr))[p.count] ^= 1
+		}
+		_, err = f.WriteAt(buf, int64(id)*int64(pageSize))
+		assert.NoError(t, err)
+		f.Close()
+
+		assert.Equal(t, db.Open(path, 0666), ErrChecksum)
+	})
+}
+
+// Ensure that allocating the live freelist or buckets page fails an assertion.
+func TestDBAllocateLivePage(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		txn, err := db.rwtxBegin()
+		assert.NoError(t, err)
+		defer txn.Rollback()
+
+		db.freelist.readIDs([]pageID{txn.meta.bucketsPageID})
+		assert.Panics(t, func() { txn.allocate(1) })
+		db.freelist.readIDs([]pageID{txn.meta.freelistPageID})
+		assert.Panics(t, func() { txn.allocate(1) })
+	})
+}
+
+// Ensure that a failed open leaves the database in a state that can be opened again.
+func TestDBReopenAfterOpenError(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.Open(path, 0666))
+		db.Close()
+
+		// Fail after the files are opened and the meta page is read.
+		db.Comparator = func(a, b []byte) int { return bytes.Compare(b, a) }
+		db.ComparatorName = "reverse"
+		assert.Equal(t, db.Open(path, 0666), ErrComparatorMismatch)
+		assert.Nil(t, db.file)
+		assert.Nil(t, db.metafile)
+		assert.Equal(t, db.Path(), "")
+
+		// Open again with the right configuration.
+		db.Comparator, db.ComparatorName = nil, ""
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		}))
+	})
+}
+
+// Ensure that a database with an unexpected page size can't be opened.
+func TestDBOpenExpectPageSize(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		// A new file isn't initialized with the wrong page size.
+		db.ExpectPageSize = os.Getpagesize() * 2
+		assert.Equal(t, db.Open(path, 0666), ErrPageSizeMismatch)
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, info.Size(), int64(0))
+		assert.Equal(t, db.Path(), "")
+
+		db.ExpectPageSize = os.Getpagesize()
+		assert.NoError(t, db.Open(path, 0666))
+		db.Close()
+
+		// An existing file is checked against its stored page size.
+		assert.Equal(t, db.OpenWithOptions(path, 0666, &Options{ExpectPageSize: 1024}), ErrPageSizeMismatch)
+		assert.Nil(t, db.file)
+		assert.NoError(t, db.OpenWithOptions(path, 0666, &Options{ExpectPageSize: os.Getpagesize()}))
+		db.Close()
+		assert.NoError(t, db.OpenWithOptions(path, 0666, &Options{}))
+		db.Close()
+	})
+}
+
+// Ensure that a database whose meta pages hold a bogus page size can't be opened.
+func TestDBOpenInvalidPageSize(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.Open(path, 0666))
+		pageSize := db.pageSize
+		db.Close()
+
+		// Rewrite the page size of a meta page with a valid checksum.
+		setPageSize := func(id int, size uint32) {
+			f, err := os.OpenFile(path, os.O_RDWR, 0666)
+			assert.NoError(t, err)
+			defer f.Close()
+			b := make([]byte, pageSize)
+			_, err = f.ReadAt(b, int64(id*pageSize))
+			assert.NoError(t, err)
+			m := (*page)(unsafe.Pointer(&b[0])).meta()
+			m.pageSize = size
+			m.checksum = m.sum64()
+			_, err = f.WriteAt(b, int64(id*pageSize))
+			assert.NoError(t, err)
+		}
+
+		// The other meta page is used when only one is bogus.
+		setPageSize(0, uint32(pageSize)+1)
+		assert.NoError(t, db.Open(path, 0666))
+		assert.Equal(t, db.pageSize, pageSize)
+		db.Close()
+
+		for _, size := range []uint32{0, 3000, minPageSize / 2, maxPageSize * 2} {
+			setPageSize(0, size)
+			setPageSize(1, size)
+			err := db.Open(path, 0666)
+			assert.ErrorIs(t, err, ErrInvalidPageSize)
+			assert.ErrorContains(t, err, errMsgMeta)
+			assert.False(t, db.isOpened)
+			assert.Nil(t, db.file)
+		}
+	})
+}
+
+// Ensure that a database isn't created with a page size it can't open.
+func TestDBInitInvalidPageSize(t *testing.T) {
+	withMockDB(func(db *DB, mockos *mockos, mocksyscall *mocksyscall, path string) {
+		file, metafile := &mockfile{}, &mockfile{}
+		mockos.On("OpenFile", path, os.O_RDWR|os.O_CREATE, os.FileMode(0666)).Return(file, nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_EX|syscall.LOCK_NB).Return(nil)
+		mocksyscall.On("Flock", 0, syscall.LOCK_UN).Return(nil)
+		mockos.On("OpenFile", path, os.O_RDWR|os.O_SYNC, os.FileMode(0666)).Return(metafile, nil)
+		file.On("Close").Return(nil)
+		metafile.On("Close").Return(nil)
+		mockos.On("Getpagesize").Return(3000)
+		file.On("Stat").Return(&mockfileinfo{"", 0, 0666, time.Now(), false, nil}, nil)
+
+		assert.Equal(t, db.Open(path, 0666), ErrInvalidPageSize)
+		metafile.AssertNotCalled(t, "WriteAt", mock.Anything, mock.Anything)
+		file.AssertCalled(t, "Close")
+		assert.False(t, db.isOpened)
+	})
+}
+
+// Ensure that a panic in Update or View releases the transaction.
+func TestDBUpdatePanic(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.PanicsWithValue(t, "boom", func() {
+			_ = db.Update(func(txn *RWTransaction) error {
+				txn.CreateBucket("widgets")
+				panic("boom")
+			})
+		})
+
+		// The writer lock is free and nothing was committed.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			assert.Nil(t, txn.Bucket("widgets"))
+			return txn.CreateBucket("woojits")
+		}))
+
+		assert.PanicsWithValue(t, "boom", func() {
+			_ = db.View(func(txn *Transaction) error {
+				panic("boom")
+			})
+		})
+		assert.Equal(t, len(db.txs), 0)
+
+		// A remap waits on open readers so it would block if one was leaked.
+		assert.NoError(t, db.Remap())
+		assert.NoError(t, db.View(func(txn *Transaction) error {
+			assert.NotNil(t, txn.Bucket("woojits"))
+			return nil
+		}))
+	})
+}
+
+// Ensure that a done context stops Update and View.
+func TestDBUpdateContext(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// An already cancelled context doesn't call the function.
+		var called bool
+		assert.Equal(t, db.UpdateContext(ctx, func(txn *RWTransaction) error {
+			called = true
+			return nil
+		}), context.Canceled)
+		assert.Equal(t, db.ViewContext(ctx, func(txn *Transaction) error {
+			called = true
+			return nil
+		}), context.Canceled)
+		assert.False(t, called)
+
+		// A context cancelled while the function runs rolls back.
+		ctx, cancel = context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		assert.Equal(t, db.UpdateContext(ctx, func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			<-ctx.Done()
+			return nil
+		}), context.Canceled)
+		assert.Equal(t, db.ViewContext(ctx, func(txn *Transaction) error {
+			return nil
+		}), context.Canceled)
+
+		// A live context commits.
+		ctx = context.Background()
+		assert.NoError(t, db.UpdateContext(ctx, func(txn *RWTransaction) error {
+			return txn.CreateBucket("woojits")
+		}))
+		assert.NoError(t, db.ViewContext(ctx, func(txn *Transaction) error {
+			assert.Nil(t, txn.Bucket("widgets"))
+			assert.NotNil(t, txn.Bucket("woojits"))
+			return nil
+		}))
+	})
+}
+
+// Ensure that a new database is seeded once and an existing one is left alone.
+func TestDBOpenAndSeed(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		var n int
+		seed := func(txn *RWTransaction) error {
+			n++
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}
+		assert.NoError(t, db.OpenAndSeed(path, 0666, seed))
+		assert.Equal(t, n, 1)
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("foo"), []byte("baz"))
+		}))
+		db.Close()
+
+		assert.NoError(t, db.OpenAndSeed(path, 0666, seed))
+		defer db.Close()
+		assert.Equal(t, n, 1)
+		_ = db.View(func(txn *Transaction) error {
+			value, _ := txn.Get("widgets", []byte("foo"))
+			assert.Equal(t, value, []byte("baz"))
+			return nil
+		})
+	})
+}
+
+// Ensure that a failed seed closes the database and is retried on the next open.
+func TestDBOpenAndSeedError(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		exp := fmt.Errorf("seed error")
+		assert.Equal(t, db.OpenAndSeed(path, 0666, func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return exp
+		}), exp)
+		assert.Equal(t, db.Path(), "")
+
+		assert.NoError(t, db.OpenAndSeed(path, 0666, func(txn *RWTransaction) error {
+			return txn.CreateBucket("woojits")
+		}))
+		defer db.Close()
+		_ = db.View(func(txn *Transaction) error {
+			assert.Nil(t, txn.Bucket("widgets"))
+			assert.NotNil(t, txn.Bucket("woojits"))
+			return nil
+		})
+	})
+}
+
+// Ensure that a populated database can be opened read-only.
+func TestDBOpenReadOnly(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.Open(path, 0666))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		db.Close()
+
+		// Make the file read-only, as it would be on read-only media.
+		assert.NoError(t, os.Chmod(path, 0444))
+		assert.NoError(t, db.OpenReadOnly(path, 0666))
+		defer db.Close()
+		assert.Nil(t, db.metafile)
+
+		assert.NoError(t, db.View(func(txn *Transaction) error {
+			value, err := txn.Get("widgets", []byte("foo"))
+			assert.NoError(t, err)
+			assert.Equal(t, value, []byte("bar"))
+			return nil
+		}))
+		err := db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("baz"), []byte("bat"))
+		})
+		assert.Equal(t, err, ErrDatabaseReadOnly)
+	})
+}
+
+// Ensure that an empty file can't be opened read-only.
+func TestDBOpenReadOnlyEmpty(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		f, err := os.Create(path)
+		assert.NoError(t, err)
+		f.Close()
+		assert.Equal(t, db.OpenReadOnly(path, 0666), ErrInvalid)
+		assert.Nil(t, db.file)
+	})
+}
+
+// Ensure that a database can be opened with the older meta page.
+func TestDBForceMeta(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		// Create a bucket in one transaction (meta 0) and a key in the next (meta 1).
+		assert.NoError(t, db.Open(path, 0666))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		db.Close()
+
+		// Forcing the older meta page opens the state before the put.
+		db.ForceMetaChoice = ForceMeta0
+		assert.NoError(t, db.Open(path, 0666))
+		_ = db.View(func(txn *Transaction) error {
+			assert.NotNil(t, txn.Bucket("widgets"))
+			value, _ := txn.Get("widgets", []byte("foo"))
+			assert.Nil(t, value)
+			return nil
+		})
+
+		// A commit overwrites the newer meta page.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("baz"), []byte("bat"))
+		}))
+		db.Close()
+
+		db.ForceMetaChoice = ForceMetaAuto
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+		_ = db.View(func(txn *Transaction) error {
+			value, _ := txn.Get("widgets", []byte("baz"))
+			assert.Equal(t, value, []byte("bat"))
+			return nil
+		})
 	})
 }
 
 // Ensure that the mmap grows appropriately.
 func TestDBMmapSize(t *testing.T) {
 	db := &DB{pageSize: 4096}
-	assert.Equal(t, db.mmapSize(0), minMmapSize)
-	assert.Equal(t, db.mmapSize(16384), minMmapSize)
-	assert.Equal(t, db.mmapSize(minMmapSize-1), minMmapSize)
-	assert.Equal(t, db.mmapSize(minMmapSize), minMmapSize*2)
-	assert.Equal(t, db.mmapSize(10000000), 20000768)
-	assert.Equal(t, db.mmapSize((1<<30)-1), 2147483648)
-	assert.Equal(t, db.mmapSize(1<<30), 1<<31)
+	mmapSize := func(size int) int {
+		size, err := db.mmapSize(size)
+		assert.NoError(t, err)
+		return size
+	}
+	assert.Equal(t, mmapSize(0), minMmapSize)
+	assert.Equal(t, mmapSize(16384), minMmapSize)
+	assert.Equal(t, mmapSize(minMmapSize-1), minMmapSize)
+	assert.Equal(t, mmapSize(minMmapSize), minMmapSize*2)
+	assert.Equal(t, mmapSize(10000000), 20000768)
+	if maxMapSize > 1<<32 {
+		assert.Equal(t, int64(mmapSize((1<<30)-1)), int64(1<<31))
+		assert.Equal(t, int64(mmapSize(1<<30)), int64(1<<31))
+	}
+}
+
+// Ensure that the mmap doesn't grow past the largest map the platform allows.
+func TestDBMmapSizeMax(t *testing.T) {
+	db := &DB{pageSize: 4096}
+	limit := maxMapSize / 4096 * 4096
+	for _, size := range []int{maxMapSize - maxMmapStep, maxMapSize - maxMmapStep + 1, limit - 1, limit} {
+		sz, err := db.mmapSize(size)
+		assert.NoError(t, err)
+		assert.Equal(t, sz, limit, "size=%d", size)
+	}
+
+	// Sizes that can't be mapped in whole pages are too large.
+	sizes := []int{limit + 1}
+	if over := int64(maxMapSize) + 1; over <= math.MaxInt {
+		sizes = append(sizes, int(over))
+	}
+	for _, size := range sizes {
+		_, err := db.mmapSize(size)
+		assert.Equal(t, err, ErrMmapTooLarge, "size=%d", size)
+	}
+}
+
+// Ensure that opening with an InitialMmapSize past the platform limit fails
+// with a clear error.
+func TestDBOpenInitialMmapSizeTooLarge(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		// The limit isn't a whole number of pages so it can't be mapped.
+		err := db.OpenWithOptions(path, 0666, &Options{InitialMmapSize: maxMapSize})
+		assert.Equal(t, err, ErrMmapTooLarge)
+		assert.NoError(t, db.OpenWithOptions(path, 0666, &Options{InitialMmapSize: 1 << 24}))
+		defer db.Close()
+		assert.Equal(t, len(db.mmapdata), 1<<25)
+	})
 }
 
 // Ensure a closed database returns an error while running a transaction block
@@ -167,15 +1026,175 @@ func TestDBTransactionBlockWhileClosed(t *testing.T) {
 	})
 }
 
-// withDB executes a function with a database reference.
-func withDB(fn func(*DB, string)) {
-	name := "myboltdb-" + fmt.Sprintf("%d", rand.Int63n(math.MaxInt64))
-	fmt.Println(name)
-	f, _ := os.CreateTemp("", name)
-	path := f.Name()
-	f.Close()
-	os.Remove(path)
-	defer os.RemoveAll(path)
+// Ensure that a reader picks up pages committed by another writer after its mmap was created.
+func TestDBRemapOnExternalGrowth(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		// Open a read-only handle, as a reader in another process would.
+		// It doesn't wait for the writer's file lock.
+		reader := DB{Timeout: -1}
+		assert.NoError(t, reader.OpenReadOnly(path, 0666))
+		defer reader.Close()
+		size := len(reader.mmapdata)
+
+		// Grow the file past the reader's mmap.
+		err := db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 25000; i++ {
+				if err := txn.Put("widgets", []byte(fmt.Sprintf("%08d", i)), make([]byte, 200)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+
+		// The reader should remap and see every key.
+		count := 0
+		err = reader.View(func(txn *Transaction) error {
+			return txn.ForEach("widgets", func(k, v []byte) error {
+				count++
+				return nil
+			})
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, count, 25000)
+		assert.True(t, len(reader.mmapdata) > size)
+	})
+}
+
+// Ensure that a reader can wait for a commit made through another handle.
+func TestDBWaitForTxID(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		var reader DB
+		assert.NoError(t, reader.OpenReadOnly(path, 0666))
+		defer reader.Close()
+
+		var id int
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			id = txn.ID()
+			return txn.CreateBucket("widgets")
+		}))
+
+		// A committed id returns right away.
+		assert.NoError(t, reader.WaitForTxID(context.Background(), id))
+
+		// A later id waits for the commit.
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_ = db.Update(func(txn *RWTransaction) error {
+				return txn.Put("widgets", []byte("foo"), []byte("bar"))
+			})
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, reader.WaitForTxID(ctx, id+1))
+		_ = reader.View(func(txn *Transaction) error {
+			value, _ := txn.Get("widgets", []byte("foo"))
+			assert.Equal(t, value, []byte("bar"))
+			return nil
+		})
+
+		// An id that is never committed waits for the context.
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, reader.WaitForTxID(ctx, id+2), context.DeadlineExceeded)
+	})
+}
+
+// Ensure that syncing a closed database returns an error.
+func TestDBSyncNotOpen(t *testing.T) {
+	var db DB
+	assert.Equal(t, db.Sync(), ErrDatabaseNotOpen)
+}
+
+// Ensure that waiting on a closed database returns an error.
+func TestDBWaitForTxIDNotOpen(t *testing.T) {
+	var db DB
+	assert.Equal(t, db.WaitForTxID(context.Background(), 1), ErrDatabaseNotOpen)
+}
+
+// Ensure that remapping a removed data file returns an error and keeps the current map.
+func TestDBRemapFileRemoved(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		assert.NoError(t, os.Remove(path))
+
+		assert.Equal(t, db.GrowTo(len(db.mmapdata)*2), ErrFileRemoved)
+		err := db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 25000; i++ {
+				if err := txn.Put("widgets", []byte(fmt.Sprintf("%08d", i)), make([]byte, 200)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrFileRemoved)
+
+		// Reads still work off the current map.
+		assert.NoError(t, db.View(func(txn *Transaction) error {
+			value, _ := txn.Get("widgets", []byte("foo"))
+			assert.Equal(t, value, []byte("bar"))
+			return nil
+		}))
+	})
+}
+
+// shortreados opens files whose reads return at most 16 bytes at a time.
+type shortreados struct {
+	sysos
+}
+
+func (o *shortreados) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	f, err := o.sysos.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &shortreadfile{f}, nil
+}
+
+type shortreadfile struct {
+	file
+}
+
+func (f *shortreadfile) ReadAt(b []byte, off int64) (int, error) {
+	return f.file.ReadAt(b[:min(len(b), 16)], off)
+}
+
+// heldlocksyscall simulates a file lock held by another process until a given time.
+type heldlocksyscall struct {
+	syssyscall
+	until time.Time
+}
+
+func (o *heldlocksyscall) Flock(fd int, how int) error {
+	if how != syscall.LOCK_UN && time.Now().Before(o.until) {
+		return syscall.EWOULDBLOCK
+	}
+	return o.syssyscall.Flock(fd, how)
+}
+
+// madvisesyscall mocks madvise calls and passes the rest through.
+type madvisesyscall struct {
+	syssyscall
+	mock.Mock
+}
+
+func (o *madvisesyscall) Madvise(b []byte, advice int) error {
+	return o.Called(len(b), advice).Error(0)
+}
+
+// withDB executes a function with a database reference.
+func withDB(fn func(*DB, string)) {
+	name := "myboltdb-" + fmt.Sprintf("%d", rand.Int63n(math.MaxInt64))
+	fmt.Println(name)
+	f, _ := os.CreateTemp("", name)
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	defer os.RemoveAll(path)
 
 	var db DB
 	fn(&db, path)
@@ -190,6 +1209,25 @@ func withMockDB(fn func(*DB, *mockos, *mocksyscall, string)) {
 	fn(&db, os, syscall, "/mock/db")
 }
 
+// fill creates a bucket, unless it exists, and puts n keys made by fillKey
+// with 100 byte values into it.
+func fill(txn *RWTransaction, name string, n int) error {
+	if err := txn.CreateBucketIfNotExists(name); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := txn.Put(name, fillKey(i), make([]byte, 100)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillKey returns the i-th key that fill puts.
+func fillKey(i int) []byte {
+	return []byte(fmt.Sprintf("%05d", i))
+}
+
 // withOpenDB executes a function with an already opened database.
 func withOpenDB(fn func(*DB, string)) {
 	withDB(func(db *DB, path string) {
@@ -200,3 +1238,1074 @@ func withOpenDB(fn func(*DB, string)) {
 		fn(db, path)
 	})
 }
+
+// Ensure that a value held by an open read transaction stays valid while a
+// writer needs to remap, and that the remap waits for the reader to close.
+func TestDBRemapWaitsForReader(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+
+		txn, err := db.txBegin()
+		assert.NoError(t, err)
+		value, _ := txn.Get("widgets", []byte("foo"))
+		assert.Equal(t, value, []byte("bar"))
+		size := len(db.mmapdata)
+
+		// Write enough data to grow the mmap.
+		done := make(chan error)
+		go func() {
+			done <- db.Update(func(txn *RWTransaction) error {
+				for i := 0; i < 8; i++ {
+					if err := txn.Put("widgets", []byte(fmt.Sprintf("big%d", i)), make([]byte, 1<<20)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}()
+
+		// The writer can't remap while the reader is open.
+		select {
+		case err := <-done:
+			t.Fatalf("writer finished while reader was open: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		assert.Equal(t, value, []byte("bar"))
+		assert.Equal(t, len(db.mmapdata), size)
+
+		// Closing the reader lets the remap and commit continue.
+		txn.Close()
+		assert.NoError(t, <-done)
+		assert.True(t, len(db.mmapdata) > size)
+	})
+}
+
+// Ensure that a writer waiting for another writer doesn't block readers or the first commit.
+func TestDBWaitingWriterDoesNotBlockReaders(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		txn, err := db.rwtxBegin()
+		assert.NoError(t, err)
+		assert.NoError(t, txn.CreateBucket("widgets"))
+
+		// Queue a second writer behind the first.
+		done := make(chan error)
+		go func() {
+			done <- db.Update(func(txn *RWTransaction) error {
+				return txn.Put("widgets", []byte("foo"), []byte("bar"))
+			})
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		// Readers and the first writer's commit still go through.
+		assert.NoError(t, db.View(func(txn *Transaction) error { return nil }))
+		assert.NoError(t, txn.Commit())
+		assert.NoError(t, <-done)
+	})
+}
+
+// Ensure that Remap shrinks a grown mmap back to fit the data.
+func TestDBRemap(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		// Load a lot of data, delete it and give the pages back.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 50000; i++ {
+				if err := txn.Put("widgets", fillKey(i), make([]byte, 200)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 50000; i++ {
+				if err := txn.Delete("widgets", fillKey(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		assert.NoError(t, db.CompactFreelist())
+		size := len(db.mmapdata)
+		assert.True(t, size > minMmapSize)
+		assert.True(t, int(db.meta().pageID)*db.pageSize < minMmapSize)
+
+		assert.NoError(t, db.Remap())
+		assert.Equal(t, len(db.mmapdata), minMmapSize)
+
+		// The data is still readable after remapping.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		assert.NoError(t, db.Remap())
+		_ = db.View(func(txn *Transaction) error {
+			value, _ := txn.Get("widgets", []byte("foo"))
+			assert.Equal(t, value, []byte("bar"))
+			return nil
+		})
+	})
+}
+
+// Ensure that remaps are counted and reported.
+func TestDBStatsRemap(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		var sizes []int
+		db.OnRemap = func(size int, d time.Duration) {
+			sizes = append(sizes, size)
+		}
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+		assert.Equal(t, db.Stats().RemapN, 0)
+
+		// Grow the file past the initial map.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 25000; i++ {
+				if err := txn.Put("widgets", []byte(fmt.Sprintf("%08d", i)), make([]byte, 200)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		stats := db.Stats()
+		assert.True(t, stats.RemapN > 0)
+		assert.True(t, stats.RemapTime > 0)
+		assert.Equal(t, len(sizes), stats.RemapN)
+		assert.Equal(t, sizes[len(sizes)-1], len(db.mmapdata))
+	})
+}
+
+// Ensure that a database can be compacted into another one bucket at a time.
+func TestDBCompactTo(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for _, name := range []string{"widgets", "woojits", "empty"} {
+				txn.CreateBucket(name)
+			}
+			for i := 0; i < 1000; i++ {
+				txn.Put("widgets", []byte(fmt.Sprintf("%04d", i)), []byte("bar"))
+			}
+			txn.Put("woojits", []byte("foo"), []byte("baz"))
+			_, err := txn.NextSequence("woojits")
+			return err
+		}))
+
+		withOpenDB(func(dst *DB, path string) {
+			// A bucket copied before an interruption is left alone.
+			assert.NoError(t, dst.Update(func(txn *RWTransaction) error {
+				txn.CreateBucket("woojits")
+				return txn.Put("woojits", []byte("foo"), []byte("copied"))
+			}))
+
+			assert.NoError(t, db.CompactTo(dst))
+			assert.NoError(t, dst.View(func(txn *Transaction) error {
+				assert.Equal(t, len(txn.Buckets()), 3)
+				var n int
+				txn.ForEach("widgets", func(k, v []byte) error {
+					assert.Equal(t, k, []byte(fmt.Sprintf("%04d", n)))
+					assert.Equal(t, v, []byte("bar"))
+					n++
+					return nil
+				})
+				assert.Equal(t, n, 1000)
+				value, _ := txn.Get("woojits", []byte("foo"))
+				assert.Equal(t, value, []byte("copied"))
+				return nil
+			}))
+		})
+	})
+}
+
+// Ensure that the bucket sequence is kept when compacting.
+func TestDBCompactToSequence(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 3; i++ {
+				txn.NextSequence("widgets")
+			}
+			return nil
+		}))
+
+		withOpenDB(func(dst *DB, path string) {
+			assert.NoError(t, db.CompactTo(dst))
+			assert.NoError(t, dst.Update(func(txn *RWTransaction) error {
+				seq, err := txn.NextSequence("widgets")
+				assert.Equal(t, seq, 4)
+				return err
+			}))
+		})
+	})
+}
+
+// Ensure that a backup taken while a writer commits is a valid copy of the database.
+func TestDBBackup(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			fill(txn, "widgets", 1000)
+			txn.CreateBucket("woojits")
+			return txn.Put("woojits", []byte("foo"), []byte("bar"))
+		}))
+
+		withDB(func(dst *DB, dstpath string) {
+			// Commit while the backup's read transaction is open.
+			assert.NoError(t, db.View(func(txn *Transaction) error {
+				assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+					return txn.Put("woojits", []byte("baz"), []byte("bat"))
+				}))
+				f, _ := os.Create(dstpath)
+				defer f.Close()
+				n, err := txn.WriteTo(f)
+				assert.NoError(t, err)
+				assert.Equal(t, n, int64(txn.meta.pageID)*int64(db.pageSize))
+				return err
+			}))
+
+			assert.NoError(t, dst.Open(dstpath, 0666))
+			defer dst.Close()
+			assert.Nil(t, dst.Check())
+			_ = dst.View(func(txn *Transaction) error {
+				var n int
+				txn.ForEach("widgets", func(k, v []byte) error {
+					assert.Equal(t, k, fillKey(n))
+					assert.Equal(t, len(v), 100)
+					n++
+					return nil
+				})
+				assert.Equal(t, n, 1000)
+				value, _ := txn.Get("woojits", []byte("foo"))
+				assert.Equal(t, value, []byte("bar"))
+				value, _ = txn.Get("woojits", []byte("baz"))
+				assert.Nil(t, value)
+				return nil
+			})
+
+			// The backup can be written to.
+			assert.NoError(t, dst.Update(func(txn *RWTransaction) error {
+				return txn.Put("woojits", []byte("baz"), []byte("bat"))
+			}))
+		})
+
+		// Backup replaces the file and includes the later commit.
+		withDB(func(dst *DB, dstpath string) {
+			assert.NoError(t, os.WriteFile(dstpath, make([]byte, 1<<20), 0666))
+			assert.NoError(t, db.Backup(dstpath))
+			assert.NoError(t, dst.Open(dstpath, 0666))
+			defer dst.Close()
+			assert.Nil(t, dst.Check())
+			_ = dst.View(func(txn *Transaction) error {
+				value, _ := txn.Get("woojits", []byte("baz"))
+				assert.Equal(t, value, []byte("bat"))
+				return nil
+			})
+		})
+	})
+}
+
+// Ensure that a backup is written through the DB's file system.
+func TestDBBackupOS(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		recorder := &recordingos{}
+		db.os = recorder
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		defer os.Remove(path + ".bak")
+
+		n := len(recorder.writes)
+		assert.NoError(t, db.Backup(path+".bak"))
+		assert.True(t, len(recorder.writes) > n)
+		assert.Equal(t, recorder.writes[n].off, int64(0))
+		assert.Equal(t, recorder.syncs[len(recorder.syncs)-1], len(recorder.writes))
+
+		// Write errors are returned.
+		recorder.writeErrs = []error{syscall.EIO}
+		assert.ErrorIs(t, db.Backup(path+".bak"), syscall.EIO)
+	})
+}
+
+// Ensure that backing up a closed database returns an error.
+func TestDBBackupNotOpen(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.Equal(t, db.Backup(path+".bak"), ErrDatabaseNotOpen)
+		os.Remove(path + ".bak")
+	})
+}
+
+// Ensure that a backup is checked once it's written.
+func TestDBBackupAndVerify(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		defer os.Remove(path + ".bak")
+		assert.NoError(t, db.BackupAndVerify(path+".bak"))
+
+		// Put the bucket's root page on the freelist too and reopen.
+		var root, freelistPageID pageID
+		_ = db.View(func(txn *Transaction) error {
+			root = txn.Bucket("widgets").rootPageID
+			freelistPageID = txn.meta.freelistPageID
+			return nil
+		})
+		pageSize := db.pageSize
+		db.Close()
+		f, err := os.OpenFile(path, os.O_RDWR, 0666)
+		assert.NoError(t, err)
+		buf := make([]byte, pageSize)
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		p.id = freelistPageID
+		p.flags = freelistPageFlag
+		p.count = 1
+		slots := (*[2]pageID)(unsafe.Pointer(&p.ptr))
+		slots[0], slots[1] = pageID(freelistChecksum([]pageID{root})), root
+		_, err = f.WriteAt(buf, int64(freelistPageID)*int64(pageSize))
+		assert.NoError(t, err)
+		f.Close()
+		assert.NoError(t, db.Open(path, 0666))
+
+		// The backup carries the problem over and fails its check.
+		err = db.BackupAndVerify(path + ".bak")
+		assert.ErrorContains(t, err, "backup check: ")
+		assert.ErrorContains(t, err, fmt.Sprintf("page %d: referenced by freelist and bucket \"widgets\"", root))
+
+		db.Close()
+		assert.Equal(t, db.BackupAndVerify(path+".bak"), ErrDatabaseNotOpen)
+	})
+}
+
+// Ensure that compacting after deleting most keys makes a much smaller file.
+func TestDBCompact(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 10000)
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 10000; i++ {
+				if i%10 == 0 {
+					continue
+				}
+				if err := txn.Delete("widgets", fillKey(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+
+		withDB(func(dst *DB, dstpath string) {
+			saved, err := db.Compact(dstpath)
+			assert.NoError(t, err)
+			srcInfo, _ := os.Stat(path)
+			dstInfo, _ := os.Stat(dstpath)
+			assert.Equal(t, saved, srcInfo.Size()-dstInfo.Size())
+			assert.True(t, dstInfo.Size()*4 < srcInfo.Size(), "src=%d dst=%d", srcInfo.Size(), dstInfo.Size())
+
+			assert.NoError(t, dst.Open(dstpath, 0666))
+			defer dst.Close()
+			assert.Nil(t, dst.Check())
+			_ = dst.View(func(txn *Transaction) error {
+				var n int
+				txn.ForEach("widgets", func(k, v []byte) error {
+					assert.Equal(t, k, []byte(fmt.Sprintf("%05d", n*10)))
+					n++
+					return nil
+				})
+				assert.Equal(t, n, 1000)
+				return nil
+			})
+		})
+	})
+}
+
+// Ensure that the new data file is opened and measured through the DB's os.
+func TestDBCompactUsesOS(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 100)
+		}))
+		o := &statos{}
+		db.os = o
+		withDB(func(dst *DB, dstpath string) {
+			_, err := db.Compact(dstpath)
+			assert.NoError(t, err)
+			assert.Equal(t, o.opened, []string{dstpath, dstpath})
+			assert.Equal(t, o.statted, []string{dstpath})
+		})
+	})
+}
+
+// statos records the files opened and stat'ed through it.
+type statos struct {
+	sysos
+	opened  []string
+	statted []string
+}
+
+func (o *statos) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	o.opened = append(o.opened, name)
+	return o.sysos.OpenFile(name, flag, perm)
+}
+
+func (o *statos) Stat(name string) (os.FileInfo, error) {
+	o.statted = append(o.statted, name)
+	return o.sysos.Stat(name)
+}
+
+// Ensure that the page and transaction counters follow allocations and frees.
+func TestDBStats(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		stats := db.Stats()
+		assert.Equal(t, stats.PageSize, db.pageSize)
+		assert.Equal(t, stats.HighWaterPageID, 4)
+		assert.Equal(t, stats.FreePageN, 0)
+		assert.Equal(t, stats.PendingPageN, 0)
+
+		// Allocating pages moves the high water mark.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 1000)
+		}))
+		stats = db.Stats()
+		assert.True(t, stats.HighWaterPageID > 4)
+		assert.Equal(t, stats.CommitN, 1)
+
+		// Pages freed while a reader is open are pending.
+		txn, err := db.txBegin()
+		assert.NoError(t, err)
+		assert.Equal(t, db.Stats().OpenTxN, 1)
+		assert.Equal(t, db.Stats().TxN, stats.TxN+1)
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 1000; i++ {
+				txn.Delete("widgets", fillKey(i))
+			}
+			return nil
+		}))
+		stats = db.Stats()
+		assert.True(t, stats.PendingPageN > 0)
+		assert.Equal(t, stats.PendingAlloc, stats.PendingPageN*db.pageSize)
+
+		// They are free once the reader closes and the next writer starts.
+		txn.Close()
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error { return nil }))
+		next := db.Stats()
+		assert.Equal(t, next.OpenTxN, 0)
+		assert.Equal(t, next.CommitN, 3)
+		assert.True(t, next.FreePageN > 0)
+		assert.True(t, next.PendingPageN < stats.PendingPageN)
+	})
+}
+
+// Ensure that Stats can be sampled while a writer holds the locks.
+func TestDBStatsWhileWriting(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		txn, err := db.rwtxBegin()
+		assert.NoError(t, err)
+		db.metalock.Lock()
+		db.mmaplock.Lock()
+		done := make(chan Stats)
+		go func() { done <- db.Stats() }()
+		select {
+		case stats := <-done:
+			assert.Equal(t, stats.PageSize, db.pageSize)
+			assert.Equal(t, stats.HighWaterPageID, 4)
+		case <-time.After(time.Second):
+			t.Error("Stats blocked on a lock")
+		}
+		db.mmaplock.Unlock()
+		db.metalock.Unlock()
+		txn.Rollback()
+	})
+}
+
+// Ensure that writers are warned, or held back, while too many pages are pending.
+func TestDBMaxPendingPageN(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		defer log.SetOutput(os.Stderr)
+
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 1000)
+		}))
+
+		// Pages freed while a reader is open stay pending.
+		txn, err := db.txBegin()
+		assert.NoError(t, err)
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 1000; i++ {
+				txn.Delete("widgets", fillKey(i))
+			}
+			return nil
+		}))
+		db.MaxPendingPageN = db.Stats().PendingPageN
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error { return nil }))
+		assert.Equal(t, buf.Len(), 0)
+
+		// The warning is logged once.
+		db.MaxPendingPageN = 10
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error { return nil }))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error { return nil }))
+		assert.Equal(t, strings.Count(buf.String(), "MaxPendingPageN"), 1)
+
+		// Strict mode rejects writes until the reader closes.
+		db.StrictMaxPendingPageN = true
+		assert.Equal(t, db.Update(func(txn *RWTransaction) error { return nil }), ErrTooManyPendingPages)
+		txn.Close()
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error { return nil }))
+		assert.True(t, db.Stats().PendingPageN <= 10)
+	})
+}
+
+// Ensure that a write past the end of the map fails with NoAutoGrow until the map is grown.
+func TestDBNoAutoGrow(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.OpenWithOptions(path, 0666, &Options{NoAutoGrow: true}))
+		defer db.Close()
+		size := len(db.mmapdata)
+
+		fill := func(txn *RWTransaction) error {
+			txn.CreateBucketIfNotExists("widgets")
+			for i := 0; i < 25000; i++ {
+				if err := txn.Put("widgets", []byte(fmt.Sprintf("%08d", i)), make([]byte, 200)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		assert.Equal(t, db.Update(fill), ErrDatabaseFull)
+		assert.Equal(t, len(db.mmapdata), size)
+		assert.Equal(t, db.Stats().RemapN, 0)
+
+		// Growing ahead of time lets the write through without remapping.
+		assert.NoError(t, db.GrowTo(size*4))
+		assert.True(t, len(db.mmapdata) >= size*4)
+		remaps := db.Stats().RemapN
+		assert.NoError(t, db.Update(fill))
+		assert.Equal(t, db.Stats().RemapN, remaps)
+		_ = db.View(func(txn *Transaction) error {
+			assert.Equal(t, txn.Bucket("widgets").Stats().KeyN, 25000)
+			return nil
+		})
+	})
+}
+
+// Ensure that the map is advised for random reads and keeps the advice it is given.
+func TestDBMadvise(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		s := &madvisesyscall{}
+		db.syscall = s
+		s.On("Madvise", minMmapSize, syscall.MADV_RANDOM).Return(nil).Once()
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+		s.AssertExpectations(t)
+
+		s.On("Madvise", minMmapSize, syscall.MADV_SEQUENTIAL).Return(nil).Once()
+		assert.NoError(t, db.Madvise(syscall.MADV_SEQUENTIAL))
+		s.AssertExpectations(t)
+
+		// Advice that fails isn't kept.
+		s.On("Madvise", minMmapSize, -1).Return(syscall.EINVAL).Once()
+		assert.Equal(t, db.Madvise(-1), syscall.EINVAL)
+
+		// The advice is given again when remapping.
+		s.On("Madvise", minMmapSize*4, syscall.MADV_SEQUENTIAL).Return(nil).Once()
+		assert.NoError(t, db.GrowTo(minMmapSize*2))
+		s.AssertExpectations(t)
+	})
+}
+
+// Ensure that a database opens on a platform without madvise.
+func TestDBMadviseUnsupported(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		s := &madvisesyscall{}
+		db.syscall = s
+		s.On("Madvise", mock.Anything, mock.Anything).Return(syscall.ENOSYS)
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		}))
+		assert.Equal(t, db.Madvise(syscall.MADV_SEQUENTIAL), syscall.ENOSYS)
+	})
+}
+
+// Ensure that advising a closed database returns an error.
+func TestDBMadviseWhileClosed(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.Equal(t, db.Madvise(syscall.MADV_SEQUENTIAL), ErrDatabaseNotOpen)
+	})
+}
+
+// Ensure that remapping a closed database returns an error.
+func TestDBRemapWhileClosed(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.Equal(t, db.Remap(), ErrDatabaseNotOpen)
+	})
+}
+
+// Ensure that a database opened with DirectIO can write and read back data.
+func TestDBDirectIO(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		db.DirectIO = true
+		if err := db.Open(path, 0666); err != nil {
+			t.Skipf("O_DIRECT not supported: %s", err)
+		}
+		err := db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		})
+		assert.NoError(t, err)
+
+		// Small commits write contiguous pages in runs from a scratch buffer.
+		for i := 0; i < 300; i++ {
+			err := db.Update(func(txn *RWTransaction) error {
+				return txn.Put("widgets", fillKey(i), make([]byte, 100))
+			})
+			assert.NoError(t, err)
+		}
+		db.Close()
+
+		// Reopen and read the data back.
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+		_ = db.View(func(txn *Transaction) error {
+			value, err := txn.Get("widgets", []byte("foo"))
+			assert.NoError(t, err)
+			assert.Equal(t, value, []byte("bar"))
+			assert.Equal(t, txn.Bucket("widgets").KeyN(), 301)
+			return nil
+		})
+	})
+}
+
+// Ensure that aligned buffers start on the requested boundary.
+func TestAlignedBuffer(t *testing.T) {
+	for _, align := range []int{512, 4096, 65536} {
+		buf := alignedBuffer(3*align, align)
+		assert.Equal(t, len(buf), 3*align)
+		assert.Equal(t, int(uintptr(unsafe.Pointer(&buf[0]))%uintptr(align)), 0)
+	}
+}
+
+// Ensure that entries can be validated without a transaction.
+func TestDBValidateEntry(t *testing.T) {
+	var db DB
+	assert.NoError(t, db.ValidateEntry([]byte("foo"), []byte("bar")))
+	assert.NoError(t, db.ValidateEntry([]byte("foo"), nil))
+	assert.Equal(t, db.ValidateEntry(nil, []byte("bar")), ErrKeyRequired)
+	assert.Equal(t, db.ValidateEntry([]byte{}, []byte("bar")), ErrKeyRequired)
+	assert.Equal(t, db.ValidateEntry(make([]byte, MaxKeySize+1), []byte("bar")), ErrKeyTooLarge)
+}
+
+// Ensure that keys too large for a branch page to hold two of them are rejected.
+func TestDBValidateEntryBranchKeySize(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		limit := (db.pageSize-pageHeaderSize)/minKeysPerPage - branchPageElementSize
+		assert.NoError(t, db.ValidateEntry(make([]byte, limit), []byte("bar")))
+		assert.Equal(t, db.ValidateEntry(make([]byte, limit+1), []byte("bar")), ErrKeyTooLarge)
+
+		err := db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", make([]byte, limit+1), []byte("bar"))
+		})
+		assert.Equal(t, err, ErrKeyTooLarge)
+	})
+}
+
+// Ensure that entries needing more overflow pages than allowed are rejected.
+func TestDBMaxOverflowPages(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		db.MaxOverflowPages = 2
+		limit := 3*db.pageSize - pageHeaderSize - leafPageElementSize - 3
+		assert.NoError(t, db.ValidateEntry([]byte("foo"), make([]byte, limit-1)))
+		assert.Equal(t, db.ValidateEntry([]byte("foo"), make([]byte, limit)), ErrValueTooLarge)
+
+		err := db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			assert.NoError(t, txn.Put("widgets", []byte("foo"), make([]byte, limit-1)))
+			return txn.Put("widgets", []byte("bar"), make([]byte, 1<<20))
+		})
+		assert.Equal(t, err, ErrValueTooLarge)
+
+		// No cap by default.
+		db.MaxOverflowPages = 0
+		assert.NoError(t, db.ValidateEntry([]byte("foo"), make([]byte, 1<<20)))
+	})
+}
+
+// Ensure that a custom comparator orders keys and is enforced on reopen.
+func TestDBComparator(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		reverse := func(a, b []byte) int { return bytes.Compare(b, a) }
+		db.Comparator, db.ComparatorName = reverse, "reverse"
+		assert.NoError(t, db.Open(path, 0666))
+		_ = db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 1000)
+		})
+		_ = db.View(func(txn *Transaction) error {
+			value, err := txn.Get("widgets", fillKey(123))
+			assert.NoError(t, err)
+			assert.NotNil(t, value)
+
+			var keys []string
+			txn.ForEach("widgets", func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+			if assert.Equal(t, len(keys), 1000) {
+				assert.Equal(t, keys[0], string(fillKey(999)))
+				assert.Equal(t, keys[999], string(fillKey(0)))
+			}
+			return nil
+		})
+		db.Close()
+
+		// Reopening with the default comparator is rejected.
+		var db2 DB
+		assert.Equal(t, db2.Open(path, 0666), ErrComparatorMismatch)
+
+		// A comparator without a name is rejected.
+		var db3 DB
+		db3.Comparator = reverse
+		assert.Equal(t, db3.Open(path, 0666), ErrComparatorNameRequired)
+
+		// Reopening with the same comparator works.
+		var db4 DB
+		db4.Comparator, db4.ComparatorName = reverse, "reverse"
+		assert.NoError(t, db4.Open(path, 0666))
+		db4.Close()
+	})
+}
+
+// Ensure that committed transactions don't leak pages.
+func TestDBLeakedPageCount(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		n, err := db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, n, 0)
+
+		for i := 0; i < 10; i++ {
+			err := db.Update(func(txn *RWTransaction) error {
+				txn.CreateBucketIfNotExists("widgets")
+				for j := 0; j < 500; j++ {
+					txn.Put("widgets", []byte(fmt.Sprintf("%04d", j)), []byte(fmt.Sprintf("value-%d", i)))
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+		}
+		n, err = db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, n, 0)
+
+		// Allocate a page that nothing references.
+		_ = db.Update(func(txn *RWTransaction) error {
+			_, err := txn.allocate(1)
+			return err
+		})
+		n, err = db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, n, 1)
+	})
+}
+
+// Ensure that leaked pages are counted without starting a write transaction,
+// which would fail on a read-only database or while too many pages are pending.
+func TestDBLeakedPageCountWithoutWriter(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 100)
+		}))
+		txn, err := db.txBegin()
+		assert.NoError(t, err)
+		defer txn.Close()
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			if _, err := txn.allocate(1); err != nil {
+				return err
+			}
+			return txn.Put("widgets", fillKey(0), []byte("bar"))
+		}))
+		db.MaxPendingPageN = 1
+		db.StrictMaxPendingPageN = true
+		pending, err := db.PendingPageIDs()
+		assert.NoError(t, err)
+		n, err := db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, n, 1)
+		after, err := db.PendingPageIDs()
+		assert.NoError(t, err)
+		assert.Equal(t, after, pending)
+
+		var reader DB
+		assert.NoError(t, reader.OpenReadOnly(path, 0666))
+		defer reader.Close()
+		n, err = reader.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, n, 1)
+	})
+}
+
+// Ensure that a consistent database passes the check.
+func TestDBCheck(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.Nil(t, db.Check())
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+				fill(txn, "widgets", 1000)
+				txn.CreateBucketIfNotExists("woojits")
+				for j := 0; j < 500; j += 2 {
+					txn.Delete("widgets", fillKey(j))
+				}
+				return txn.Put("woojits", []byte("foo"), make([]byte, 3*db.pageSize))
+			}))
+		}
+		assert.Nil(t, db.Check())
+
+		// Pages allocated by a commit but not referenced are unreachable.
+		_ = db.Update(func(txn *RWTransaction) error {
+			_, err := txn.allocate(1)
+			return err
+		})
+		errs := db.Check()
+		if assert.Equal(t, len(errs), 1) {
+			assert.Contains(t, errs[0].Error(), "unreachable")
+		}
+	})
+}
+
+// Ensure that a page referenced by both a bucket and the freelist is reported.
+func TestDBCheckDoubleReference(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		var root, freelistPageID pageID
+		_ = db.View(func(txn *Transaction) error {
+			root = txn.Bucket("widgets").rootPageID
+			freelistPageID = txn.meta.freelistPageID
+			return nil
+		})
+		pageSize := db.pageSize
+		db.Close()
+
+		// Rewrite the freelist page to hold the bucket's root page.
+		f, err := os.OpenFile(path, os.O_RDWR, 0666)
+		assert.NoError(t, err)
+		buf := make([]byte, pageSize)
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		p.id = freelistPageID
+		p.flags = freelistPageFlag
+		p.count = 1
+		slots := (*[2]pageID)(unsafe.Pointer(&p.ptr))
+		slots[0], slots[1] = pageID(freelistChecksum([]pageID{root})), root
+		_, err = f.WriteAt(buf, int64(freelistPageID)*int64(pageSize))
+		assert.NoError(t, err)
+		f.Close()
+
+		assert.NoError(t, db.Open(path, 0666))
+		errs := db.Check()
+		assert.Contains(t, fmt.Sprint(errs), fmt.Sprintf("page %d: referenced by freelist and bucket \"widgets\"", root))
+	})
+}
+
+// Ensure that out of order keys and pages past the high-water mark are reported.
+func TestDBCheckCorruptPages(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			txn.Put("widgets", []byte("a"), []byte("bar"))
+			return txn.Put("widgets", []byte("b"), []byte("bar"))
+		}))
+
+		// Overwrite the first key in the file so that it sorts after the second.
+		var off int64
+		_ = db.View(func(txn *Transaction) error {
+			key := txn.page(txn.Bucket("widgets").rootPageID).leafPageElement(0).key()
+			off = int64(uintptr(unsafe.Pointer(&key[0])) - uintptr(unsafe.Pointer(&db.mmapdata[0])))
+			return nil
+		})
+		f, err := os.OpenFile(path, os.O_RDWR, 0666)
+		assert.NoError(t, err)
+		_, err = f.WriteAt([]byte("c"), off)
+		assert.NoError(t, err)
+		f.Close()
+		errs := db.Check()
+		assert.Contains(t, fmt.Sprint(errs), `key 1 "b" is not after "c"`)
+
+		// A bucket pointing past the high-water mark.
+		_ = db.View(func(txn *Transaction) error {
+			txn.buckets.get("widgets").rootPageID = txn.meta.pageID + 10
+			errs := txn.check()
+			assert.Contains(t, fmt.Sprint(errs), fmt.Sprintf("page %d: bucket \"widgets\" is past the high water mark %d", txn.meta.pageID+10, txn.meta.pageID))
+			return nil
+		})
+	})
+}
+
+// Ensure that compacting the freelist gives back free pages at the end of the file.
+func TestDBCompactFreelist(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 1000)
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 1000; i++ {
+				if err := txn.Delete("widgets", fillKey(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+
+		// Release the pending pages before compacting.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error { return nil }))
+		before := db.Stats()
+		assert.NoError(t, db.CompactFreelist())
+		after := db.Stats()
+		assert.True(t, after.HighWaterPageID < before.HighWaterPageID)
+		assert.True(t, after.FreePageN < before.FreePageN)
+		assert.Nil(t, db.Check())
+
+		// The compacted file reopens and keeps its data.
+		db.Close()
+		assert.NoError(t, db.Open(path, 0666))
+		assert.Nil(t, db.Check())
+		_ = db.View(func(txn *Transaction) error {
+			value, _ := txn.Get("widgets", []byte("foo"))
+			assert.Equal(t, value, []byte("bar"))
+			return nil
+		})
+	})
+}
+
+// Ensure that checking a closed database returns an error.
+func TestDBCheckWhileClosed(t *testing.T) {
+	var db DB
+	assert.Equal(t, db.Check(), []error{ErrDatabaseNotOpen})
+}
+
+// Ensure that counting leaked pages on a closed database returns an error.
+func TestDBLeakedPageCountWhileClosed(t *testing.T) {
+	var db DB
+	_, err := db.LeakedPageCount()
+	assert.Equal(t, err, ErrDatabaseNotOpen)
+}
+
+// Ensure that the free and pending page ids can be listed.
+func TestDBFreePageIDs(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		ids, err := db.FreePageIDs()
+		assert.NoError(t, err)
+		assert.Equal(t, ids, []int{})
+
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 100)
+		}))
+
+		// Pages freed while a reader is open stay pending.
+		txn, err := db.txBegin()
+		assert.NoError(t, err)
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", fillKey(0), []byte("bar"))
+		}))
+		pending, err := db.PendingPageIDs()
+		assert.NoError(t, err)
+		freed := pending[int(db.meta().txID)]
+		assert.True(t, len(freed) > 0)
+		ids, err = db.FreePageIDs()
+		assert.NoError(t, err)
+		for _, id := range freed {
+			assert.NotContains(t, ids, id)
+		}
+
+		// Listing doesn't release them. The next writer does once the reader
+		// closes. The ids are a copy.
+		txn.Close()
+		txid := int(db.meta().txID)
+		pending, err = db.PendingPageIDs()
+		assert.NoError(t, err)
+		assert.Equal(t, pending[txid], freed)
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error { return nil }))
+		pending, err = db.PendingPageIDs()
+		assert.NoError(t, err)
+		assert.NotContains(t, pending, txid)
+		ids, err = db.FreePageIDs()
+		assert.NoError(t, err)
+		assert.True(t, len(ids) > 0)
+		ids[0] = 0
+		ids, err = db.FreePageIDs()
+		assert.NoError(t, err)
+		assert.NotEqual(t, ids[0], 0)
+	})
+}
+
+// Ensure that page ids can be listed on a read-only database.
+func TestDBFreePageIDsReadOnly(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			if err := fill(txn, "widgets", 100); err != nil {
+				return err
+			}
+			return txn.Delete("widgets", fillKey(0))
+		}))
+		n := db.freelist.count()
+		assert.True(t, n > 0)
+		db.Close()
+
+		// Pending pages on the freelist page are free to a new handle.
+		var reader DB
+		assert.NoError(t, reader.OpenReadOnly(path, 0666))
+		defer reader.Close()
+		ids, err := reader.FreePageIDs()
+		assert.NoError(t, err)
+		assert.Equal(t, len(ids), n)
+		pending, err := reader.PendingPageIDs()
+		assert.NoError(t, err)
+		assert.Equal(t, len(pending), 0)
+	})
+}
+
+// Ensure that page ids can be listed while writers are held back by too many
+// pending pages.
+func TestDBPendingPageIDsOverStrictLimit(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 100)
+		}))
+		txn, err := db.txBegin()
+		assert.NoError(t, err)
+		defer txn.Close()
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", fillKey(0), []byte("bar"))
+		}))
+
+		db.MaxPendingPageN = 1
+		db.StrictMaxPendingPageN = true
+		assert.Equal(t, db.Update(func(txn *RWTransaction) error { return nil }), ErrTooManyPendingPages)
+		pending, err := db.PendingPageIDs()
+		assert.NoError(t, err)
+		assert.True(t, len(pending[int(db.meta().txID)]) > 1)
+		_, err = db.FreePageIDs()
+		assert.NoError(t, err)
+	})
+}
+
+// Ensure that listing page ids on a closed database returns an error.
+func TestDBFreePageIDsWhileClosed(t *testing.T) {
+	var db DB
+	_, err := db.FreePageIDs()
+	assert.Equal(t, err, ErrDatabaseNotOpen)
+	_, err = db.PendingPageIDs()
+	assert.Equal(t, err, ErrDatabaseNotOpen)
+}
@@ -10,6 +10,27 @@ var (
 	// different version of Bolt.
 	ErrVersionMismatch = errors.New("version mismatch")
 
+	// ErrChecksum is returned when the checksum of a meta page or a freelist
+	// page doesn't match its contents.
+	ErrChecksum = errors.New("checksum error")
+
+	// ErrComparatorMismatch is returned when opening a database with a
+	// different comparator than the one it was created with.
+	ErrComparatorMismatch = errors.New("comparator mismatch")
+
+	// ErrPageSizeMismatch is returned when opening a database whose page
+	// size isn't the DB's ExpectPageSize.
+	ErrPageSizeMismatch = errors.New("page size mismatch")
+
+	// ErrInvalidPageSize is returned when opening a database whose page size
+	// isn't a power of two between 1KiB and 64KiB, or when creating one on an
+	// OS that reports such a page size.
+	ErrInvalidPageSize = errors.New("invalid page size")
+
+	// ErrComparatorNameRequired is returned when opening a database with a
+	// Comparator but without a ComparatorName to identify it.
+	ErrComparatorNameRequired = errors.New("comparator name required")
+
 	// ErrDatabaseNotOpen is returned when a DB instance is accessed before it
 	// is opened or after it is closed.
 	ErrDatabaseNotOpen = errors.New("database not open")
@@ -18,6 +39,37 @@ var (
 	// already open.
 	ErrDatabaseOpen = errors.New("database already open")
 
+	// ErrDatabaseInUse is returned when a database file is locked by another
+	// process, or by another DB in this process.
+	ErrDatabaseInUse = errors.New("database is in use")
+
+	// ErrTimeout is returned when a database file can't be locked before
+	// the DB's Timeout has elapsed.
+	ErrTimeout = errors.New("timeout")
+
+	// ErrFileRemoved is returned when remapping a data file that has been
+	// deleted while the database was open. Writes to it would be lost when
+	// the database is closed.
+	ErrFileRemoved = errors.New("data file removed")
+
+	// ErrMmapTooLarge is returned when the data file needs to be mapped at
+	// a size that's larger than the platform can address, such as past 2GB
+	// on a 32-bit platform.
+	ErrMmapTooLarge = errors.New("mmap too large")
+
+	// ErrDatabaseFull is returned when a write needs to grow the memory map
+	// while the DB's NoAutoGrow option is set.
+	ErrDatabaseFull = errors.New("database is full")
+
+	// ErrTooManyPendingPages is returned when starting a write transaction
+	// while more pages are pending than the DB's MaxPendingPageN allows and
+	// StrictMaxPendingPageN is set.
+	ErrTooManyPendingPages = errors.New("too many pending pages")
+
+	// ErrDatabaseReadOnly is returned when starting a write transaction on a
+	// database that was opened read-only.
+	ErrDatabaseReadOnly = errors.New("database is in read-only mode")
+
 	// ErrBucketNotFound is returned when trying to access a bucket that has
 	// not been created yet.
 	ErrBucketNotFound = errors.New("bucket not found")
@@ -40,4 +92,20 @@ var (
 
 	// ErrValueTooLarge is returned when inserting a value that is larger than MaxValueSize.
 	ErrValueTooLarge = errors.New("value too large")
+
+	// ErrInvalidFlags is returned when putting a value with flags that are
+	// reserved by the database.
+	ErrInvalidFlags = errors.New("invalid flags")
+
+	// ErrNodeTooLarge is returned by Commit when a node is too large to be
+	// written to a page, such as one holding a value close to maxAllocSize.
+	ErrNodeTooLarge = errors.New("node too large")
+
+	// ErrTransactionNotWritable is returned when changing data through a
+	// read-only transaction.
+	ErrTransactionNotWritable = errors.New("transaction not writable")
+
+	// ErrCursorNotPositioned is returned when acting on the current element
+	// of a cursor that isn't on an element.
+	ErrCursorNotPositioned = errors.New("cursor not positioned")
 )
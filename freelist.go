@@ -2,6 +2,9 @@ package toyboltdb
 
 import (
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"slices"
 	"sort"
 	"unsafe"
 )
@@ -11,38 +14,167 @@ import (
 //
 // freelist manages used and unused pages.
 //
-// A freelist has many pages.
+// A freelist has many pages. Free pages are kept as runs of contiguous ids in
+// a tree ordered by first id that also tracks the longest run below each node,
+// so that an allocation finds the highest or lowest run that is long enough in
+// O(log n) for n runs instead of scanning every free id. Runs are also indexed
+// by their first and last ids so that freed pages are joined to the runs next
+// to them without rebuilding the index.
 type freelist struct {
-	pageIDs          []pageID
+	runs             *runNode       // free runs by first id
+	runStarts        map[pageID]int // run lengths by first id
+	runEnds          map[pageID]int // run lengths by last id
+	freeN            int            // number of free ids
 	pendingPageIDMap map[txID][]pageID
 }
 
+// size returns the size of the page after serialization.
+func (f *freelist) size() int {
+	// The first element holds the checksum.
+	n := f.count() + 1
+	if n > 0xFFFF {
+		// The second element will be used to store the count.
+		n++
+	}
+	return pageHeaderSize + (int(unsafe.Sizeof(pageID(0))) * n)
+}
+
+// count returns the number of free and pending page ids.
+func (f *freelist) count() int {
+	n := f.freeCount()
+	for _, ids := range f.pendingPageIDMap {
+		n += len(ids)
+	}
+	return n
+}
+
+// freeCount returns the number of free page ids.
+func (f *freelist) freeCount() int {
+	return f.freeN
+}
+
+// ids returns a list of all free ids in reverse sorted order.
+func (f *freelist) ids() []pageID {
+	ids := make([]pageID, 0, f.freeCount())
+	var walk func(r *runNode)
+	walk = func(r *runNode) {
+		if r == nil {
+			return
+		}
+		walk(r.right)
+		for i := r.n - 1; i >= 0; i-- {
+			ids = append(ids, r.start+pageID(i))
+		}
+		walk(r.left)
+	}
+	walk(f.runs)
+	return ids
+}
+
+// all returns a list of all free ids and all pending ids in reverse sorted order.
+func (f *freelist) all() []pageID {
+	ids := f.ids()
+	for _, list := range f.pendingPageIDMap {
+		ids = append(ids, list...)
+	}
+	sort.Sort(reverseSortedPageIDs(ids))
+	return ids
+}
+
+// readIDs replaces the free ids with a given list of ids, in any order.
+// Duplicate ids are only counted once.
+func (f *freelist) readIDs(ids []pageID) {
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	f.runs = nil
+	f.runStarts = make(map[pageID]int)
+	f.runEnds = make(map[pageID]int)
+	f.freeN = 0
+	for i := 0; i < len(ids); {
+		// Extend the run for as long as the ids are contiguous.
+		j := i + 1
+		for j < len(ids) && ids[j] == ids[j-1]+1 {
+			j++
+		}
+		f.addRun(ids[i], j-i)
+		i = j
+	}
+}
+
+// addRun indexes a run of n free pages starting at a given id.
+func (f *freelist) addRun(start pageID, n int) {
+	if f.runStarts == nil {
+		f.runStarts = make(map[pageID]int)
+		f.runEnds = make(map[pageID]int)
+	}
+	l, r := splitRuns(f.runs, start)
+	f.runs = mergeRuns(mergeRuns(l, newRunNode(start, n)), r)
+	f.runStarts[start] = n
+	f.runEnds[start+pageID(n-1)] = n
+	f.freeN += n
+}
+
+// delRun removes the run of n free pages starting at a given id from the index.
+func (f *freelist) delRun(start pageID, n int) {
+	l, r := splitRuns(f.runs, start)
+	_, r = splitRuns(r, start+1)
+	f.runs = mergeRuns(l, r)
+	delete(f.runStarts, start)
+	delete(f.runEnds, start+pageID(n-1))
+	f.freeN -= n
+}
+
 // allocate returns the starting page id of a contiguous list of pages of a given size.
 // If a contiguous block cannot be found then 0 is returned.
 //
+// The block is taken from the end of the highest run that is long enough.
+//
 // See test cases
 func (f *freelist) allocate(n int) pageID {
-	var count int
-	var previd pageID
-	for i, id := range f.pageIDs {
-		// Reset count if this is not contiguous.
-		if previd == 0 || previd-id != 1 {
-			count = 1
-		}
+	if n == 0 {
+		return 0
+	}
 
-		// If we found a contiguous block then remove it and return it.
-		if count == n {
-			f.pageIDs = append(f.pageIDs[:i-(n-1)], f.pageIDs[i+1:]...)
-			if id <= 1 {
-				panic(fmt.Sprintf("assertion failed: cannot allocate page 0 or 1: %d", id))
-			}
-			return id
-		}
+	r := f.runs.highest(n)
+	if r == nil {
+		return 0
+	}
+	start, size := r.start, r.n
+
+	// Keep the front of the run free.
+	f.delRun(start, size)
+	if size > n {
+		f.addRun(start, size-n)
+	}
+
+	id := start + pageID(size-n)
+	if id <= 1 {
+		panic(fmt.Sprintf("assertion failed: cannot allocate page 0 or 1: %d", id))
+	}
+	return id
+}
+
+// allocateLow is like allocate but returns the lowest contiguous block of a
+// given size so that the pages at the end of the file are left free.
+func (f *freelist) allocateLow(n int) pageID {
+	if n == 0 {
+		return 0
+	}
 
-		previd = id
-		count++
+	r := f.runs.lowest(n)
+	if r == nil {
+		return 0
 	}
-	return 0
+	start, size := r.start, r.n
+
+	// Keep the back of the run free.
+	f.delRun(start, size)
+	if size > n {
+		f.addRun(start+pageID(n), size-n)
+	}
+	return start
 }
 
 // free releases a page and its overflow for a given transaction id.
@@ -59,20 +191,266 @@ func (f *freelist) free(txID txID, p *page) {
 
 // release moves all page ids for a transaction id (or older) to the freelist.
 func (f *freelist) release(txID txID) {
+	var released []pageID
 	for tid, ids := range f.pendingPageIDMap {
 		if tid <= txID {
-			f.pageIDs = append(f.pageIDs, ids...)
+			released = append(released, ids...)
 			delete(f.pendingPageIDMap, tid)
 		}
 	}
-	sort.Sort(reverseSortedPageIDs(f.pageIDs))
+	f.add(released)
+}
+
+// add puts page ids back on the free ids, joining them to the runs next to them.
+// The ids must not be free already.
+func (f *freelist) add(ids []pageID) {
+	for _, id := range ids {
+		start, n := id, 1
+		if l, ok := f.runEnds[id-1]; ok {
+			start -= pageID(l)
+			n += l
+			f.delRun(start, l)
+		}
+		if l, ok := f.runStarts[id+1]; ok {
+			n += l
+			f.delRun(id+1, l)
+		}
+		f.addRun(start, n)
+	}
+}
+
+// remove takes n page ids starting at a given id out of the free page ids.
+// The runs that overlap them are split around them.
+func (f *freelist) remove(id pageID, n int) {
+	// Only the run that starts at or before id and the ones that start
+	// before the end can overlap.
+	end, lo := id+pageID(n), id
+	if r := f.runs.floor(id); r != nil {
+		lo = r.start
+	}
+	var overlap []*runNode
+	f.runs.ascend(lo, end, func(r *runNode) { overlap = append(overlap, r) })
+
+	for _, r := range overlap {
+		start, l := r.start, r.n
+		if last := start + pageID(l); last > id {
+			f.delRun(start, l)
+			if start < id {
+				f.addRun(start, int(id-start))
+			}
+			if last > end {
+				f.addRun(end, int(last-end))
+			}
+		}
+	}
+}
+
+// compact drops the run of free pages that ends at the high-water mark.
+// It returns the new high-water mark, which is lowered past the dropped pages.
+func (f *freelist) compact(highWater pageID) pageID {
+	if l, ok := f.runEnds[highWater-1]; ok {
+		highWater -= pageID(l)
+		f.delRun(highWater, l)
+	}
+	return highWater
+}
+
+// runNode is a run of free pages in a treap ordered by first id. The nodes
+// are heap-ordered by a random priority, which keeps the tree balanced in
+// expectation, and hold the longest run below them so that searches for a long
+// enough run skip the subtrees that have none.
+type runNode struct {
+	start       pageID
+	n           int
+	maxN        int // longest run in the subtree
+	priority    uint32
+	left, right *runNode
+}
+
+func newRunNode(start pageID, n int) *runNode {
+	return &runNode{start: start, n: n, maxN: n, priority: rand.Uint32()}
+}
+
+// update recomputes the longest run in the subtree after a child changes.
+func (r *runNode) update() *runNode {
+	r.maxN = r.n
+	if r.left != nil && r.left.maxN > r.maxN {
+		r.maxN = r.left.maxN
+	}
+	if r.right != nil && r.right.maxN > r.maxN {
+		r.maxN = r.right.maxN
+	}
+	return r
+}
+
+// splitRuns splits a tree into the runs that start before a given id and
+// the rest.
+func splitRuns(r *runNode, start pageID) (*runNode, *runNode) {
+	if r == nil {
+		return nil, nil
+	}
+	if r.start < start {
+		lo, hi := splitRuns(r.right, start)
+		r.right = lo
+		return r.update(), hi
+	}
+	lo, hi := splitRuns(r.left, start)
+	r.left = hi
+	return lo, r.update()
+}
+
+// mergeRuns joins two trees where every run in lo starts before those in hi.
+func mergeRuns(lo, hi *runNode) *runNode {
+	if lo == nil {
+		return hi
+	} else if hi == nil {
+		return lo
+	}
+	if lo.priority > hi.priority {
+		lo.right = mergeRuns(lo.right, hi)
+		return lo.update()
+	}
+	hi.left = mergeRuns(lo, hi.left)
+	return hi.update()
+}
+
+// highest returns the highest run of at least n pages, or nil if none is.
+func (r *runNode) highest(n int) *runNode {
+	if r == nil || r.maxN < n {
+		return nil
+	}
+	if hi := r.right.highest(n); hi != nil {
+		return hi
+	} else if r.n >= n {
+		return r
+	}
+	return r.left.highest(n)
+}
+
+// lowest returns the lowest run of at least n pages, or nil if none is.
+func (r *runNode) lowest(n int) *runNode {
+	if r == nil || r.maxN < n {
+		return nil
+	}
+	if lo := r.left.lowest(n); lo != nil {
+		return lo
+	} else if r.n >= n {
+		return r
+	}
+	return r.right.lowest(n)
+}
+
+// floor returns the run with the highest first id at or below id, if any.
+func (r *runNode) floor(id pageID) *runNode {
+	var found *runNode
+	for r != nil {
+		if r.start <= id {
+			found, r = r, r.right
+		} else {
+			r = r.left
+		}
+	}
+	return found
+}
+
+// ascend calls fn in order for the runs whose first id is in [lo, hi).
+func (r *runNode) ascend(lo, hi pageID, fn func(*runNode)) {
+	if r == nil {
+		return
+	}
+	if r.start > lo {
+		r.left.ascend(lo, hi, fn)
+	}
+	if r.start >= lo && r.start < hi {
+		fn(r)
+	}
+	if r.start < hi {
+		r.right.ascend(lo, hi, fn)
+	}
 }
 
 // read initializes the freelist from a freelist page.
-func (f *freelist) read(p *page) {
-	ids := ((*[maxAllocSize]pageID)(unsafe.Pointer(&p.ptr)))[0:p.count]
-	f.pageIDs = make([]pageID, len(ids))
-	copy(f.pageIDs, ids)
+// It returns ErrInvalid if the page claims more ids than fit in it and its overflow.
+func (f *freelist) read(p *page, pageSize int) error {
+	ids, err := readFreelistPage(p, pageSize)
+	if err != nil {
+		return err
+	}
+	f.readIDs(ids)
+	return nil
+}
+
+// readFreelistPage returns the page ids stored on a freelist page as they are
+// on the page, including any duplicates.
+// It returns ErrInvalid if the page claims more ids than fit in it and its
+// overflow, and ErrChecksum if the ids don't match the page's checksum.
+//
+// The first slot holds the checksum of the ids. The page count holds the
+// number of ids when it is below 0xFFFF. Otherwise the count is set to 0xFFFF
+// and the real count is stored as a uint64 in the second slot, followed by
+// the ids.
+func readFreelistPage(p *page, pageSize int) ([]pageID, error) {
+	if (p.flags & freelistPageFlag) == 0 {
+		return nil, ErrInvalid
+	}
+
+	// Determine how many ids the page and its overflow can hold.
+	capacity := ((int(p.overflow)+1)*pageSize - pageHeaderSize) / int(unsafe.Sizeof(pageID(0)))
+	slots := (*[maxAllocSize / 8]pageID)(unsafe.Pointer(&p.ptr))
+
+	idx, count := 1, int(p.count)
+	if count == 0xFFFF {
+		idx = 2
+		if capacity < idx {
+			return nil, ErrInvalid
+		}
+		n := slots[1]
+		if n > pageID(capacity) {
+			return nil, ErrInvalid
+		}
+		count = int(n)
+	}
+	if idx+count > capacity {
+		return nil, ErrInvalid
+	}
+
+	ids := slots[idx : idx+count]
+	if uint64(slots[0]) != freelistChecksum(ids) {
+		return nil, ErrChecksum
+	}
+	return slices.Clone(ids), nil
+}
+
+// freelistChecksum returns the fnv-1a checksum of the ids on a freelist page.
+func freelistChecksum(ids []pageID) uint64 {
+	h := fnv.New64a()
+	n := uint64(len(ids))
+	_, _ = h.Write((*[8]byte)(unsafe.Pointer(&n))[:])
+	if len(ids) > 0 {
+		_, _ = h.Write(unsafe.Slice((*byte)(unsafe.Pointer(&ids[0])), len(ids)*int(unsafe.Sizeof(pageID(0)))))
+	}
+	return h.Sum64()
+}
+
+// write writes the page ids onto a freelist page.
+// Pending ids are included since no transaction uses them once the database is reopened.
+// The page, including its overflow, must be at least size() bytes.
+func (f *freelist) write(p *page) {
+	p.flags |= freelistPageFlag
+
+	// The checksum goes in the first slot. The count is stored in the
+	// second slot when it doesn't fit in the header.
+	ids := f.all()
+	slots := (*[maxAllocSize / 8]pageID)(unsafe.Pointer(&p.ptr))
+	slots[0] = pageID(freelistChecksum(ids))
+	if len(ids) < 0xFFFF {
+		p.count = uint16(len(ids))
+		copy(slots[1:], ids)
+	} else {
+		p.count = 0xFFFF
+		slots[1] = pageID(len(ids))
+		copy(slots[2:], ids)
+	}
 }
 
 type reverseSortedPageIDs []pageID
@@ -1,7 +1,9 @@
 package toyboltdb
 
 import (
+	"math/rand"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -22,7 +24,8 @@ func TestFreelistFreeOverflow(t *testing.T) {
 
 // Ensure that a freelist can find contiguous blocks of pages.
 func TestFreelistAllocate(t *testing.T) {
-	f := &freelist{pageIDs: []pageID{18, 13, 12, 9, 7, 6, 5, 4, 3}}
+	f := &freelist{}
+	f.readIDs([]pageID{18, 13, 12, 9, 7, 6, 5, 4, 3})
 	assert.Equal(t, f.allocate(2), pageID(12)) // 13,12
 	assert.Equal(t, f.allocate(1), pageID(18)) // 18
 	assert.Equal(t, f.allocate(3), pageID(5))  // 7,6,5
@@ -30,5 +33,259 @@ func TestFreelistAllocate(t *testing.T) {
 	assert.Equal(t, f.allocate(2), pageID(3)) // 4,3
 	assert.Equal(t, f.allocate(1), pageID(9)) // 9
 	assert.Equal(t, f.allocate(0), pageID(0))
-	assert.Equal(t, f.pageIDs, []pageID{})
+	assert.Equal(t, f.ids(), []pageID{})
+}
+
+// Ensure that released pages join the free runs next to them.
+func TestFreelistReleaseJoinsRuns(t *testing.T) {
+	f := &freelist{pendingPageIDMap: make(map[txID][]pageID)}
+	f.readIDs([]pageID{9, 8, 4, 3})
+	f.free(100, &page{id: 5, overflow: 2})
+	f.free(101, &page{id: 20})
+	f.release(100)
+	assert.Equal(t, f.runStarts, map[pageID]int{3: 7})
+	assert.Equal(t, f.runEnds, map[pageID]int{9: 7})
+	assert.Equal(t, f.allocate(7), pageID(3))
+	assert.Equal(t, f.allocate(1), pageID(0))
+	assert.Equal(t, f.pendingPageIDMap[101], []pageID{20})
+}
+
+// Ensure that a freelist can allocate the lowest contiguous block of pages.
+func TestFreelistAllocateLow(t *testing.T) {
+	f := &freelist{}
+	f.readIDs([]pageID{18, 13, 12, 9, 7, 6, 5, 3})
+	assert.Equal(t, f.allocateLow(2), pageID(5)) // 5,6
+	assert.Equal(t, f.allocateLow(1), pageID(3))
+	assert.Equal(t, f.allocateLow(3), pageID(0))
+	assert.Equal(t, f.allocateLow(2), pageID(12)) // 12,13
+	assert.Equal(t, f.allocateLow(0), pageID(0))
+	assert.Equal(t, f.ids(), []pageID{18, 9, 7})
+}
+
+// Ensure that a range of page ids can be taken out of a freelist.
+func TestFreelistRemove(t *testing.T) {
+	f := &freelist{}
+	f.readIDs([]pageID{18, 13, 12, 9, 7, 6, 5})
+	f.remove(6, 2)
+	assert.Equal(t, f.ids(), []pageID{18, 13, 12, 9, 5})
+	assert.Equal(t, f.runStarts, map[pageID]int{5: 1, 9: 1, 12: 2, 18: 1})
+	f.remove(12, 1)
+	assert.Equal(t, f.ids(), []pageID{18, 13, 9, 5})
+	f.remove(100, 10)
+	assert.Equal(t, f.ids(), []pageID{18, 13, 9, 5})
+
+	// A range spanning several runs splits the ones at its ends.
+	f.readIDs([]pageID{2, 3, 4, 5, 7, 8, 10, 11, 12})
+	f.remove(4, 7)
+	assert.Equal(t, f.ids(), []pageID{12, 11, 3, 2})
+	assert.Equal(t, f.runStarts, map[pageID]int{2: 2, 11: 2})
+	assert.Equal(t, f.runEnds, map[pageID]int{3: 2, 12: 2})
+}
+
+// Ensure that allocations match a scan of every run as pages are allocated and freed.
+func TestFreelistAllocateMatchesScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var ids []pageID
+	for i := 2; i < 2000; i++ {
+		if r.Intn(3) != 0 {
+			ids = append(ids, pageID(i))
+		}
+	}
+	f := &freelist{pendingPageIDMap: make(map[txID][]pageID)}
+	f.readIDs(ids)
+
+	// scan returns the first id of the highest or lowest run of n pages.
+	scan := func(n int, low bool) (pageID, int) {
+		var start pageID
+		var size int
+		for s, l := range f.runStarts {
+			if l >= n && (size == 0 || (s > start) != low) {
+				start, size = s, l
+			}
+		}
+		return start, size
+	}
+	for i := 0; i < 2000; i++ {
+		n := r.Intn(6) + 1
+		var id pageID
+		if start, size := scan(n, i%2 == 0); i%2 == 0 {
+			id = f.allocateLow(n)
+			assert.Equal(t, id, start)
+		} else {
+			id = f.allocate(n)
+			if size > 0 {
+				assert.Equal(t, id, start+pageID(size-n))
+			} else {
+				assert.Equal(t, id, pageID(0))
+			}
+		}
+		if id != 0 && r.Intn(2) == 0 {
+			f.free(txID(i), &page{id: id, overflow: uint32(n - 1)})
+			f.release(txID(i))
+		}
+		assert.Equal(t, f.freeCount(), len(f.ids()))
+	}
+}
+
+// Ensure that compacting a freelist sorts it and gives back the pages at the high-water mark.
+func TestFreelistCompact(t *testing.T) {
+	f := &freelist{}
+	f.readIDs([]pageID{5, 19, 18, 9, 18, 17, 12})
+	assert.Equal(t, f.compact(20), pageID(17))
+	assert.Equal(t, f.ids(), []pageID{12, 9, 5})
+	assert.Equal(t, f.compact(17), pageID(17))
+	assert.Equal(t, f.ids(), []pageID{12, 9, 5})
+
+	f = &freelist{}
+	f.readIDs([]pageID{3, 2})
+	assert.Equal(t, f.compact(4), pageID(2))
+	assert.Equal(t, f.ids(), []pageID{})
+}
+
+// Ensure that a freelist can deserialize from a freelist page.
+func TestFreelistRead(t *testing.T) {
+	// Create a page.
+	var buf [4096]byte
+	page := (*page)(unsafe.Pointer(&buf[0]))
+	page.flags = freelistPageFlag
+	page.count = 2
+
+	// Insert 2 page ids after their checksum.
+	ids := (*[3]pageID)(unsafe.Pointer(&page.ptr))
+	ids[1] = 23
+	ids[2] = 50
+	ids[0] = pageID(freelistChecksum(ids[1:]))
+
+	// Deserialize page into a freelist.
+	f := &freelist{pendingPageIDMap: make(map[txID][]pageID)}
+	assert.NoError(t, f.read(page, 4096))
+
+	// Ensure that there are two page ids in the freelist.
+	assert.Equal(t, f.ids(), []pageID{50, 23})
+
+	// A changed id no longer matches the checksum.
+	ids[2] = 51
+	assert.Equal(t, f.read(page, 4096), ErrChecksum)
+}
+
+// Ensure that a freelist can serialize into a freelist page.
+func TestFreelistWrite(t *testing.T) {
+	// Create a freelist and write it to a page.
+	var buf [4096]byte
+	f := &freelist{pendingPageIDMap: make(map[txID][]pageID)}
+	f.readIDs([]pageID{39, 12})
+	f.pendingPageIDMap[100] = []pageID{28, 11}
+	f.pendingPageIDMap[101] = []pageID{3}
+	assert.Equal(t, f.size(), pageHeaderSize+8*6)
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	f.write(p)
+	assert.Equal(t, p.flags&freelistPageFlag, uint16(freelistPageFlag))
+	assert.Equal(t, p.count, uint16(5))
+
+	// Read the page back out. Pending ids are read back as free.
+	f2 := &freelist{pendingPageIDMap: make(map[txID][]pageID)}
+	assert.NoError(t, f2.read(p, 4096))
+	assert.Equal(t, f2.ids(), []pageID{39, 28, 12, 11, 3})
+}
+
+// Ensure that a freelist with more ids than fit in the page count round-trips intact.
+func TestFreelistWriteCountOverflow(t *testing.T) {
+	f := &freelist{pendingPageIDMap: make(map[txID][]pageID)}
+	var ids []pageID
+	for i := 100001; i > 1; i-- {
+		ids = append(ids, pageID(i))
+	}
+	f.readIDs(ids)
+	assert.Equal(t, f.size(), pageHeaderSize+8*100002)
+
+	// Write to a buffer spanning enough pages.
+	buf := make([]byte, (f.size()/4096+1)*4096)
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	p.overflow = uint32(len(buf)/4096 - 1)
+	f.write(p)
+	assert.Equal(t, p.count, uint16(0xFFFF))
+
+	f2 := &freelist{pendingPageIDMap: make(map[txID][]pageID)}
+	assert.NoError(t, f2.read(p, 4096))
+	assert.Equal(t, f2.freeCount(), 100000)
+	assert.Equal(t, f2.ids(), ids)
+}
+
+// Ensure that the serialized size accounts for the checksum and count slots.
+func TestFreelistSize(t *testing.T) {
+	f := &freelist{}
+	f.addRun(2, 0xFFFE)
+	assert.Equal(t, f.size(), pageHeaderSize+8*(1+0xFFFE))
+	f.addRun(0x10001, 1)
+	assert.Equal(t, f.size(), pageHeaderSize+8*(2+0xFFFF))
+}
+
+// Ensure that reading a freelist page with an implausible count returns an error.
+func TestFreelistReadInvalidCount(t *testing.T) {
+	var buf [8192]byte
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	p.flags = freelistPageFlag
+	f := &freelist{pendingPageIDMap: make(map[txID][]pageID)}
+
+	// The count in the header doesn't fit.
+	p.count = 600
+	assert.Equal(t, f.read(p, 4096), ErrInvalid)
+
+	// The count in the second slot doesn't fit.
+	p.count = 0xFFFF
+	slots := (*[1002]pageID)(unsafe.Pointer(&p.ptr))
+	slots[1] = 1000
+	slots[0] = pageID(freelistChecksum(slots[2:]))
+	assert.Equal(t, f.read(p, 4096), ErrInvalid)
+
+	// The count fits once the page has enough overflow.
+	p.overflow = 1
+	ids, err := readFreelistPage(p, 4096)
+	assert.NoError(t, err)
+	assert.Equal(t, len(ids), 1000)
+}
+
+// Benchmark allocating single pages from a freelist with many runs.
+func BenchmarkFreelistAllocate(b *testing.B) {
+	// Free every page except every 100th so there are many runs.
+	var ids []pageID
+	for i := 2; i < 1000000; i++ {
+		if i%100 != 0 {
+			ids = append(ids, pageID(i))
+		}
+	}
+	f := &freelist{}
+	f.readIDs(ids)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if f.allocate(1) == 0 {
+			b.StopTimer()
+			f.readIDs(ids)
+			b.StartTimer()
+		}
+	}
+}
+
+// Benchmark freeing and releasing single pages into a freelist with many runs.
+func BenchmarkFreelistRelease(b *testing.B) {
+	var ids []pageID
+	for i := 2; i < 1000000; i++ {
+		if i%100 != 0 {
+			ids = append(ids, pageID(i))
+		}
+	}
+	f := &freelist{pendingPageIDMap: make(map[txID][]pageID)}
+	f.readIDs(ids)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := f.allocate(1)
+		if id == 0 {
+			b.StopTimer()
+			f.readIDs(ids)
+			b.StartTimer()
+			continue
+		}
+		f.free(txID(i), &page{id: id})
+		f.release(txID(i))
+	}
 }
@@ -1,8 +1,13 @@
 package toyboltdb
 
+import (
+	"hash/fnv"
+	"unsafe"
+)
+
 const (
 	magic   = uint32(0xED0CDAED) // QQQ: deadcode?
-	version = 1
+	version = 5
 )
 
 type meta struct {
@@ -14,18 +19,33 @@ type meta struct {
 	freelistPageID pageID
 	pageID         pageID
 	txID           txID
+	comparator     uint32 // identity of the key comparator, 0 for byte order
+	checksum       uint64 // fnv-1a of the fields above
 }
 
 // validate checks the marker bytes and version of the meta page to ensure it matches this binary.
+// It also checks the checksum to catch a torn or corrupted write, and the page
+// size since every page offset is computed from it.
 func (m *meta) validate() error {
 	if m.magic != magic {
 		return ErrInvalid
 	} else if m.version != version {
 		return ErrVersionMismatch
+	} else if m.checksum != m.sum64() {
+		return ErrChecksum
+	} else if !validPageSize(int(m.pageSize)) {
+		return ErrInvalidPageSize
 	}
 	return nil
 }
 
+// sum64 generates the checksum of the meta.
+func (m *meta) sum64() uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write((*[unsafe.Offsetof(meta{}.checksum)]byte)(unsafe.Pointer(m))[:])
+	return h.Sum64()
+}
+
 // copy copies one meta object to another.
 func (m *meta) copy(dest *meta) {
 	dest.magic = m.magic
@@ -35,6 +55,8 @@ func (m *meta) copy(dest *meta) {
 	dest.freelistPageID = m.freelistPageID
 	dest.pageID = m.pageID
 	dest.txID = m.txID
+	dest.comparator = m.comparator
+	dest.checksum = m.checksum
 
 	// NOTE: This is NG
 	// dest = &meta{
@@ -55,5 +77,6 @@ func (m *meta) write(p *page) {
 	p.id = pageID(m.txID % 2)
 	p.flags |= metaPageFlag
 
+	m.checksum = m.sum64()
 	m.copy(p.meta())
 }
@@ -17,6 +17,7 @@ type node struct {
 	transaction *RWTransaction
 	isLeaf      bool
 	unbalanced  bool
+	dirty       bool // changed since it was read from its page
 	key         []byte
 	depth       int
 	pageID      pageID
@@ -43,6 +44,16 @@ func (n *node) size() int {
 	return size
 }
 
+// checkSize returns ErrNodeTooLarge if the node can't be written to a page,
+// because it is larger than maxAllocSize or has more elements than a page
+// can count.
+func (n *node) checkSize() error {
+	if n.size() > maxAllocSize || len(n.children) > maxNodesPerPage {
+		return ErrNodeTooLarge
+	}
+	return nil
+}
+
 // pageElementSize returns the size of each page element based on the type of node.
 func (n *node) pageElementSize() int {
 	if n.isLeaf {
@@ -64,15 +75,31 @@ func (n *node) childAt(index int) *node {
 	if n.isLeaf {
 		panic(fmt.Sprintf("assertion failed: invalid childAt(%d) on a leaf node", index))
 	}
-	return n.transaction.node(n.children[index].pageID, n)
+	child := n.transaction.node(n.children[index].pageID, n)
+
+	// An empty child has no first key so it takes the key it is stored
+	// under in its parent. Otherwise it couldn't be found when spilling.
+	if child.key == nil {
+		child.key = n.children[index].key
+	}
+	return child
 }
 
 // childIndex returns the index of a given child node.
 func (n *node) childIndex(child *node) int {
-	index := sort.Search(len(n.children), func(i int) bool { return bytes.Compare(n.children[i].key, child.key) != -1 })
+	index := sort.Search(len(n.children), func(i int) bool { return n.compare(n.children[i].key, child.key) >= 0 })
 	return index
 }
 
+// compare orders two keys using the database's comparator.
+// Nodes that aren't attached to a transaction use byte order.
+func (n *node) compare(a, b []byte) int {
+	if n.transaction == nil {
+		return bytes.Compare(a, b)
+	}
+	return n.transaction.db.compare(a, b)
+}
+
 // numChildren returns the number of children.
 func (n *node) numChildren() int {
 	return len(n.children)
@@ -103,30 +130,33 @@ func (n *node) prevSibling() *node {
 }
 
 // put inserts a key/value.
-func (n *node) put(oldKey, newKey, value []byte, pageID pageID) {
+// The flags are only kept for leaf elements.
+func (n *node) put(oldKey, newKey, value []byte, pageID pageID, flags uint32) {
 	// Find insertion index.
-	index := sort.Search(len(n.children), func(i int) bool { return bytes.Compare(n.children[i].key, oldKey) != -1 })
+	index := sort.Search(len(n.children), func(i int) bool { return n.compare(n.children[i].key, oldKey) >= 0 })
 
 	// Add capacity and shift nodes if we don't have an exact match and need to insert.
-	exact := (len(n.children) > 0 && index < len(n.children) && bytes.Equal(n.children[index].key, oldKey))
+	exact := (len(n.children) > 0 && index < len(n.children) && n.compare(n.children[index].key, oldKey) == 0)
 	if !exact {
 		n.children = append(n.children, inode{})
 		copy(n.children[index+1:], n.children[index:])
 	}
 
 	inode := &n.children[index]
+	inode.flags = flags
 	inode.key = newKey
 	inode.value = value
 	inode.pageID = pageID
+	n.dirty = true
 }
 
 // del removes a key from the node.
 func (n *node) del(key []byte) {
 	// Find index of key.
-	index := sort.Search(len(n.children), func(i int) bool { return bytes.Compare(n.children[i].key, key) != -1 })
+	index := sort.Search(len(n.children), func(i int) bool { return n.compare(n.children[i].key, key) >= 0 })
 
 	// Exit if the key isn't found.
-	if index >= len(n.children) || !bytes.Equal(n.children[index].key, key) {
+	if index >= len(n.children) || n.compare(n.children[index].key, key) != 0 {
 		return
 	}
 
@@ -135,6 +165,7 @@ func (n *node) del(key []byte) {
 
 	// Mark the node as needing rebalancing.
 	n.unbalanced = true
+	n.dirty = true
 }
 
 // read initializes the node from a page.
@@ -147,6 +178,7 @@ func (n *node) read(p *page) {
 		inode := &n.children[i]
 		if n.isLeaf {
 			elem := p.leafPageElement(uint16(i))
+			inode.flags = elem.flags
 			inode.key = elem.key()
 			inode.value = elem.value()
 		} else {
@@ -165,6 +197,9 @@ func (n *node) read(p *page) {
 }
 
 // write writes the items onto one or more pages.
+// The page must be followed by enough overflow pages to hold the node and
+// its overflow count must already be set, as allocate() does. write leaves
+// the overflow count as is so readers know the full extent of the page.
 func (n *node) write(p *page) {
 	// Initialize page.
 	if n.isLeaf {
@@ -180,6 +215,7 @@ func (n *node) write(p *page) {
 		// Write the page element.
 		if n.isLeaf {
 			elem := p.leafPageElement(uint16(i))
+			elem.flags = item.flags
 			elem.pos = uint32(uintptr(unsafe.Pointer(&b[0])) - uintptr(unsafe.Pointer(elem)))
 			elem.ksize = uint32(len(item.key))
 			elem.vsize = uint32(len(item.value))
@@ -211,15 +247,18 @@ func (n *node) rebalance() {
 	if n.size() > threshold && len(n.children) > n.minKeys() {
 		return
 	}
+	n.transaction.stats.Rebalance++
 
 	// Root node has special handling.
 	if n.parent == nil {
 		// If root node is a branch and only has one node then collapse it.
 		if !n.isLeaf && len(n.children) == 1 {
 			// Move child's children up.
-			child := n.transaction.nodes[n.children[0].pageID]
+			// The child may not have been read into a node yet.
+			child := n.childAt(0)
 			n.isLeaf = child.isLeaf
 			n.children = child.children[:]
+			n.dirty = true
 
 			// Reparent all child nodes being moved.
 			for _, inode := range n.children {
@@ -230,13 +269,30 @@ func (n *node) rebalance() {
 
 			// Remove old child.
 			child.parent = nil
-			delete(n.transaction.nodes, child.pageID)
+			n.transaction.free(child)
 		}
 		return
 	}
 
+	// If this is the only child then rebalance the parent first. The parent
+	// either collapses into the root or takes children from a sibling.
 	if n.parent.numChildren() < 2 {
-		panic("assertion failed: parent must have at least 2 children")
+		n.parent.unbalanced = true
+		n.parent.rebalance()
+		if n.transaction.nodes[n.pageID] != n || n.parent == nil {
+			return
+		}
+		if n.parent.numChildren() < 2 {
+			panic("assertion failed: parent must have at least 2 children")
+		}
+	}
+
+	// If node has no keys then just remove it.
+	if n.numChildren() == 0 {
+		n.parent.del(n.key)
+		n.transaction.free(n)
+		n.parent.rebalance()
+		return
 	}
 
 	// Destination node is right sibling if idx == 0, otherwise left sibling.
@@ -248,6 +304,9 @@ func (n *node) rebalance() {
 		target = n.prevSibling()
 	}
 
+	// Either way both nodes change.
+	n.dirty, target.dirty = true, true
+
 	// If target node has extra nodes then just move one over.
 	if target.numChildren() > target.minKeys() {
 		if useNextSibling {
@@ -259,7 +318,7 @@ func (n *node) rebalance() {
 			target.children = target.children[1:]
 
 			// Update target key on parent.
-			target.parent.put(target.key, target.children[0].key, nil, target.pageID)
+			target.parent.put(target.key, target.children[0].key, nil, target.pageID, 0)
 			target.key = target.children[0].key
 		} else {
 			// Reparent and move node.
@@ -273,7 +332,7 @@ func (n *node) rebalance() {
 		}
 
 		// Update parent key for node.
-		n.parent.put(n.key, n.children[0].key, nil, n.pageID)
+		n.parent.put(n.key, n.children[0].key, nil, n.pageID, 0)
 		n.key = n.children[0].key
 
 		return
@@ -291,7 +350,7 @@ func (n *node) rebalance() {
 		// Copy over inodes from target and remove target.
 		n.children = append(n.children, target.children...)
 		n.parent.del(target.key)
-		delete(n.transaction.nodes, target.pageID)
+		n.transaction.free(target)
 	} else {
 		// Reparent all child nodes being moved.
 		for _, inode := range n.children {
@@ -301,10 +360,14 @@ func (n *node) rebalance() {
 		}
 
 		// Copy over inodes to target and remove node.
+		// Both nodes may have been emptied in which case the target keeps its key.
 		target.children = append(target.children, n.children...)
 		n.parent.del(n.key)
-		n.parent.put(target.key, target.children[0].key, nil, target.pageID)
-		delete(n.transaction.nodes, n.pageID)
+		if len(target.children) > 0 {
+			n.parent.put(target.key, target.children[0].key, nil, target.pageID, 0)
+			target.key = target.children[0].key
+		}
+		n.transaction.free(n)
 	}
 
 	// Either this node or the target node was deleted from the parent so rebalance it.
@@ -312,15 +375,24 @@ func (n *node) rebalance() {
 }
 
 // split divides up the node into appropriately sized nodes.
-func (n *node) split(pageSize int) []*node {
+// Each page is filled up to fillPercent of the page size but always holds at
+// least minKeysPerPage elements, so an oversized element goes onto overflow pages.
+func (n *node) split(pageSize int, fillPercent float64) []*node {
 	// Ignore the split if the page doesn't have at least enough nodes for
 	// multiple pages or if the data can fit on a single page.
 	if len(n.children) <= (minKeysPerPage*2) || n.size() < pageSize {
 		return []*node{n}
 	}
 
-	// Set fill threshold to 50%.
-	threshold := pageSize / 2
+	// Set fill threshold, keeping it within bounds.
+	if fillPercent == 0 {
+		fillPercent = DefaultFillPercent
+	} else if fillPercent < minFillPercent {
+		fillPercent = minFillPercent
+	} else if fillPercent > maxFillPercent {
+		fillPercent = maxFillPercent
+	}
+	threshold := int(float64(pageSize) * fillPercent)
 
 	// Group into smaller pages and target a given fill size.
 	size := pageHeaderSize
@@ -378,6 +450,7 @@ func (s nodesByDepth) Less(i, j int) bool { return s[i].depth > s[j].depth }
 // It can be used to point to elements in a page or
 // point to an element which hasn't been added to a page yet.
 type inode struct {
+	flags  uint32 // leaf element flags
 	pageID pageID
 	key    []byte
 	value  []byte
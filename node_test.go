@@ -1,6 +1,8 @@
 package toyboltdb
 
 import (
+	"bytes"
+	"fmt"
 	"testing"
 	"unsafe"
 
@@ -10,10 +12,10 @@ import (
 // Ensure that a node can insert a key/value.
 func TestNodePut(t *testing.T) {
 	n := &node{children: make(inodes, 0)}
-	n.put([]byte("baz"), []byte("baz"), []byte("2"), 0)
-	n.put([]byte("foo"), []byte("foo"), []byte("0"), 0)
-	n.put([]byte("bar"), []byte("bar"), []byte("1"), 0)
-	n.put([]byte("foo"), []byte("foo"), []byte("3"), 0)
+	n.put([]byte("baz"), []byte("baz"), []byte("2"), 0, 0)
+	n.put([]byte("foo"), []byte("foo"), []byte("0"), 0, 0)
+	n.put([]byte("bar"), []byte("bar"), []byte("1"), 0, 0)
+	n.put([]byte("foo"), []byte("foo"), []byte("3"), 0, 0)
 	assert.Equal(t, len(n.children), 3)
 	assert.Equal(t, n.children[0].key, []byte("bar"))
 	assert.Equal(t, n.children[0].value, []byte("1"))
@@ -58,9 +60,9 @@ func TestNodeReadLeafPage(t *testing.T) {
 func TestNodeWriteLeafPage(t *testing.T) {
 	// Create a node.
 	n := &node{isLeaf: true, children: make(inodes, 0)}
-	n.put([]byte("susy"), []byte("susy"), []byte("que"), 0)
-	n.put([]byte("ricki"), []byte("ricki"), []byte("lake"), 0)
-	n.put([]byte("john"), []byte("john"), []byte("johnson"), 0)
+	n.put([]byte("susy"), []byte("susy"), []byte("que"), 0, 0)
+	n.put([]byte("ricki"), []byte("ricki"), []byte("lake"), 0, 0x10000)
+	n.put([]byte("john"), []byte("john"), []byte("johnson"), 0, 0)
 
 	// Write it to a page.
 	var buf [4096]byte
@@ -77,6 +79,137 @@ func TestNodeWriteLeafPage(t *testing.T) {
 	assert.Equal(t, n2.children[0].value, []byte("johnson"))
 	assert.Equal(t, n2.children[1].key, []byte("ricki"))
 	assert.Equal(t, n2.children[1].value, []byte("lake"))
+	assert.Equal(t, n2.children[1].flags, uint32(0x10000))
 	assert.Equal(t, n2.children[2].key, []byte("susy"))
 	assert.Equal(t, n2.children[2].value, []byte("que"))
 }
+
+// Ensure that a node larger than a page is written across its overflow pages.
+func TestNodeWriteOverflowPage(t *testing.T) {
+	// Create a node that needs three pages.
+	n := &node{isLeaf: true, children: make(inodes, 0)}
+	n.put([]byte("bar"), []byte("bar"), bytes.Repeat([]byte("x"), 5000), 0, 0)
+	n.put([]byte("foo"), []byte("foo"), bytes.Repeat([]byte("y"), 5000), 0, 0)
+	count := (n.size() / 4096) + 1
+	assert.Equal(t, count, 3)
+
+	// Write it to a page with overflow, as allocate() would.
+	buf := make([]byte, count*4096)
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	p.overflow = uint32(count - 1)
+	n.write(p)
+	assert.Equal(t, p.overflow, uint32(2))
+
+	// Read the page back in.
+	n2 := &node{}
+	n2.read(p)
+	assert.Equal(t, len(n2.children), 2)
+	assert.Equal(t, n2.children[0].value, bytes.Repeat([]byte("x"), 5000))
+	assert.Equal(t, n2.children[1].value, bytes.Repeat([]byte("y"), 5000))
+}
+
+// Ensure that a node splits into pages filled to the given percentage.
+func TestNodeSplitFillPercent(t *testing.T) {
+	// Create a leaf node of 1000 elements of 24 bytes each.
+	newNode := func() *node {
+		n := &node{isLeaf: true, children: make(inodes, 0)}
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("%04d", i))
+			n.put(k, k, []byte("0000"), 0, 0)
+		}
+		return n
+	}
+
+	// The default packs pages about half full.
+	nodes := newNode().split(4096, 0)
+	assert.Equal(t, len(nodes), 12)
+	for _, n := range nodes[:len(nodes)-1] {
+		assert.True(t, n.size() <= 2048)
+	}
+
+	// A higher fill packs pages tighter.
+	nodes = newNode().split(4096, 0.9)
+	assert.Equal(t, len(nodes), 7)
+	for _, n := range nodes[:len(nodes)-1] {
+		assert.True(t, n.size() > 2048 && n.size() <= 3686)
+	}
+
+	// Out of range values are clamped.
+	assert.Equal(t, len(newNode().split(4096, 2)), len(newNode().split(4096, 1)))
+	assert.Equal(t, len(newNode().split(4096, 0.01)), len(newNode().split(4096, 0.1)))
+}
+
+// Ensure that a split always keeps the minimum number of keys on each page.
+func TestNodeSplitOversizedElement(t *testing.T) {
+	n := &node{isLeaf: true, children: make(inodes, 0)}
+	n.put([]byte("0"), []byte("0"), make([]byte, 10000), 0, 0)
+	for i := 1; i < 10; i++ {
+		k := []byte(fmt.Sprintf("%d", i))
+		n.put(k, k, make([]byte, 100), 0, 0)
+	}
+
+	nodes := n.split(4096, 0.1)
+	assert.True(t, len(nodes) > 1)
+	assert.Equal(t, nodes[0].children[0].key, []byte("0"))
+	for _, n := range nodes {
+		assert.True(t, len(n.children) >= minKeysPerPage)
+	}
+}
+
+// Ensure that a branch root left with a single child collapses into that child.
+func TestNodeRebalanceCollapseRoot(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		key := func(i int) []byte { return []byte(fmt.Sprintf("%0500d", i)) }
+		height := func() int {
+			var h int
+			_ = db.View(func(txn *Transaction) error {
+				txn.forEachPage(txn.Bucket("widgets").rootPageID, 1, func(p *page, depth int) {
+					h = max(h, depth)
+				})
+				return nil
+			})
+			return h
+		}
+
+		// Large keys keep the fanout low so the tree gets deep quickly.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 200; i++ {
+				if err := txn.Put("widgets", key(i), []byte("bar")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		before := height()
+		assert.True(t, before >= 3)
+
+		// Delete everything except the last few keys so that only one child of the root remains.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 195; i++ {
+				if err := txn.Delete("widgets", key(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		assert.True(t, height() < before)
+
+		_ = db.View(func(txn *Transaction) error {
+			for i := 195; i < 200; i++ {
+				value, _ := txn.Get("widgets", key(i))
+				assert.Equal(t, value, []byte("bar"))
+			}
+			var n int
+			txn.ForEach("widgets", func(k, v []byte) error {
+				n++
+				return nil
+			})
+			assert.Equal(t, n, 5)
+			return nil
+		})
+		count, err := db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, count, 0)
+	})
+}
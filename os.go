@@ -4,13 +4,16 @@ import "os"
 
 type _os interface {
 	OpenFile(name string, flag int, perm os.FileMode) (file file, err error)
+	Stat(name string) (fi os.FileInfo, err error)
 	Getpagesize() int
 }
 
 type file interface {
+	Close() error
 	Fd() uintptr
 	ReadAt(b []byte, off int64) (n int, err error)
 	Stat() (fi os.FileInfo, err error)
+	Sync() error
 	WriteAt(b []byte, off int64) (n int, err error)
 }
 
@@ -20,6 +23,10 @@ func (o *sysos) OpenFile(name string, flag int, perm os.FileMode) (file file, er
 	return os.OpenFile(name, flag, perm)
 }
 
+func (o *sysos) Stat(name string) (fi os.FileInfo, err error) {
+	return os.Stat(name)
+}
+
 func (o *sysos) Getpagesize() int {
 	return os.Getpagesize()
 }
@@ -32,6 +32,11 @@ type mockfile struct {
 	fd uintptr
 }
 
+func (m *mockfile) Close() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
 func (m *mockfile) Fd() uintptr {
 	return m.fd
 }
@@ -46,6 +51,11 @@ func (m *mockfile) Stat() (os.FileInfo, error) {
 	return args.Get(0).(os.FileInfo), args.Error(1)
 }
 
+func (m *mockfile) Sync() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
 func (m *mockfile) WriteAt(b []byte, off int64) (n int, err error) {
 	args := m.Called(b, off)
 	return args.Int(0), args.Error(1)
@@ -83,3 +93,55 @@ func (m *mockfileinfo) IsDir() bool {
 func (m *mockfileinfo) Sys() interface{} {
 	return m.sys
 }
+
+// recordingos is used for some tests.
+// It opens real files and records every write made through them, in order.
+// It also records how many writes had been made at each sync.
+// While writeErrs isn't empty, each write only writes the first half of its
+// buffer and returns the next error from it, or no error for a short write.
+type recordingos struct {
+	sysos
+	writes    []recordedWrite
+	syncs     []int
+	writeErrs []error
+}
+
+// recordedWrite is a single WriteAt() call captured by recordingos.
+type recordedWrite struct {
+	b   []byte
+	off int64
+}
+
+func (o *recordingos) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	f, err := o.sysos.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingfile{file: f, os: o}, nil
+}
+
+type recordingfile struct {
+	file
+	os *recordingos
+}
+
+func (f *recordingfile) WriteAt(b []byte, off int64) (n int, err error) {
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	f.os.writes = append(f.os.writes, recordedWrite{b: buf, off: off})
+	if len(f.os.writeErrs) > 0 {
+		err := f.os.writeErrs[0]
+		f.os.writeErrs = f.os.writeErrs[1:]
+		n, werr := f.file.WriteAt(b[:len(b)/2], off)
+		if werr != nil {
+			return n, werr
+		}
+		return n, err
+	}
+	return f.file.WriteAt(b, off)
+}
+
+func (f *recordingfile) Sync() error {
+	f.os.syncs = append(f.os.syncs, len(f.os.writes))
+	return f.file.Sync()
+}
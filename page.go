@@ -34,6 +34,21 @@ const (
 	freelistPageFlag = 0x10 // 0b10000
 )
 
+// Flags on leaf page elements. The low 16 bits are reserved for values with
+// special meaning to the database. The high 16 bits are left to callers
+// through PutFlags().
+const (
+	bucketLeafFlag    = 0x01   // the value is a sub-bucket; not used yet
+	reservedLeafFlags = 0xFFFF // flags that callers can't set
+)
+
+// Bounds on the page size. A database only opens with a page size that is a
+// power of two in between.
+const (
+	minPageSize = 0x400   // 1KiB
+	maxPageSize = 0x10000 // 64KiB
+)
+
 const (
 	maxNodesPerPage = 65535     // 16bit
 	maxAllocSize    = 0xFFFFFFF // 28bit
@@ -42,6 +57,11 @@ const (
 
 type pageID uint64
 
+// validPageSize returns whether n can be used as the size of a page.
+func validPageSize(n int) bool {
+	return n >= minPageSize && n <= maxPageSize && n&(n-1) == 0
+}
+
 type page struct {
 	id       pageID
 	flags    uint16
@@ -50,10 +70,55 @@ type page struct {
 	ptr      uintptr
 }
 
-// pageElementRef represents a reference to an element on a given page.
+// pageElementRef represents a reference to an element on a given page or node.
+// Exactly one of page and node is set.
 type pageElementRef struct {
 	page  *page
-	index uint16
+	node  *node
+	index int
+}
+
+// pageID returns the id of the referenced page or node.
+func (r *pageElementRef) pageID() pageID {
+	if r.node != nil {
+		return r.node.pageID
+	}
+	return r.page.id
+}
+
+// isLeaf returns whether the ref is pointing at a leaf page or node.
+func (r *pageElementRef) isLeaf() bool {
+	if r.node != nil {
+		return r.node.isLeaf
+	}
+	return (r.page.flags & leafPageFlag) != 0
+}
+
+// count returns the number of elements on the referenced page or node.
+func (r *pageElementRef) count() int {
+	if r.node != nil {
+		return len(r.node.children)
+	}
+	return int(r.page.count)
+}
+
+// key returns the key of the element at a given index.
+func (r *pageElementRef) key(index int) []byte {
+	if r.node != nil {
+		return r.node.children[index].key
+	}
+	if r.isLeaf() {
+		return r.page.leafPageElement(uint16(index)).key()
+	}
+	return r.page.branchPageElement(uint16(index)).key()
+}
+
+// childPageID returns the page id of the child at a given index of a branch.
+func (r *pageElementRef) childPageID(index int) pageID {
+	if r.node != nil {
+		return r.node.children[index].pageID
+	}
+	return r.page.branchPageElement(uint16(index)).pageID
 }
 
 // typ returns a human readable page type string used for debugging.
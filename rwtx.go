@@ -10,7 +10,14 @@
 package toyboltdb
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
 	"sort"
+	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -20,6 +27,11 @@ const (
 	MaxBucketNameSize = 255        // 8bit
 )
 
+// maxWriteRunSize is the size, in bytes, past which a run of contiguous dirty
+// pages is written out and a new run is started. It bounds the buffer that a
+// run is gathered into.
+const maxWriteRunSize = 1 << 20
+
 // RWTransaction represents a transaction that can read and write data.
 // Only one read/write transaction can be active for a database at a time.
 // RWTransaction is composed of a read-only Transaction so it can also use
@@ -28,11 +40,48 @@ type RWTransaction struct {
 	Transaction
 	nodes   map[pageID]*node // cache
 	pending []*node
+	freed   []pageID // pages dropped from the tree, freed on commit
+	reused  []pageID // pages taken off the freelist, put back on rollback
+	stats   TxStats
+	compact bool // compact the freelist on commit
+}
+
+// TxStats represents statistics about the actions performed by a read/write transaction.
+// The stats remain readable after the transaction has been committed.
+type TxStats struct {
+	LogicalBytes int // key/value bytes changed by Put() and Delete()
+	WriteBytes   int // bytes written to disk during Commit()
+
+	PageCount int // number of pages allocated
+	PageAlloc int // bytes allocated for pages
+	NodeCount int // number of nodes read from pages
+	Rebalance int // number of nodes rebalanced
+	Split     int // number of extra nodes created by splitting
+	Spill     int // number of nodes spilled to dirty pages
+	Write     int // number of pages written to disk
+	WriteCall int // number of writes made for them, runs of pages are written at once
+	Retry     int // number of writes retried after a transient error or a short write
+
+	NodeCacheN int // number of nodes cached when the stats were read
+	Evict      int // number of clean nodes evicted from the cache
+}
+
+// WriteAmplification returns the ratio of bytes written to disk to the
+// logical key/value bytes changed. Returns 0 if nothing was changed.
+//
+// A high ratio means small changes are rewriting whole pages, e.g. values are
+// small relative to the page size or keys are too random.
+func (s *TxStats) WriteAmplification() float64 {
+	if s.LogicalBytes == 0 {
+		return 0
+	}
+	return float64(s.WriteBytes) / float64(s.LogicalBytes)
 }
 
 // init initializes the transaction.
-func (t *RWTransaction) init(db *DB) {
-	t.Transaction.init(db)
+func (t *RWTransaction) init(db *DB, m *meta) {
+	t.Transaction.init(db, m)
+	t.rwtransaction = t
 	t.pages = make(map[pageID]*page)
 
 	// Increment the transaction id.
@@ -41,29 +90,64 @@ func (t *RWTransaction) init(db *DB) {
 
 // Commit writes all changes to **disk** and updates the **meta page**.
 // Returns an error if a disk write error occurs.
-func (t *RWTransaction) Commit() error {
+func (t *RWTransaction) Commit() (err error) {
 	defer t.db.rwtxEnd()
 
-	// TODO(benbjohnson): Use vectorized I/O to write out dirty pages.
+	// A commit that fails before the meta page is written leaves no trace.
+	defer func() {
+		if err != nil {
+			t.rollback()
+		}
+	}()
 
 	// Rebalance and spill data onto dirty pages.
 	t.rebalance()
-	t.spill()
+	for _, id := range t.freed {
+		t.db.freelist.free(t.meta.txID, t.page(id))
+	}
+	if err := t.spill(); err != nil {
+		return err
+	}
 
-	// Spill buckets page.
+	// Free the old buckets page and spill a new one.
+	t.db.freelist.free(t.meta.txID, t.page(t.meta.bucketsPageID))
 	p, err := t.allocate((t.buckets.size() / t.db.pageSize) + 1)
 	if err != nil {
 		return err
 	}
 	t.buckets.write(p)
+	t.meta.bucketsPageID = p.id
+
+	// Free the old freelist page and write the freelist to a new one.
+	// The page is allocated before the list is written so that the list
+	// doesn't contain the page itself.
+	t.db.freelist.free(t.meta.txID, t.page(t.meta.freelistPageID))
+	p, err = t.allocate((t.db.freelist.size() / t.db.pageSize) + 1)
+	if err != nil {
+		return err
+	}
+	if t.compact {
+		// The pages given back are put back on the freelist if the commit fails.
+		highWater := t.db.freelist.compact(t.meta.pageID)
+		for id := highWater; id < t.meta.pageID; id++ {
+			t.reused = append(t.reused, id)
+		}
+		t.meta.pageID = highWater
+	}
+	t.db.freelist.write(p)
+	t.meta.freelistPageID = p.id
 
 	// Write dirty pages to disk.
 	if err := t.write(); err != nil {
 		return err
 	}
 
-	// Update the meta.
-	t.meta.bucketsPageID = p.id
+	// Make the pages durable before the meta page points at them.
+	if !t.db.NoSync {
+		if err := t.db.Sync(); err != nil {
+			return err
+		}
+	}
 
 	// Write meta to disk.
 	if err := t.writeMeta(); err != nil {
@@ -73,12 +157,39 @@ func (t *RWTransaction) Commit() error {
 	return nil
 }
 
+// Stats returns the statistics of the transaction.
+func (t *RWTransaction) Stats() TxStats {
+	stats := t.stats
+	stats.NodeCacheN = len(t.nodes)
+	return stats
+}
+
 // Rollback closes the transaction and ignores all previous updates.
+// The pages that it allocated are given back so it has no lasting effect.
+// The pages that it freed stay in use since the committed tree still holds
+// them. They are only queued until commit so they never become pending.
 func (t *RWTransaction) Rollback() {
+	t.rollback()
 	t.db.rwtxEnd()
 }
 
+// rollback undoes the transaction's changes to the shared freelist. Pages
+// that it took off the freelist are put back since nothing uses them, and
+// the pages that a failed commit freed are dropped since the committed tree
+// still uses them. The high-water mark needs no undoing since it is only
+// moved in the transaction's copy of the meta, and pages past it were only
+// allocated in memory. Those and the cached nodes are dropped so that a
+// transaction that is still referenced doesn't hold on to them.
+func (t *RWTransaction) rollback() {
+	delete(t.db.freelist.pendingPageIDMap, t.meta.txID)
+	t.db.freelist.add(t.reused)
+	t.reused = nil
+	t.nodes, t.pending, t.freed = nil, nil, nil
+	t.pages = nil
+}
+
 // CreateBucket creates a new bucket.
+// The name is stored as is so it can hold any bytes, not only UTF-8.
 // Returns an error if the bucket already exists, if the bucket name is blank, or if the bucket name is too long.
 func (t *RWTransaction) CreateBucket(name string) error {
 	// Check if bucket already exists.
@@ -98,7 +209,59 @@ func (t *RWTransaction) CreateBucket(name string) error {
 	p.flags = leafPageFlag
 
 	// Add bucket to buckets page.
-	t.buckets.put(name, &bucket{rootPageID: p.id})
+	t.buckets.put(name, &bucket{rootPageID: p.id, modifiedTxID: t.meta.txID})
+	return nil
+}
+
+// CreateBucketBytes creates a new bucket like CreateBucket with a binary name.
+func (t *RWTransaction) CreateBucketBytes(name []byte) error {
+	return t.CreateBucket(string(name))
+}
+
+// PreSplitBucket creates a new bucket whose tree is already split into one
+// empty leaf per split key, as a bulk load would eventually split it. Each
+// leaf holds the keys from its split key up to the next one. Keys before the
+// first split key also go to the first leaf. Loading keys spread across the
+// split keys then fills the leaves evenly instead of splitting one leaf over
+// and over.
+//
+// The split keys are copied and sorted. Empty leaves are removed once a
+// Delete() lands on them.
+// Returns an error if the bucket already exists, if the bucket name is blank
+// or too long, or if a split key is blank or too large.
+func (t *RWTransaction) PreSplitBucket(name string, splitKeys [][]byte) error {
+	// Validate, copy and sort the split keys, dropping duplicates.
+	keys := make([][]byte, 0, len(splitKeys))
+	for _, k := range splitKeys {
+		if err := t.db.ValidateEntry(k, nil); err != nil {
+			return err
+		}
+		keys = append(keys, bytes.Clone(k))
+	}
+	sort.Slice(keys, func(i, j int) bool { return t.db.compare(keys[i], keys[j]) < 0 })
+	keys = slices.CompactFunc(keys, func(a, b []byte) bool { return t.db.compare(a, b) == 0 })
+
+	if err := t.CreateBucket(name); err != nil {
+		return err
+	}
+
+	// A single leaf is what CreateBucket() makes already.
+	if len(keys) < 2 {
+		return nil
+	}
+
+	// Turn the root into a branch over a blank leaf page per split key.
+	root := t.node(t.Bucket(name).rootPageID, nil)
+	root.isLeaf = false
+	root.dirty = true
+	for _, k := range keys {
+		p, err := t.allocate(1)
+		if err != nil {
+			return err
+		}
+		p.flags = leafPageFlag
+		root.children = append(root.children, inode{key: k, pageID: p.id})
+	}
 	return nil
 }
 
@@ -127,6 +290,27 @@ func (t *RWTransaction) DeleteBucket(name string) error {
 	return nil
 }
 
+// DeleteBucketBytes deletes a bucket like DeleteBucket with a binary name.
+func (t *RWTransaction) DeleteBucketBytes(name []byte) error {
+	return t.DeleteBucket(string(name))
+}
+
+// SwapBuckets exchanges the contents of two buckets, including their sequences.
+// No data is copied and readers see either the old or the new contents once committed.
+// Returns an error if either bucket does not exist.
+func (t *RWTransaction) SwapBuckets(a, b string) error {
+	ba, bb := t.Bucket(a), t.Bucket(b)
+	if ba == nil || bb == nil {
+		return ErrBucketNotFound
+	}
+
+	ba.rootPageID, bb.rootPageID = bb.rootPageID, ba.rootPageID
+	ba.sequence, bb.sequence = bb.sequence, ba.sequence
+	ba.modifiedTxID = t.meta.txID
+	bb.modifiedTxID = t.meta.txID
+	return nil
+}
+
 // NextSequence returns an autoincrementing integer for the bucket.
 func (t *RWTransaction) NextSequence(name string) (int, error) {
 	// Check if bucket already exists.
@@ -134,39 +318,35 @@ func (t *RWTransaction) NextSequence(name string) (int, error) {
 	if b == nil {
 		return 0, ErrBucketNotFound
 	}
-
-	// Increment and return the sequence.
-	b.bucket.sequence++
-
-	return int(b.bucket.sequence), nil
+	seq, err := b.NextSequence()
+	return int(seq), err
 }
 
 // Put sets the value for a key inside of the named bucket.
 // If the key exist then its previous value will be overwritten.
+// The key and value are copied so the caller is free to reuse them after Put returns.
 // Returns an error if the bucket is not found, if the key is blank, if the key is too large, or if the value is too large.
 func (t *RWTransaction) Put(name string, key []byte, value []byte) error {
 	b := t.Bucket(name)
 	if b == nil {
 		return ErrBucketNotFound
 	}
+	return b.Put(key, value)
+}
 
-	// Validate the key and data size.
-	if len(key) == 0 {
-		return ErrKeyRequired
-	} else if len(key) > MaxKeySize {
-		return ErrKeyTooLarge
-	} else if len(value) > MaxValueSize {
-		return ErrValueTooLarge
+// PutReturning sets the value for a key inside of the named bucket like Put
+// and returns a copy of the value that it replaced.
+// Returns a nil value if the key did not exist.
+func (t *RWTransaction) PutReturning(name string, key []byte, value []byte) ([]byte, error) {
+	b := t.Bucket(name)
+	if b == nil {
+		return nil, ErrBucketNotFound
 	}
-
-	// Move cursor to correct position.
-	c := b.Cursor()
-	c.Get(key)
-
-	// Insert the key/value.
-	c.node(t).put(key, key, value, 0)
-
-	return nil
+	old, err := b.put(key, value, 0)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(old), nil
 }
 
 // Delete removes a key from the named bucket.
@@ -177,15 +357,16 @@ func (t *RWTransaction) Delete(name string, key []byte) error {
 	if b == nil {
 		return ErrBucketNotFound
 	}
+	return b.Delete(key)
+}
 
-	// Move cursor to correct position.
-	c := b.Cursor()
-	c.Get(key)
-
-	// Delete the node if we have a matching key.
-	c.node(t).del(key)
-
-	return nil
+// free removes a node from the transaction and queues its page to be
+// released to the freelist when the transaction commits.
+func (t *RWTransaction) free(n *node) {
+	delete(t.nodes, n.pageID)
+	if n.pageID > 0 {
+		t.freed = append(t.freed, n.pageID)
+	}
 }
 
 // allocate returns a contiguous block of memory starting at a given page.
@@ -197,6 +378,8 @@ func (t *RWTransaction) allocate(count int) (*page, error) {
 
 	// Save to our page cache.
 	t.pages[p.id] = p
+	t.stats.PageCount += count
+	t.stats.PageAlloc += count * t.db.pageSize
 
 	return p, nil
 }
@@ -215,10 +398,68 @@ func (t *RWTransaction) node(pageID pageID, parent *node) *node {
 	}
 	n.read(t.page(pageID))
 	t.nodes[pageID] = n
+	t.stats.NodeCount++
 
 	return n
 }
 
+// evict drops clean nodes from the cache once it holds more than
+// DB.NodeCacheLimit nodes. They are read from their pages again if needed.
+// A clean node is kept while any node under it is dirty since spilling the
+// dirty node updates it. It must only be called between operations so that
+// no cursor is part way through materializing nodes.
+func (t *RWTransaction) evict() {
+	if limit := t.db.NodeCacheLimit; limit <= 0 || len(t.nodes) <= limit {
+		return
+	}
+
+	// Keep every dirty node along with its ancestors.
+	keep := make(map[*node]bool)
+	for _, n := range t.nodes {
+		if !n.dirty {
+			continue
+		}
+		for p := n; p != nil && !keep[p]; p = p.parent {
+			keep[p] = true
+		}
+	}
+
+	for id, n := range t.nodes {
+		if !keep[n] {
+			delete(t.nodes, id)
+			t.stats.Evict++
+		}
+	}
+}
+
+// DumpNodes writes the transaction's cached node graph to w, one node per
+// line, ordered by depth and then page id. It is meant for attaching to bug
+// reports about rebalancing and spilling.
+func (t *RWTransaction) DumpNodes(w io.Writer) error {
+	nodes := make([]*node, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].depth != nodes[j].depth {
+			return nodes[i].depth < nodes[j].depth
+		}
+		return nodes[i].pageID < nodes[j].pageID
+	})
+
+	for _, n := range nodes {
+		var parent pageID
+		if n.parent != nil {
+			parent = n.parent.pageID
+		}
+		if _, err := fmt.Fprintf(w, "page=%d parent=%d leaf=%v depth=%d keys=%d unbalanced=%v\n",
+			n.pageID, parent, n.isLeaf, n.depth, len(n.children), n.unbalanced); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // rebalance attempts to balance all nodes.
 func (t *RWTransaction) rebalance() {
 	for _, n := range t.nodes {
@@ -254,8 +495,10 @@ func (t *RWTransaction) spill() error {
 
 		// Split nodes into appropriate sized nodes.
 		// The first node in this list will be a reference to n to preserve ancestry.
-		newNodes := n.split(t.db.pageSize)
+		newNodes := n.split(t.db.pageSize, t.db.FillPercent)
 		t.pending = newNodes
+		t.stats.Split += len(newNodes) - 1
+		t.stats.Spill++
 
 		// If this is a root node that split then create a parent node.
 		if n.parent == nil && len(newNodes) > 1 {
@@ -270,6 +513,12 @@ func (t *RWTransaction) spill() error {
 
 		// Write nodes to dirty pages.
 		for i, newNode := range newNodes {
+			// A node that can't be addressed within a page would be written
+			// out of bounds.
+			if err := newNode.checkSize(); err != nil {
+				return err
+			}
+
 			// Allocate contiguous space for the node.
 			p, err := t.allocate((newNode.size() / t.db.pageSize) + 1)
 			if err != nil {
@@ -289,9 +538,13 @@ func (t *RWTransaction) spill() error {
 				oldKey = newNode.children[0].key
 			}
 
-			// Update the parent entry.
+			// Update the parent entry. An empty node keeps its existing key.
 			if newNode.parent != nil {
-				newNode.parent.put(oldKey, newNode.children[0].key, nil, newNode.pageID)
+				newKey := oldKey
+				if len(newNode.children) > 0 {
+					newKey = newNode.children[0].key
+				}
+				newNode.parent.put(oldKey, newKey, nil, newNode.pageID, 0)
 			}
 		}
 
@@ -318,14 +571,59 @@ func (t *RWTransaction) write() error {
 	}
 	sort.Sort(pages)
 
-	// Write pages to disk in order.
-	for _, p := range pages {
-		size := (int(p.overflow) + 1) * t.db.pageSize
-		buf := (*[maxAllocSize]byte)(unsafe.Pointer(p))[:size]
-		offset := int64(p.id) * int64(t.db.pageSize)
-		if _, err := t.db.file.WriteAt(buf, offset); err != nil {
+	// Write pages to disk in order. Pages with contiguous ids are gathered
+	// into runs that are written with a single call.
+	var run [][]byte
+	var offset int64
+	var size int
+	var scratch []byte
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+
+		// A run of a single page is written straight from its buffer.
+		// Longer runs are gathered into a scratch buffer which is aligned
+		// for DirectIO like the page buffers are.
+		buf := run[0]
+		if len(run) > 1 {
+			if cap(scratch) < size {
+				if t.db.DirectIO {
+					scratch = alignedBuffer(size, t.db.pageSize)
+				} else {
+					scratch = make([]byte, size)
+				}
+			}
+			scratch = scratch[:0]
+			for _, b := range run {
+				scratch = append(scratch, b...)
+			}
+			buf = scratch
+		}
+		run = run[:0]
+		if err := t.writeAt(t.db.file, buf, offset); err != nil {
 			return err
 		}
+		t.stats.WriteCall++
+		return nil
+	}
+	for _, p := range pages {
+		off := int64(p.id) * int64(t.db.pageSize)
+		if len(run) == 0 || off != offset+int64(size) || size >= maxWriteRunSize {
+			if err := flush(); err != nil {
+				return err
+			}
+			offset, size = off, 0
+		}
+
+		buf := (*[maxAllocSize]byte)(unsafe.Pointer(p))[:(int(p.overflow)+1)*t.db.pageSize]
+		run = append(run, buf)
+		size += len(buf)
+		t.stats.WriteBytes += len(buf)
+		t.stats.Write++
+	}
+	if err := flush(); err != nil {
+		return err
 	}
 
 	// Clear out page cache.
@@ -334,6 +632,37 @@ func (t *RWTransaction) write() error {
 	return nil
 }
 
+// writeAt writes a buffer to a file at a given offset. A write that fails
+// with a transient error or is cut short is retried from where it stopped,
+// up to the DB's WriteRetries times with a doubling backoff.
+func (t *RWTransaction) writeAt(f file, b []byte, off int64) error {
+	backoff := t.db.WriteRetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultWriteRetryBackoff
+	}
+	for retries := 0; ; retries++ {
+		n, err := f.WriteAt(b, off)
+		b, off = b[n:], off+int64(n)
+		if err == nil {
+			if len(b) == 0 {
+				return nil
+			}
+			err = io.ErrShortWrite
+		}
+		if retries >= t.db.WriteRetries || !isTransientWriteError(err) {
+			return err
+		}
+		t.stats.Retry++
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isTransientWriteError returns whether a failed write may succeed if it's tried again.
+func isTransientWriteError(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, io.ErrShortWrite)
+}
+
 // writeMeta writes the meta to the disk.
 func (t *RWTransaction) writeMeta() error {
 	// Create a temporary buffer for the meta page.
@@ -342,7 +671,18 @@ func (t *RWTransaction) writeMeta() error {
 	t.meta.write(p)
 
 	// Write the meta page to file.
-	t.db.metafile.WriteAt(buf, int64(p.id)*int64(t.db.pageSize))
+	if err := t.writeAt(t.db.metafile, buf, int64(p.id)*int64(t.db.pageSize)); err != nil {
+		return err
+	}
+	t.stats.WriteBytes += len(buf)
+	t.stats.Write++
+
+	// The new meta page is now the newest so stop forcing the old one.
+	t.db.metalock.Lock()
+	t.db.force = ForceMetaAuto
+	t.db.countFreelist()
+	t.db.stats.commitN.Add(1)
+	t.db.metalock.Unlock()
 
 	return nil
 }
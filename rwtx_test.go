@@ -1,8 +1,17 @@
 package toyboltdb
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -86,6 +95,51 @@ func TestRWTransactionCreateBucketWithLongName(t *testing.T) {
 	})
 }
 
+// Ensure that bucket names can hold any bytes and survive a reopen.
+func TestRWTransactionCreateBucketBytes(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		names := [][]byte{{0x00}, {0x00, 'a', 0x00}, {0xff, 0xfe}, {'a', 0x80}, bytes.Repeat([]byte{0xff}, 255)}
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i, name := range names {
+				assert.NoError(t, txn.CreateBucketBytes(name))
+				assert.NoError(t, txn.BucketBytes(name).Put([]byte("foo"), []byte{byte(i)}))
+			}
+			assert.Equal(t, txn.CreateBucketBytes([]byte{0x00}), ErrBucketExists)
+			assert.Equal(t, txn.CreateBucketBytes(bytes.Repeat([]byte{0xff}, 256)), ErrBucketNameTooLarge)
+			return nil
+		}))
+
+		db.Close()
+		assert.NoError(t, db.Open(path, 0666))
+		_ = db.View(func(txn *Transaction) error {
+			for i, name := range names {
+				b := txn.BucketBytes(name)
+				if assert.NotNil(t, b) {
+					assert.Equal(t, b.NameBytes(), name)
+					assert.Equal(t, b.Get([]byte("foo")), []byte{byte(i)})
+				}
+			}
+			assert.Nil(t, txn.BucketBytes([]byte{0x00, 'a'}))
+
+			// Buckets are sorted by the bytes of their names.
+			var got [][]byte
+			for _, b := range txn.Buckets() {
+				got = append(got, b.NameBytes())
+			}
+			assert.Equal(t, got, [][]byte{names[0], names[1], names[3], names[2], names[4]})
+			return nil
+		})
+
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.DeleteBucketBytes(names[0])
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			assert.Nil(t, txn.BucketBytes(names[0]))
+			return nil
+		})
+	})
+}
+
 // Ensure that a bucket can be deleted.
 func TestRWTransactionDeleteBucket(t *testing.T) {
 	withOpenDB(func(db *DB, path string) {
@@ -186,3 +240,1142 @@ func TestRWTransactionDeleteBucketNotFound(t *testing.T) {
 		})
 	})
 }
+
+// Ensure that a committed transaction reports its write amplification.
+func TestRWTransactionStatsWriteAmplification(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		var txn *RWTransaction
+		err := db.Update(func(tx *RWTransaction) error {
+			txn = tx
+			tx.CreateBucket("rw-widgets")
+			return tx.Put("rw-widgets", []byte("foo"), []byte("bar"))
+		})
+		assert.NoError(t, err)
+
+		stats := txn.Stats()
+		assert.Equal(t, stats.LogicalBytes, 6)
+		assert.True(t, stats.WriteBytes >= 2*db.pageSize)
+		assert.Equal(t, stats.WriteAmplification(), float64(stats.WriteBytes)/6)
+	})
+}
+
+// Ensure that a transaction without changes reports no write amplification.
+func TestRWTransactionStatsWriteAmplificationEmpty(t *testing.T) {
+	var stats TxStats
+	assert.Equal(t, stats.WriteAmplification(), float64(0))
+}
+
+// Ensure that a committed transaction counts its splits, spills and writes.
+func TestRWTransactionStatsSplit(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		var txn *RWTransaction
+		err := db.Update(func(tx *RWTransaction) error {
+			txn = tx
+			return fill(tx, "widgets", 1000)
+		})
+		assert.NoError(t, err)
+
+		stats := txn.Stats()
+		assert.True(t, stats.Split > 0)
+		assert.True(t, stats.Spill > 1)
+		assert.Equal(t, stats.NodeCount, 1)
+		assert.True(t, stats.PageCount >= stats.Split+1)
+		assert.Equal(t, stats.PageAlloc, stats.PageCount*db.pageSize)
+		assert.True(t, stats.Write > stats.Split)
+
+		// Deleting most keys rebalances the leaves.
+		err = db.Update(func(tx *RWTransaction) error {
+			txn = tx
+			for i := 0; i < 990; i++ {
+				if err := tx.Delete("widgets", fillKey(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.True(t, txn.Stats().Rebalance > 0)
+	})
+}
+
+// Ensure that a write transaction evicts clean nodes past the cache limit and
+// still commits every change.
+func TestRWTransactionNodeCacheLimit(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 10000)
+		}))
+
+		db.NodeCacheLimit = 10
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			// Deleting missing keys reads nodes without changing them.
+			for i := 0; i < 10000; i += 100 {
+				assert.NoError(t, txn.Delete("widgets", []byte(fmt.Sprintf("%05d-missing", i))))
+			}
+			assert.True(t, txn.Stats().NodeCacheN <= 10+3)
+			assert.True(t, txn.Stats().Evict > 0)
+
+			// Changed nodes stay cached.
+			for i := 0; i < 10000; i += 1000 {
+				assert.NoError(t, txn.Put("widgets", fillKey(i), []byte("new")))
+			}
+			assert.True(t, txn.Stats().NodeCacheN > 10)
+			return nil
+		}))
+
+		_ = db.View(func(txn *Transaction) error {
+			var count int
+			txn.ForEach("widgets", func(k, v []byte) error {
+				count++
+				return nil
+			})
+			assert.Equal(t, count, 10000)
+			for i := 0; i < 10000; i += 1000 {
+				value, _ := txn.Get("widgets", fillKey(i))
+				assert.Equal(t, value, []byte("new"))
+			}
+			return nil
+		})
+	})
+}
+
+// Ensure that a cursor deleting from a node that has since been evicted
+// deletes from the cached node instead.
+func TestRWTransactionNodeCacheLimitCursorDelete(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 10000)
+		}))
+
+		db.NodeCacheLimit = 1
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			// Cache the leaf without changing it and position a cursor on it.
+			assert.NoError(t, txn.Delete("widgets", []byte("00000-missing")))
+			c := txn.Bucket("widgets").Cursor()
+			k, _ := c.Seek([]byte("00000"))
+			assert.Equal(t, k, []byte("00000"))
+
+			// Evict it. The cursor's delete evicts the clean nodes read since.
+			assert.NoError(t, txn.Delete("widgets", []byte("09999-missing")))
+			evict := txn.Stats().Evict
+			assert.NoError(t, c.Delete())
+			assert.True(t, txn.Stats().Evict > evict)
+			return nil
+		}))
+
+		_ = db.View(func(txn *Transaction) error {
+			value, _ := txn.Get("widgets", []byte("00000"))
+			assert.Nil(t, value)
+			value, _ = txn.Get("widgets", []byte("00001"))
+			assert.NotNil(t, value)
+			return nil
+		})
+	})
+}
+
+// Ensure that reusing a buffer across puts doesn't change previously inserted keys.
+func TestRWTransactionPutReusedBuffer(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		err := db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("rw-widgets")
+			buf := make([]byte, 3)
+			for _, s := range []string{"bar", "baz", "foo"} {
+				copy(buf, s)
+				if err := txn.Put("rw-widgets", buf, buf); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+
+		_ = db.View(func(txn *Transaction) error {
+			var keys []string
+			txn.ForEach("rw-widgets", func(k, v []byte) error {
+				assert.Equal(t, k, v)
+				keys = append(keys, string(k))
+				return nil
+			})
+			assert.Equal(t, keys, []string{"bar", "baz", "foo"})
+			return nil
+		})
+	})
+}
+
+// Ensure that PutReturning returns the value it replaced.
+func TestRWTransactionPutReturning(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("rw-widgets")
+			return txn.Put("rw-widgets", []byte("foo"), []byte("bar"))
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			// The old value comes from the committed page.
+			old, err := txn.PutReturning("rw-widgets", []byte("foo"), []byte("baz"))
+			assert.NoError(t, err)
+			assert.Equal(t, old, []byte("bar"))
+
+			// Then from the uncommitted node.
+			old, err = txn.PutReturning("rw-widgets", []byte("foo"), []byte("bat"))
+			assert.NoError(t, err)
+			assert.Equal(t, old, []byte("baz"))
+
+			// A new key has no old value, not even for a neighbouring key.
+			old, err = txn.PutReturning("rw-widgets", []byte("fo"), []byte("new"))
+			assert.NoError(t, err)
+			assert.Nil(t, old)
+
+			_, err = txn.PutReturning("no_such_bucket", []byte("foo"), []byte("bar"))
+			assert.Equal(t, err, ErrBucketNotFound)
+			_, err = txn.PutReturning("rw-widgets", nil, []byte("bar"))
+			assert.Equal(t, err, ErrKeyRequired)
+			return nil
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			value, _ := txn.Get("rw-widgets", []byte("foo"))
+			assert.Equal(t, value, []byte("bat"))
+			return nil
+		})
+	})
+}
+
+// Ensure that a write transaction can read its own uncommitted puts.
+func TestRWTransactionPutThenGet(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		// Commit enough keys to span multiple pages.
+		err := db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("rw-widgets")
+			for i := 0; i < 1000; i++ {
+				k := []byte(fmt.Sprintf("%04d", i))
+				if err := txn.Put("rw-widgets", k, []byte("old")); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+
+		_ = db.Update(func(txn *RWTransaction) error {
+			assert.NoError(t, txn.Put("rw-widgets", []byte("0500"), []byte("new")))
+			assert.NoError(t, txn.Put("rw-widgets", []byte("1500"), []byte("added")))
+
+			value, err := txn.Get("rw-widgets", []byte("0500"))
+			assert.NoError(t, err)
+			assert.Equal(t, value, []byte("new"))
+			value, _ = txn.Get("rw-widgets", []byte("1500"))
+			assert.Equal(t, value, []byte("added"))
+			value, _ = txn.Get("rw-widgets", []byte("0499"))
+			assert.Equal(t, value, []byte("old"))
+
+			// Iteration sees the pending writes too.
+			var n int
+			txn.ForEach("rw-widgets", func(k, v []byte) error {
+				switch string(k) {
+				case "0500":
+					assert.Equal(t, v, []byte("new"))
+				case "1500":
+					assert.Equal(t, v, []byte("added"))
+				}
+				n++
+				return nil
+			})
+			assert.Equal(t, n, 1001)
+			return nil
+		})
+	})
+}
+
+// Ensure that a write transaction doesn't see keys it has deleted.
+func TestRWTransactionDeleteThenGet(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		err := db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("rw-widgets")
+			for i := 0; i < 1000; i++ {
+				k := []byte(fmt.Sprintf("%04d", i))
+				if err := txn.Put("rw-widgets", k, []byte("bar")); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+
+		// The transaction is rolled back so that only its reads are under test.
+		errRollback := errors.New("rollback")
+		err = db.Update(func(txn *RWTransaction) error {
+			// Delete a single key and then a whole run of keys so that leaves empty out.
+			assert.NoError(t, txn.Delete("rw-widgets", []byte("0001")))
+			for i := 100; i < 900; i++ {
+				assert.NoError(t, txn.Delete("rw-widgets", []byte(fmt.Sprintf("%04d", i))))
+			}
+
+			value, err := txn.Get("rw-widgets", []byte("0001"))
+			assert.NoError(t, err)
+			assert.Nil(t, value)
+			value, _ = txn.Get("rw-widgets", []byte("0500"))
+			assert.Nil(t, value)
+			value, _ = txn.Get("rw-widgets", []byte("0900"))
+			assert.Equal(t, value, []byte("bar"))
+
+			// A deleted key can be put back within the same transaction.
+			assert.NoError(t, txn.Put("rw-widgets", []byte("0500"), []byte("baz")))
+			value, _ = txn.Get("rw-widgets", []byte("0500"))
+			assert.Equal(t, value, []byte("baz"))
+
+			var keys []string
+			txn.ForEach("rw-widgets", func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+			assert.Equal(t, len(keys), 200)
+			assert.Equal(t, keys[0], "0000")
+			assert.Equal(t, keys[98], "0099")
+			assert.Equal(t, keys[99], "0500")
+			assert.Equal(t, keys[100], "0900")
+			return errRollback
+		})
+		assert.Equal(t, err, errRollback)
+	})
+}
+
+// Ensure that emptied leaves are dropped as keys are deleted instead of being held until commit.
+func TestRWTransactionDeleteFreesEmptiedLeaves(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	withOpenDB(func(db *DB, path string) {
+		const n = 1000000
+		key := func(i int) []byte {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], uint64(i))
+			return k[:]
+		}
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		}))
+		for i := 0; i < n; i += 100000 {
+			assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+				for j := i; j < i+100000; j++ {
+					if err := txn.Put("widgets", key(j), []byte("bar")); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+
+		var leaves int
+		_ = db.View(func(txn *Transaction) error {
+			txn.forEachPage(txn.Bucket("widgets").rootPageID, 0, func(p *page, depth int) {
+				if (p.flags & leafPageFlag) != 0 {
+					leaves++
+				}
+			})
+			return nil
+		})
+
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < n; i++ {
+				if err := txn.Delete("widgets", key(i)); err != nil {
+					return err
+				}
+			}
+
+			// Only branches and the last leaf under each branch are still cached.
+			assert.True(t, len(txn.nodes) < leaves/10, "%d nodes for %d leaves", len(txn.nodes), leaves)
+			assert.True(t, len(txn.freed) > leaves*9/10)
+			return nil
+		}))
+
+		// The bucket is empty and every dropped page was returned to the freelist.
+		_ = db.View(func(txn *Transaction) error {
+			k, _ := txn.Bucket("widgets").Cursor().First()
+			assert.Nil(t, k)
+			return nil
+		})
+		count, err := db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, count, 0)
+	})
+}
+
+// Ensure that deleting a run of keys that empties adjacent leaves can be committed.
+func TestRWTransactionDeleteRangeCommit(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 1000; i++ {
+				if err := txn.Put("widgets", []byte(fmt.Sprintf("%04d", i)), []byte("bar")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 100; i < 900; i++ {
+				if err := txn.Delete("widgets", []byte(fmt.Sprintf("%04d", i))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+
+		_ = db.View(func(txn *Transaction) error {
+			var n int
+			txn.ForEach("widgets", func(k, v []byte) error {
+				n++
+				return nil
+			})
+			assert.Equal(t, n, 200)
+			value, _ := txn.Get("widgets", []byte("0900"))
+			assert.Equal(t, value, []byte("bar"))
+			return nil
+		})
+		count, err := db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, count, 0)
+	})
+}
+
+// Ensure that a value spanning overflow pages survives a reopen.
+func TestRWTransactionPutOverflowReopen(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		value := bytes.Repeat([]byte("x"), 20000)
+		assert.NoError(t, db.Open(path, 0666))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), value)
+		}))
+		db.Close()
+
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+		_ = db.View(func(txn *Transaction) error {
+			p := txn.page(txn.Bucket("widgets").rootPageID)
+			assert.Equal(t, int(p.overflow), 20000/db.pageSize)
+
+			v, _ := txn.Get("widgets", []byte("foo"))
+			assert.Equal(t, v, value)
+			return nil
+		})
+	})
+}
+
+// Ensure that pages freed by a commit are reused after the database is reopened.
+func TestRWTransactionCommitFreelistReopen(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.Open(path, 0666))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 1000)
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 1000; i++ {
+				if err := txn.Delete("widgets", fillKey(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		free := db.freelist.all()
+		highWaterMark := db.meta().pageID
+		db.Close()
+
+		// The free and pending pages are read back as free.
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+		assert.Equal(t, db.freelist.ids(), free)
+		assert.True(t, len(free) > 20)
+
+		// Writing the data again reuses the freed pages instead of growing the file.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 1000)
+		}))
+		assert.Equal(t, db.meta().pageID, highWaterMark)
+		count, err := db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, count, 0)
+	})
+}
+
+// Ensure that a commit syncs the data file once, after the data pages and
+// before the meta page are written.
+func TestRWTransactionCommitSync(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		recorder := &recordingos{}
+		db.os = recorder
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+
+		for i := 0; i < 3; i++ {
+			recorder.writes, recorder.syncs = nil, nil
+			assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+				txn.CreateBucketIfNotExists("widgets")
+				return txn.Put("widgets", []byte(fmt.Sprintf("%d", i)), []byte("bar"))
+			}))
+			assert.Equal(t, recorder.syncs, []int{len(recorder.writes) - 1})
+		}
+
+		// NoSync skips it.
+		db.NoSync = true
+		recorder.syncs = nil
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		assert.Nil(t, recorder.syncs)
+	})
+}
+
+// Ensure that transient write errors and short writes are retried from where they stopped.
+func TestRWTransactionCommitWriteRetry(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		recorder := &recordingos{}
+		db.os = recorder
+		assert.NoError(t, db.Open(path, 0666))
+		db.WriteRetries, db.WriteRetryBackoff = 3, time.Nanosecond
+
+		recorder.writes = nil
+		recorder.writeErrs = []error{syscall.EINTR, nil, syscall.EAGAIN}
+		txn, err := db.rwtxBegin()
+		assert.NoError(t, err)
+		fill(txn, "widgets", 100)
+		assert.NoError(t, txn.Commit())
+		assert.Equal(t, txn.Stats().Retry, 3)
+		for i := 1; i <= 3; i++ {
+			prev := recorder.writes[i-1]
+			assert.Equal(t, recorder.writes[i].off, prev.off+int64(len(prev.b)/2))
+			assert.Equal(t, len(recorder.writes[i].b), len(prev.b)-len(prev.b)/2)
+		}
+
+		// Running out of retries fails the commit.
+		db.WriteRetries = 1
+		recorder.writeErrs = []error{syscall.EINTR, syscall.EINTR}
+		err = db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		})
+		assert.True(t, errors.Is(err, syscall.EINTR))
+
+		// Other errors aren't retried.
+		recorder.writeErrs = []error{syscall.EIO}
+		err = db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		})
+		assert.True(t, errors.Is(err, syscall.EIO))
+		assert.Equal(t, len(recorder.writeErrs), 0)
+
+		// The retried commit is intact once reopened.
+		db.Close()
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+		assert.Nil(t, db.Check())
+		_ = db.View(func(txn *Transaction) error {
+			var n int
+			txn.ForEach("widgets", func(k, v []byte) error {
+				n++
+				return nil
+			})
+			assert.Equal(t, n, 100)
+			return nil
+		})
+	})
+}
+
+// Ensure that a bulk load with NoSync only syncs when asked to.
+func TestRWTransactionCommitNoSync(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		recorder := &recordingos{}
+		db.os = recorder
+		assert.NoError(t, db.OpenWithOptions(path, 0666, &Options{NoSync: true}))
+		defer db.Close()
+
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+				txn.CreateBucketIfNotExists("widgets")
+				return txn.Put("widgets", []byte(fmt.Sprintf("%d", i)), []byte("bar"))
+			}))
+		}
+		assert.Equal(t, len(recorder.syncs), 0)
+
+		assert.NoError(t, db.Sync())
+		assert.Equal(t, len(recorder.syncs), 1)
+	})
+}
+
+// Ensure that a commit interrupted after any of its writes leaves the database
+// in either the old or the new state, never a torn one.
+func TestRWTransactionCommitCrashConsistency(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		// Create the old state.
+		assert.NoError(t, db.Open(path, 0666))
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("old"))
+		})
+		db.Close()
+		base, err := os.ReadFile(path)
+		assert.NoError(t, err)
+
+		// Commit the new state while recording every write.
+		recorder := &recordingos{}
+		var db2 DB
+		db2.os = recorder
+		assert.NoError(t, db2.Open(path, 0666))
+		err = db2.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("woojits")
+			if err := fill(txn, "widgets", 1000); err != nil {
+				return err
+			}
+			return txn.Put("widgets", []byte("foo"), []byte("new"))
+		})
+		assert.NoError(t, err)
+		db2.Close()
+		writes := recorder.writes
+		assert.True(t, len(writes) > 2)
+
+		// Replay each prefix of the writes onto the old file and reopen it.
+		for n := 0; n <= len(writes); n++ {
+			img := make([]byte, len(base))
+			copy(img, base)
+			for _, w := range writes[:n] {
+				if end := int(w.off) + len(w.b); end > len(img) {
+					img = append(img, make([]byte, end-len(img))...)
+				}
+				copy(img[w.off:], w.b)
+			}
+			crashpath := path + ".crash"
+			assert.NoError(t, os.WriteFile(crashpath, img, 0666))
+
+			var crashed DB
+			if !assert.NoError(t, crashed.Open(crashpath, 0666), "writes=%d", n) {
+				continue
+			}
+			_ = crashed.View(func(txn *Transaction) error {
+				value, err := txn.Get("widgets", []byte("foo"))
+				assert.NoError(t, err)
+				count := 0
+				txn.ForEach("widgets", func(k, v []byte) error {
+					count++
+					return nil
+				})
+				switch string(value) {
+				case "old":
+					assert.Equal(t, count, 1, "writes=%d", n)
+					assert.Nil(t, txn.Bucket("woojits"), "writes=%d", n)
+				case "new":
+					assert.Equal(t, count, 1001, "writes=%d", n)
+					assert.NotNil(t, txn.Bucket("woojits"), "writes=%d", n)
+				default:
+					t.Errorf("writes=%d: unexpected value: %q", n, value)
+				}
+				if n == len(writes) {
+					assert.Equal(t, string(value), "new")
+				}
+				return nil
+			})
+			crashed.Close()
+			os.Remove(crashpath)
+		}
+	})
+}
+
+// Ensure that a rolled back transaction puts the pages it allocated back on the freelist.
+func TestRWTransactionRollbackFreelist(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 1000)
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 1000; i++ {
+				txn.Delete("widgets", fillKey(i))
+			}
+			return nil
+		}))
+
+		// Release the pending pages so that there are free pages to allocate.
+		txn, err := db.rwtxBegin()
+		assert.NoError(t, err)
+		txn.Rollback()
+		free, highWaterMark := db.freelist.ids(), db.meta().pageID
+		assert.True(t, len(free) > 10)
+
+		txn, err = db.rwtxBegin()
+		assert.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, txn.CreateBucket(fmt.Sprintf("woojits-%d", i)))
+		}
+		assert.Equal(t, len(db.freelist.ids()), len(free)-10)
+		txn.Rollback()
+
+		assert.Equal(t, db.freelist.ids(), free)
+		assert.Equal(t, db.meta().pageID, highWaterMark)
+	})
+}
+
+// Ensure that pages freed by a rolled back transaction stay in use.
+func TestRWTransactionRollbackFreed(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 1000)
+		}))
+
+		// Empty most leaves so their pages are freed, then roll back.
+		txn, err := db.rwtxBegin()
+		assert.NoError(t, err)
+		id := txn.meta.txID
+		free, pending := db.freelist.ids(), len(db.freelist.pendingPageIDMap)
+		for i := 0; i < 900; i++ {
+			txn.Delete("widgets", fillKey(i))
+		}
+		assert.True(t, len(txn.freed) > 0)
+		txn.Rollback()
+		assert.Nil(t, db.freelist.pendingPageIDMap[id])
+		assert.Equal(t, len(db.freelist.pendingPageIDMap), pending)
+		assert.Equal(t, db.freelist.ids(), free)
+
+		// The pages are still reachable and nothing leaked once the next
+		// transaction, which reuses the id, commits.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			assert.Equal(t, txn.meta.txID, id)
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			assert.Equal(t, txn.Bucket("widgets").KeyN(), 1001)
+			return nil
+		})
+		count, err := db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, count, 0)
+		assert.Nil(t, db.Check())
+	})
+}
+
+// Ensure that a rolled back transaction that allocated many pages leaves no
+// pages behind once the next transaction commits.
+func TestRWTransactionRollbackNoLeak(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 1000)
+		}))
+		highWaterMark := db.meta().pageID
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+
+		// Allocate lots of pages, some past the high-water mark, then roll back.
+		txn, err := db.rwtxBegin()
+		assert.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, txn.CreateBucket(fmt.Sprintf("woojits-%d", i)))
+		}
+		fill(txn, "widgets", 20000)
+		assert.True(t, txn.meta.pageID > highWaterMark)
+		txn.Rollback()
+		assert.Equal(t, db.meta().pageID, highWaterMark)
+		assert.Nil(t, txn.nodes)
+		assert.Nil(t, txn.pages)
+
+		// A small commit only grows the file by the few pages it needs.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		assert.True(t, db.meta().pageID < highWaterMark+10)
+		info2, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.True(t, info2.Size() < info.Size()+10*int64(db.pageSize))
+		count, err := db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, count, 0)
+		assert.Nil(t, db.Check())
+	})
+}
+
+// Ensure that a commit that fails leaves the freelist as it was.
+func TestRWTransactionCommitFailureFreelist(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		assert.NoError(t, db.OpenWithOptions(path, 0666, &Options{NoAutoGrow: true}))
+		defer db.Close()
+
+		// Free some pages and release them.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return fill(txn, "widgets", 1000)
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 500; i++ {
+				txn.Delete("widgets", fillKey(i))
+			}
+			return nil
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error { return nil }))
+		free := db.freelist.all()
+		assert.True(t, len(free) > 0)
+
+		// The commit runs out of room after freeing and allocating pages.
+		assert.Equal(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 25000; i++ {
+				if err := txn.Put("widgets", fillKey(i), make([]byte, 200)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}), ErrDatabaseFull)
+		assert.Equal(t, db.freelist.all(), free)
+		assert.Equal(t, len(db.freelist.pendingPageIDMap), 0)
+
+		// The next commit reuses the transaction id without freeing pages in use.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error { return nil }))
+		count, err := db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, count, 0)
+		assert.Nil(t, db.Check())
+	})
+}
+
+// Ensure that a node too large to write to a page fails the commit cleanly.
+func TestRWTransactionCommitNodeTooLarge(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+
+		// The values share one buffer so the node is only large on paper.
+		// It is put straight into the node since Put() would copy it. A node
+		// with this few elements isn't split.
+		value := make([]byte, maxAllocSize/2)
+		txn, err := db.rwtxBegin()
+		assert.NoError(t, err)
+		n, _ := txn.Bucket("widgets").Cursor().searchNode(txn, []byte("foo"))
+		for _, k := range []string{"a", "b", "c"} {
+			n.put([]byte(k), []byte(k), value, 0, 0)
+		}
+		assert.Equal(t, txn.Commit(), ErrNodeTooLarge)
+
+		// Nothing was written.
+		assert.Nil(t, db.Check())
+		_ = db.View(func(txn *Transaction) error {
+			assert.Equal(t, txn.Bucket("widgets").KeyN(), 1)
+			return nil
+		})
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.Put("widgets", []byte("baz"), []byte("bat"))
+		}))
+	})
+}
+
+// Ensure that dirty pages with contiguous ids are written with a single call.
+func TestRWTransactionWriteRuns(t *testing.T) {
+	withDB(func(db *DB, path string) {
+		recorder := &recordingos{}
+		db.os = recorder
+		assert.NoError(t, db.Open(path, 0666))
+		defer db.Close()
+
+		txn, err := db.rwtxBegin()
+		assert.NoError(t, err)
+		defer txn.Rollback()
+
+		// Pages 22 and 23 are one page with an overflow so 24 continues the run.
+		for _, id := range []pageID{24, 10, 20, 12, 22, 11} {
+			n := 1
+			if id == 22 {
+				n = 2
+			}
+			buf := make([]byte, n*db.pageSize)
+			p := db.pageInBuffer(buf, 0)
+			p.id, p.overflow = id, uint32(n-1)
+			txn.pages[id] = p
+		}
+		recorder.writes = nil
+		assert.NoError(t, txn.write())
+
+		var runs [][2]int
+		for _, w := range recorder.writes {
+			runs = append(runs, [2]int{int(w.off) / db.pageSize, len(w.b) / db.pageSize})
+		}
+		assert.Equal(t, runs, [][2]int{{10, 3}, {20, 1}, {22, 3}})
+		assert.Equal(t, txn.stats.Write, 6)
+		assert.Equal(t, txn.stats.WriteCall, 3)
+		assert.Equal(t, txn.stats.WriteBytes, 7*db.pageSize)
+
+		// Each page is written at its own offset.
+		for _, w := range recorder.writes {
+			for off := 0; off < len(w.b); {
+				p := (*page)(unsafe.Pointer(&w.b[off]))
+				assert.Equal(t, int(p.id)*db.pageSize, int(w.off)+off)
+				off += (int(p.overflow) + 1) * db.pageSize
+			}
+		}
+	})
+}
+
+// Ensure that a bulk load writes its pages in far fewer calls than pages.
+func TestRWTransactionWriteRunsBulkLoad(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		var txn *RWTransaction
+		assert.NoError(t, db.Update(func(tx *RWTransaction) error {
+			txn = tx
+			return fill(tx, "widgets", 10000)
+		}))
+
+		// New pages are allocated at the end of the file so they are contiguous.
+		stats := txn.Stats()
+		assert.True(t, stats.Write > 100, "write=%d", stats.Write)
+		assert.True(t, stats.WriteCall*10 < stats.Write, "write=%d calls=%d", stats.Write, stats.WriteCall)
+	})
+}
+
+// Ensure that writing out a RWTransaction writes the last committed state.
+func TestRWTransactionWriteTo(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		var buf bytes.Buffer
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+		db.Update(func(txn *RWTransaction) error {
+			txn.Put("widgets", []byte("baz"), []byte("bat"))
+			_, err := txn.WriteTo(&buf)
+			assert.NoError(t, err)
+			return errors.New("rollback")
+		})
+
+		withDB(func(dst *DB, dstpath string) {
+			assert.NoError(t, os.WriteFile(dstpath, buf.Bytes(), 0666))
+			assert.NoError(t, dst.Open(dstpath, 0666))
+			defer dst.Close()
+			_ = dst.View(func(txn *Transaction) error {
+				assert.Equal(t, txn.ID(), int(db.meta().txID))
+				value, _ := txn.Get("widgets", []byte("foo"))
+				assert.Equal(t, value, []byte("bar"))
+				value, _ = txn.Get("widgets", []byte("baz"))
+				assert.Nil(t, value)
+				return nil
+			})
+		})
+	})
+}
+
+// Benchmark inserting keys in sorted order.
+func BenchmarkRWTransactionPutSequential(b *testing.B) {
+	keys := make([]uint64, b.N)
+	for i := range keys {
+		keys[i] = uint64(i)
+	}
+	benchmarkRWTransactionPut(b, keys)
+}
+
+// Benchmark inserting keys in random order.
+func BenchmarkRWTransactionPutRandom(b *testing.B) {
+	r := rand.New(rand.NewSource(42))
+	keys := make([]uint64, b.N)
+	for i, v := range r.Perm(b.N) {
+		keys[i] = uint64(v)
+	}
+	benchmarkRWTransactionPut(b, keys)
+}
+
+// benchmarkRWTransactionPut inserts keys in batches and reports the resulting file size per key.
+func benchmarkRWTransactionPut(b *testing.B, keys []uint64) {
+	const batchSize = 1000
+	withOpenDB(func(db *DB, path string) {
+		if err := db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		}); err != nil {
+			b.Fatal(err)
+		}
+		value := make([]byte, 100)
+
+		b.ResetTimer()
+		for i := 0; i < len(keys); i += batchSize {
+			j := min(i+batchSize, len(keys))
+			if err := db.Update(func(txn *RWTransaction) error {
+				for _, k := range keys[i:j] {
+					var key [8]byte
+					binary.BigEndian.PutUint64(key[:], k)
+					if err := txn.Put("widgets", key[:], value); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+
+		info, err := os.Stat(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(info.Size())/float64(len(keys)), "filebytes/key")
+	})
+}
+
+// Ensure that the node graph of a transaction can be dumped.
+func TestRWTransactionDumpNodes(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 1000; i++ {
+				txn.Put("widgets", []byte(fmt.Sprintf("%04d", i)), []byte("bar"))
+			}
+			return nil
+		})
+		_ = db.Update(func(txn *RWTransaction) error {
+			var buf bytes.Buffer
+			assert.NoError(t, txn.DumpNodes(&buf))
+			assert.Equal(t, buf.String(), "")
+
+			assert.NoError(t, txn.Delete("widgets", []byte("0000")))
+			assert.NoError(t, txn.DumpNodes(&buf))
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			assert.Equal(t, len(lines), 2)
+			root := txn.Bucket("widgets").rootPageID
+			assert.Equal(t, lines[0], fmt.Sprintf("page=%d parent=0 leaf=false depth=0 keys=%d unbalanced=false", root, txn.nodes[root].numChildren()))
+			assert.Regexp(t, fmt.Sprintf(`^page=\d+ parent=%d leaf=true depth=1 keys=\d+ unbalanced=true$`, root), lines[1])
+			return nil
+		})
+	})
+}
+
+// Ensure that two buckets can be swapped.
+func TestRWTransactionSwapBuckets(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("users")
+			txn.CreateBucket("users_v2")
+			txn.Put("users", []byte("foo"), []byte("v1"))
+			txn.Put("users_v2", []byte("foo"), []byte("v2"))
+			txn.NextSequence("users_v2")
+			return nil
+		}))
+
+		// Hold a reader open across the swap.
+		txn, err := db.txBegin()
+		assert.NoError(t, err)
+		defer txn.Close()
+
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			assert.NoError(t, txn.SwapBuckets("users", "users_v2"))
+
+			// The swap is visible within the transaction, including pending writes.
+			value, _ := txn.Get("users", []byte("foo"))
+			assert.Equal(t, value, []byte("v2"))
+			return txn.Put("users", []byte("bar"), []byte("v2"))
+		}))
+
+		// The old reader still sees the old mapping.
+		value, _ := txn.Get("users", []byte("foo"))
+		assert.Equal(t, value, []byte("v1"))
+
+		_ = db.View(func(txn *Transaction) error {
+			value, _ := txn.Get("users", []byte("foo"))
+			assert.Equal(t, value, []byte("v2"))
+			value, _ = txn.Get("users", []byte("bar"))
+			assert.Equal(t, value, []byte("v2"))
+			value, _ = txn.Get("users_v2", []byte("foo"))
+			assert.Equal(t, value, []byte("v1"))
+			assert.Equal(t, txn.Bucket("users").sequence, uint64(1))
+			assert.Equal(t, txn.Bucket("users_v2").sequence, uint64(0))
+			return nil
+		})
+	})
+}
+
+// Ensure that swapping with a missing bucket returns an error.
+func TestRWTransactionSwapBucketsNotFound(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("users")
+			assert.Equal(t, txn.SwapBuckets("users", "users_v2"), ErrBucketNotFound)
+			assert.Equal(t, txn.SwapBuckets("users_v2", "users"), ErrBucketNotFound)
+			return nil
+		})
+	})
+}
+
+// Ensure that a pre-split bucket starts with a leaf per split key and loads correctly.
+func TestRWTransactionPreSplitBucket(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		key := func(i int) []byte { return []byte(fmt.Sprintf("%04d", i)) }
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.PreSplitBucket("widgets", [][]byte{key(300), key(100), key(200), key(100)})
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			s := txn.Bucket("widgets").Stats()
+			assert.Equal(t, s.BranchPageN, 1)
+			assert.Equal(t, s.LeafPageN, 3)
+			assert.Equal(t, s.KeyN, 0)
+			k, _ := txn.Bucket("widgets").Cursor().First()
+			assert.Nil(t, k)
+			return nil
+		})
+
+		// Keys land in the leaf for their range, including keys before the first split key.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			for i := 0; i < 400; i++ {
+				if err := txn.Put("widgets", key(i), []byte("bar")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			var n int
+			txn.ForEach("widgets", func(k, v []byte) error {
+				assert.Equal(t, k, key(n))
+				n++
+				return nil
+			})
+			assert.Equal(t, n, 400)
+			s := txn.Bucket("widgets").Stats()
+			assert.Equal(t, s.KeyN, 400)
+			assert.True(t, s.LeafPageN >= 3)
+			return nil
+		})
+		count, err := db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, count, 0)
+	})
+}
+
+// Ensure that an empty leaf of a pre-split bucket can be touched and removed.
+func TestRWTransactionPreSplitBucketEmptyLeaf(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.PreSplitBucket("widgets", [][]byte{[]byte("a"), []byte("m"), []byte("t")})
+		}))
+
+		// A delete lands on the empty middle leaf, then a put fills the last one.
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			if err := txn.Delete("widgets", []byte("n")); err != nil {
+				return err
+			}
+			return txn.Put("widgets", []byte("x"), []byte("bar"))
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			assert.Equal(t, txn.Bucket("widgets").Stats().LeafPageN, 2)
+			value, _ := txn.Get("widgets", []byte("x"))
+			assert.Equal(t, value, []byte("bar"))
+			return nil
+		})
+		count, err := db.LeakedPageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, count, 0)
+	})
+}
+
+// Ensure that pre-splitting returns errors for bad buckets and keys.
+func TestRWTransactionPreSplitBucketErrors(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			assert.Equal(t, txn.PreSplitBucket("widgets", [][]byte{[]byte("a"), nil}), ErrKeyRequired)
+			assert.Nil(t, txn.Bucket("widgets"))
+			assert.NoError(t, txn.PreSplitBucket("widgets", nil))
+			assert.Equal(t, txn.PreSplitBucket("widgets", nil), ErrBucketExists)
+			assert.Equal(t, txn.PreSplitBucket("", nil), ErrBucketNameRequired)
+			return nil
+		})
+	})
+}
@@ -0,0 +1,128 @@
+package toyboltdb
+
+import (
+	"sync"
+	"time"
+)
+
+// Snapshot is a read-only view of the database that is shared by many reads.
+// It pins a single Transaction and reuses it until the refresh interval has
+// passed so that each read skips the cost of starting a transaction.
+//
+// Reads through a Snapshot may be up to the refresh interval behind the latest
+// commit. The pinned transaction is released when the interval expires, even if
+// no reads happen, so that old pages can be reclaimed and the writer can remap.
+// A writer that needs to grow the mmap waits until then.
+//
+// A Snapshot is safe for concurrent use by multiple goroutines.
+type Snapshot struct {
+	db       *DB
+	interval time.Duration
+
+	mu      sync.Mutex
+	current *snapshotTx
+}
+
+// snapshotTx is a pinned transaction and the reads currently using it.
+type snapshotTx struct {
+	transaction *Transaction
+	timer       *time.Timer
+	refs        int
+	expired     bool
+}
+
+// Snapshot returns a Snapshot that refreshes at most once every interval.
+// No transaction is started until the first read.
+func (db *DB) Snapshot(interval time.Duration) *Snapshot {
+	return &Snapshot{db: db, interval: interval}
+}
+
+// View executes a function against the snapshot's current transaction.
+// The transaction must not be used after the function returns.
+// Any error that is returned from the function is returned from View().
+func (s *Snapshot) View(fn func(*Transaction) error) error {
+	st, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer s.release(st)
+
+	return fn(st.transaction)
+}
+
+// Close releases the pinned transaction once the reads using it are done.
+// A later View() pins a new one.
+func (s *Snapshot) Close() {
+	s.mu.Lock()
+	st := s.current
+	s.current = nil
+	s.mu.Unlock()
+
+	if st != nil {
+		st.timer.Stop()
+		s.expire(st)
+	}
+}
+
+// acquire returns the current pinned transaction, starting a new one if the
+// previous one has expired.
+func (s *Snapshot) acquire() (*snapshotTx, error) {
+	s.mu.Lock()
+	if st := s.current; st != nil {
+		st.refs++
+		s.mu.Unlock()
+		return st, nil
+	}
+	s.mu.Unlock()
+
+	// Start the transaction without holding the lock since it can wait on a
+	// remap, which in turn waits on expiring reads to release.
+	t, err := s.db.txBegin()
+	if err != nil {
+		return nil, err
+	}
+
+	// Another read may have started a transaction in the meantime.
+	s.mu.Lock()
+	if st := s.current; st != nil {
+		st.refs++
+		s.mu.Unlock()
+		t.Close()
+		return st, nil
+	}
+	st := &snapshotTx{transaction: t, refs: 1}
+	st.timer = time.AfterFunc(s.interval, func() { s.expire(st) })
+	s.current = st
+	s.mu.Unlock()
+
+	return st, nil
+}
+
+// release marks a read as done and closes the transaction if it has expired
+// and this was the last read using it.
+func (s *Snapshot) release(st *snapshotTx) {
+	s.mu.Lock()
+	st.refs--
+	done := st.expired && st.refs == 0
+	s.mu.Unlock()
+
+	if done {
+		st.transaction.Close()
+	}
+}
+
+// expire stops handing out a pinned transaction and closes it if no reads
+// are using it.
+func (s *Snapshot) expire(st *snapshotTx) {
+	s.mu.Lock()
+	if s.current == st {
+		s.current = nil
+	}
+	done := !st.expired && st.refs == 0
+	st.expired = true
+	s.mu.Unlock()
+
+	if done {
+		st.transaction.Close()
+	}
+}
@@ -0,0 +1,100 @@
+package toyboltdb
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensure that a snapshot reuses its transaction until the interval expires.
+func TestSnapshotView(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		put := func(value string) {
+			assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+				txn.CreateBucketIfNotExists("widgets")
+				return txn.Put("widgets", []byte("foo"), []byte(value))
+			}))
+		}
+		get := func(s *Snapshot) (value []byte) {
+			assert.NoError(t, s.View(func(txn *Transaction) error {
+				value, _ = txn.Get("widgets", []byte("foo"))
+				return nil
+			}))
+			return value
+		}
+		put("bar")
+
+		s := db.Snapshot(100 * time.Millisecond)
+		defer s.Close()
+		assert.Equal(t, get(s), []byte("bar"))
+
+		// A commit isn't visible until the snapshot refreshes.
+		put("baz")
+		assert.Equal(t, get(s), []byte("bar"))
+		time.Sleep(200 * time.Millisecond)
+		assert.Equal(t, get(s), []byte("baz"))
+	})
+}
+
+// Ensure that a snapshot releases its transaction after the interval even without reads.
+func TestSnapshotExpire(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		s := db.Snapshot(50 * time.Millisecond)
+		assert.NoError(t, s.View(func(txn *Transaction) error { return nil }))
+		assert.Equal(t, len(db.txs), 1)
+
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, len(db.txs), 0)
+
+		// Closing releases the transaction right away.
+		s = db.Snapshot(time.Hour)
+		assert.NoError(t, s.View(func(txn *Transaction) error { return nil }))
+		assert.Equal(t, len(db.txs), 1)
+		s.Close()
+		assert.Equal(t, len(db.txs), 0)
+	})
+}
+
+// Ensure that a transaction in use by a read is only released once the read is done.
+func TestSnapshotExpireWhileReading(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		s := db.Snapshot(time.Hour)
+		assert.NoError(t, s.View(func(txn *Transaction) error {
+			s.Close()
+			assert.Equal(t, len(db.txs), 1)
+			return nil
+		}))
+		assert.Equal(t, len(db.txs), 0)
+	})
+}
+
+// Ensure that concurrent reads share a snapshot.
+func TestSnapshotConcurrentView(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			return txn.Put("widgets", []byte("foo"), []byte("bar"))
+		}))
+
+		s := db.Snapshot(10 * time.Millisecond)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					_ = s.View(func(txn *Transaction) error {
+						value, _ := txn.Get("widgets", []byte("foo"))
+						assert.Equal(t, value, []byte("bar"))
+						return nil
+					})
+				}
+			}()
+		}
+		wg.Wait()
+		s.Close()
+		assert.Equal(t, len(db.txs), 0)
+	})
+}
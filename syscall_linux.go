@@ -1,10 +1,25 @@
 package toyboltdb
 
-import "syscall"
+import (
+	"os"
+	"syscall"
+)
+
+// oDirect is the open flag to bypass the page cache.
+const oDirect = syscall.O_DIRECT
+
+// fileRemoved reports whether a file has been unlinked from the file system
+// while it is still open.
+func fileRemoved(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink == 0
+}
 
 type _syscall interface {
 	Mmap(fd int, offset int64, length int, prot int, flags int) (data []byte, err error)
 	Munmap([]byte) error
+	Madvise(b []byte, advice int) error
+	Flock(fd int, how int) error
 }
 
 type syssyscall struct{}
@@ -17,3 +32,13 @@ func (o *syssyscall) Mmap(fd int, offset int64, length int, prot int, flags int)
 func (o *syssyscall) Munmap(b []byte) error {
 	return syscall.Munmap(b)
 }
+
+func (o *syssyscall) Madvise(b []byte, advice int) error {
+	// err = (EAGAIN, EBADF, EINVAL, EIO, ENOMEM, ENOSYS)
+	return syscall.Madvise(b, advice)
+}
+
+func (o *syssyscall) Flock(fd int, how int) error {
+	// err = (EBADF, EINTR, EINVAL, ENOLCK, EWOULDBLOCK)
+	return syscall.Flock(fd, how)
+}
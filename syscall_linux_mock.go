@@ -18,3 +18,13 @@ func (m *mocksyscall) Munmap(b []byte) error {
 	args := m.Called(b)
 	return args.Error(0)
 }
+
+func (m *mocksyscall) Madvise(b []byte, advice int) error {
+	args := m.Called(b, advice)
+	return args.Error(0)
+}
+
+func (m *mocksyscall) Flock(fd int, how int) error {
+	args := m.Called(fd, how)
+	return args.Error(0)
+}
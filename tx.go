@@ -2,6 +2,15 @@
 // db -> tx -> bucket -> cursor
 package toyboltdb
 
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
 // Transaction represents a read-only transaction on the database.
 // It can be used for retrieving values for keys as well as creating cursors for
 // iterating over the data.
@@ -10,23 +19,22 @@ package toyboltdb
 // can not be reclaimed by the writer until no more transactions are using them.
 // A long running read transaction can cause the database to quickly grow.
 type Transaction struct {
-	db      *DB
-	meta    *meta // copy
-	buckets *buckets
-	pages   map[pageID]*page // cache
+	db            *DB
+	rwtransaction *RWTransaction // set if this is the read side of a RWTransaction
+	meta          *meta          // copy
+	buckets       *buckets
+	pages         map[pageID]*page // cache
 }
 
 // txID represents the internal transaction identifier.
 type txID uint64
 
 // init initializes the transaction and associates it with a database.
-func (t *Transaction) init(db *DB) {
+// The meta is a copy of the meta page since the page can be changed by the writer.
+func (t *Transaction) init(db *DB, m *meta) {
 	t.db = db
 	t.pages = nil
-
-	// Copy the meta page since it can be changed by the writer.
-	t.meta = &meta{}
-	db.meta().copy(t.meta)
+	t.meta = m
 
 	// Read in the buckets page.
 	//
@@ -35,6 +43,13 @@ func (t *Transaction) init(db *DB) {
 	t.buckets.read(t.page(t.meta.bucketsPageID))
 }
 
+// ID returns the transaction id.
+// A read-only transaction sees the id of the last committed transaction while
+// a RWTransaction sees the id that it will commit with.
+func (t *Transaction) ID() int {
+	return int(t.meta.txID)
+}
+
 // Close closes the transaction and releases any pages it is using.
 func (t *Transaction) Close() {
 	t.db.txEnd(t)
@@ -55,13 +70,61 @@ func (t *Transaction) Bucket(name string) *Bucket {
 	}
 }
 
-// Buckets retrieves a list of all buckets.
+// BucketBytes retrieves a bucket like Bucket with a binary name.
+// Returns nil if the bucket does not exist.
+func (t *Transaction) BucketBytes(name []byte) *Bucket {
+	return t.Bucket(string(name))
+}
+
+// Buckets retrieves a list of all buckets sorted by name.
 func (t *Transaction) Buckets() []*Bucket {
 	buckets := make([]*Bucket, 0, len(t.buckets.bucketMap))
 	for name, b := range t.buckets.bucketMap {
 		bucket := &Bucket{bucket: b, transaction: t, name: name}
 		buckets = append(buckets, bucket)
 	}
+	sort.Sort(bucketsByName(buckets))
+	return buckets
+}
+
+// ForEachBucket executes a function for each bucket, in name order.
+// Buckets are only created as they are visited so stopping early is cheaper
+// than going through Buckets(). An error returned from the function stops
+// the iteration and is returned.
+func (t *Transaction) ForEachBucket(fn func(b *Bucket) error) error {
+	names := make([]string, 0, len(t.buckets.bucketMap))
+	for name := range t.buckets.bucketMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fn(&Bucket{bucket: t.buckets.bucketMap[name], name: name, transaction: t}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BucketRoots returns the root page id of every bucket, keyed by bucket name.
+// This is meant for debugging, such as spotting two buckets that share a root.
+func (t *Transaction) BucketRoots() map[string]pageID {
+	roots := make(map[string]pageID, len(t.buckets.bucketMap))
+	for name, b := range t.buckets.bucketMap {
+		roots[name] = b.rootPageID
+	}
+	return roots
+}
+
+// BucketsModifiedSince retrieves a list of buckets, sorted by name, that were
+// changed by a transaction committed after the given transaction id.
+// This allows a sync job to skip buckets that haven't changed.
+func (t *Transaction) BucketsModifiedSince(id int) []*Bucket {
+	var buckets []*Bucket
+	for _, b := range t.Buckets() {
+		if b.modifiedTxID > txID(id) {
+			buckets = append(buckets, b)
+		}
+	}
 	return buckets
 }
 
@@ -73,29 +136,381 @@ func (t *Transaction) Get(name string, key []byte) (value []byte, err error) {
 	if b == nil {
 		return nil, ErrBucketNotFound
 	}
-	c := b.Cursor()
-	return c.Get(key), nil
+	return b.Get(key), nil
 }
 
 // ForEach executes a function for each key/value pair in a bucket.
 // An error is returned if the bucket cannot be found.
 func (t *Transaction) ForEach(name string, fn func(k, v []byte) error) error {
-	// Open a cursor on the bucket.
 	b := t.Bucket(name)
 	if b == nil {
 		return ErrBucketNotFound
 	}
+	return b.ForEach(fn)
+}
+
+// ForEachCursor executes a function for each key/value pair in a bucket and
+// passes the cursor so the function can move it. See Bucket.ForEachCursor().
+// An error is returned if the bucket cannot be found.
+func (t *Transaction) ForEachCursor(name string, fn func(c *Cursor, k, v []byte) error) error {
+	b := t.Bucket(name)
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	return b.ForEachCursor(fn)
+}
+
+// ForEachBatch executes a function for each batch of key/value pairs in a
+// bucket. See Bucket.ForEachBatch().
+// An error is returned if the bucket cannot be found.
+func (t *Transaction) ForEachBatch(name string, batchSize int, fn func(kvs []KV) error) error {
+	b := t.Bucket(name)
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	return b.ForEachBatch(batchSize, fn)
+}
+
+// BucketHash returns a SHA-256 digest of the key/value pairs in a bucket.
+// Buckets with the same contents have the same hash regardless of how their
+// pages are laid out, so it can be used to compare buckets across databases.
+// Returns an error if the bucket does not exist.
+func (t *Transaction) BucketHash(name string) ([]byte, error) {
+	// Each key and value is prefixed with its length so that the boundaries
+	// between them are part of the hash.
+	h := sha256.New()
+	var buf [8]byte
+	err := t.ForEach(name, func(k, v []byte) error {
+		binary.BigEndian.PutUint64(buf[:], uint64(len(k)))
+		h.Write(buf[:])
+		h.Write(k)
+		binary.BigEndian.PutUint64(buf[:], uint64(len(v)))
+		h.Write(buf[:])
+		h.Write(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// PartitionKeys returns up to n-1 keys that split a bucket into n ranges of
+// roughly equal size. The keys are sampled from the bucket's branch pages so
+// the bucket isn't scanned. Every returned key exists in the bucket.
+//
+// The ranges are [first, k0), [k0, k1), ..., [kn-2, last]. A read-only
+// Transaction can be shared by goroutines that each scan one range with
+// their own Cursor, starting with Get() on the range's split key.
+func (t *Transaction) PartitionKeys(name string, n int) ([][]byte, error) {
+	b := t.Bucket(name)
+	if b == nil {
+		return nil, ErrBucketNotFound
+	}
 	c := b.Cursor()
 
-	// Iterate over each key/value pair in the bucket.
-	for k, v := c.First(); k != nil; k, v = c.Next() {
-		if err := fn(k, v); err != nil {
-			return err
+	// Walk down the tree until a level has enough elements to sample from.
+	p, nd := c.pageNode(b.rootPageID)
+	level := []pageElementRef{{page: p, node: nd}}
+	for {
+		var count int
+		for i := range level {
+			count += level[i].count()
+		}
+		if count >= n || level[0].isLeaf() {
+			break
+		}
+
+		var next []pageElementRef
+		for i := range level {
+			for j := 0; j < level[i].count(); j++ {
+				p, nd := c.pageNode(level[i].childPageID(j))
+				next = append(next, pageElementRef{page: p, node: nd})
+			}
+		}
+		level = next
+	}
+
+	// Collect the keys across the level.
+	var keys [][]byte
+	for i := range level {
+		for j := 0; j < level[i].count(); j++ {
+			keys = append(keys, level[i].key(j))
+		}
+	}
+
+	// Pick evenly spaced keys. Branch keys may have been deleted since they
+	// were written so move each one to the nearest existing key.
+	first, _ := c.First()
+	var splits [][]byte
+	for i := 1; i < n && len(keys) > 0; i++ {
+		k, _ := c.Seek(keys[i*len(keys)/n])
+		if k == nil || t.db.compare(k, first) == 0 {
+			continue
+		}
+		if len(splits) > 0 && t.db.compare(k, splits[len(splits)-1]) <= 0 {
+			continue
+		}
+		splits = append(splits, k)
+	}
+	return splits, nil
+}
+
+// DiffOp describes how a key changed between two transactions.
+type DiffOp int
+
+const (
+	DiffAdded    DiffOp = iota + 1 // the key only exists in the newer transaction
+	DiffModified                   // the key's value changed
+	DiffDeleted                    // the key only exists in the older transaction
+)
+
+// DiffBuckets calls fn for every key that differs between two read
+// transactions on the same database, such as a retained snapshot and a
+// current transaction. Buckets are visited in name order and keys in key
+// order. The value passed to fn is the newer value, or the older value for
+// deleted keys.
+//
+// Buckets that weren't modified between the two transactions are skipped
+// without reading them. Each remaining bucket is merge-walked with a cursor
+// on each side. An error returned from fn stops the diff and is returned.
+func DiffBuckets(older, newer *Transaction, fn func(bucket string, op DiffOp, key, value []byte) error) error {
+	// Collect the union of bucket names.
+	var names []string
+	for _, b := range older.Buckets() {
+		names = append(names, b.Name())
+	}
+	for _, b := range newer.Buckets() {
+		if older.Bucket(b.Name()) == nil {
+			names = append(names, b.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ob, nb := older.Bucket(name), newer.Bucket(name)
+		if ob != nil && nb != nil && ob.modifiedTxID == nb.modifiedTxID && ob.rootPageID == nb.rootPageID {
+			continue
+		}
+
+		// A missing bucket acts as an empty one.
+		var ok, ov, nk, nv []byte
+		var oc, nc *Cursor
+		if ob != nil {
+			oc = ob.Cursor()
+			ok, ov = oc.First()
+		}
+		if nb != nil {
+			nc = nb.Cursor()
+			nk, nv = nc.First()
+		}
+
+		for ok != nil || nk != nil {
+			var err error
+			switch cmp := compareDiffKeys(newer.db, ok, nk); {
+			case cmp < 0:
+				err = fn(name, DiffDeleted, ok, ov)
+				ok, ov = oc.Next()
+			case cmp > 0:
+				err = fn(name, DiffAdded, nk, nv)
+				nk, nv = nc.Next()
+			default:
+				if !bytes.Equal(ov, nv) {
+					err = fn(name, DiffModified, nk, nv)
+				}
+				ok, ov = oc.Next()
+				nk, nv = nc.Next()
+			}
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
+// compareDiffKeys compares two keys where a nil key is past the end of its
+// bucket and so sorts after every other key.
+func compareDiffKeys(db *DB, a, b []byte) int {
+	if a == nil {
+		return 1
+	} else if b == nil {
+		return -1
+	}
+	return db.compare(a, b)
+}
+
+// WriteTo writes the database as of this transaction to a writer as a
+// standalone data file. Both meta pages are written from the transaction's
+// meta followed by every page up to the high-water mark, so writers can keep
+// committing while a backup is taken.
+// On a RWTransaction the last committed state is written since uncommitted
+// changes are only in memory.
+func (t *Transaction) WriteTo(w io.Writer) (n int64, err error) {
+	m := t.meta
+	if t.rwtransaction != nil {
+		m = &meta{}
+		t.db.meta().copy(m)
+	}
+
+	// Write a meta page for each slot so either can be read back.
+	buf := make([]byte, t.db.pageSize*2)
+	for i := 0; i < 2; i++ {
+		p := t.db.pageInBuffer(buf, pageID(i))
+		p.id = pageID(i)
+		p.flags = metaPageFlag
+		m.copy(p.meta())
+		p.meta().checksum = p.meta().sum64()
+	}
+	wn, err := w.Write(buf)
+	n += int64(wn)
+	if err != nil {
+		return n, err
+	}
+
+	// Write the rest of the pages straight from the mmap.
+	wn, err = w.Write(t.db.mmapdata[2*t.db.pageSize : int(m.pageID)*t.db.pageSize])
+	n += int64(wn)
+	return n, err
+}
+
+// checker holds the state of a structural check of a transaction's pages.
+type checker struct {
+	t    *Transaction
+	refs map[pageID]string // what each page is referenced by
+	errs []error
+}
+
+// check verifies that every page below the high-water mark is referenced
+// exactly once by a meta page, the freelist, the buckets page or a bucket,
+// and that the keys of each bucket are in order. Each violation is returned
+// as an error.
+func (t *Transaction) check() []error {
+	c := &checker{t: t, refs: make(map[pageID]string)}
+	if int(t.meta.pageID)*t.db.pageSize > len(t.db.mmapdata) {
+		return []error{fmt.Errorf("high water mark %d is past the end of the map", t.meta.pageID)}
+	}
+
+	c.ref(0, 0, "meta page")
+	c.ref(1, 0, "meta page")
+
+	// Check the freelist as it was written by the last commit.
+	if p := c.page(t.meta.freelistPageID, "freelist page"); p != nil {
+		ids, err := readFreelistPage(p, t.db.pageSize)
+		if err != nil {
+			c.errorf(p.id, "freelist page: %v", err)
+		}
+		for _, id := range ids {
+			c.ref(id, 0, "freelist")
+		}
+	}
+	c.page(t.meta.bucketsPageID, "buckets page")
+
+	// Walk each bucket in name order so that errors are reported in a stable order.
+	names := make([]string, 0, len(t.buckets.bucketMap))
+	for name := range t.buckets.bucketMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.tree(t.buckets.get(name).rootPageID, name, nil, nil)
+	}
+
+	// Every page must have been reached.
+	for id := pageID(2); id < t.meta.pageID; id++ {
+		if _, ok := c.refs[id]; !ok {
+			c.errorf(id, "unreachable")
+		}
+	}
+	return c.errs
+}
+
+// errorf records a violation on a page.
+func (c *checker) errorf(id pageID, format string, args ...any) {
+	c.errs = append(c.errs, fmt.Errorf("page %d: %s", id, fmt.Sprintf(format, args...)))
+}
+
+// ref records a reference to a page and its overflow.
+// Returns false if any of them is past the high-water mark or already referenced.
+func (c *checker) ref(id pageID, overflow int, owner string) bool {
+	ok := true
+	for i := 0; i <= overflow; i++ {
+		pid := id + pageID(i)
+		if pid >= c.t.meta.pageID {
+			c.errorf(pid, "%s is past the high water mark %d", owner, c.t.meta.pageID)
+			return false
+		}
+		if prev, found := c.refs[pid]; found {
+			c.errorf(pid, "referenced by %s and %s", prev, owner)
+			ok = false
+			continue
+		}
+		c.refs[pid] = owner
+	}
+	return ok
+}
+
+// page references a page and returns it if it can be read.
+func (c *checker) page(id pageID, owner string) *page {
+	if id >= c.t.meta.pageID {
+		c.errorf(id, "%s is past the high water mark %d", owner, c.t.meta.pageID)
+		return nil
+	}
+	p := c.t.page(id)
+	if !c.ref(id, int(p.overflow), owner) {
+		return nil
+	}
+	return p
+}
+
+// tree checks a page of a bucket and its children. Every key must be in
+// order and within [lower, upper) of the parent's separators, where nil is unbounded.
+func (c *checker) tree(id pageID, name string, lower, upper []byte) {
+	p := c.page(id, fmt.Sprintf("bucket %q", name))
+	if p == nil {
+		return
+	}
+
+	var keys [][]byte
+	switch {
+	case (p.flags & leafPageFlag) != 0:
+		for i := uint16(0); i < p.count; i++ {
+			keys = append(keys, p.leafPageElement(i).key())
+		}
+	case (p.flags & branchPageFlag) != 0:
+		for i := uint16(0); i < p.count; i++ {
+			keys = append(keys, p.branchPageElement(i).key())
+		}
+	default:
+		c.errorf(id, "bucket %q: unexpected %s page", name, p.typ())
+		return
+	}
+
+	compare := c.t.db.compare
+	for i, k := range keys {
+		if i > 0 && compare(keys[i-1], k) >= 0 {
+			c.errorf(id, "bucket %q: key %d %q is not after %q", name, i, k, keys[i-1])
+		}
+		if (lower != nil && compare(k, lower) < 0) || (upper != nil && compare(k, upper) >= 0) {
+			c.errorf(id, "bucket %q: key %d %q is outside of the parent's range", name, i, k)
+		}
+	}
+
+	// Each child holds the keys from its separator up to the next one.
+	if (p.flags & branchPageFlag) != 0 {
+		for i := range keys {
+			lo, hi := keys[i], upper
+			if i == 0 {
+				lo = lower
+			}
+			if i+1 < len(keys) {
+				hi = keys[i+1]
+			}
+			c.tree(p.branchPageElement(uint16(i)).pageID, name, lo, hi)
+		}
+	}
+}
+
 // page returns a reference to the page with a given id.
 // If page has been written to then a temporary bufferred page is returned.
 func (t *Transaction) page(id pageID) *page {
@@ -109,3 +524,17 @@ func (t *Transaction) page(id pageID) *page {
 	// Otherwise return directly from the mmap.
 	return t.db.page(id)
 }
+
+// forEachPage iterates over every page in the tree under the given page,
+// including the page itself, along with the depth of each page.
+func (t *Transaction) forEachPage(id pageID, depth int, fn func(*page, int)) {
+	p := t.page(id)
+	fn(p, depth)
+
+	// Recursively loop over children.
+	if (p.flags & branchPageFlag) != 0 {
+		for i := uint16(0); i < p.count; i++ {
+			t.forEachPage(p.branchPageElement(i).pageID, depth+1, fn)
+		}
+	}
+}
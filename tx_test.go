@@ -1,6 +1,10 @@
 package toyboltdb
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -28,6 +32,42 @@ func TestTransactionBuckets(t *testing.T) {
 	})
 }
 
+// Ensure that buckets are visited in name order and that an error stops the iteration.
+func TestTransactionForEachBucket(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("foo")
+			txn.CreateBucket("bar")
+			txn.CreateBucket("baz")
+			txn.Put("baz", []byte("x"), []byte("y"))
+			return nil
+		})
+
+		_ = db.View(func(txn *Transaction) error {
+			var names []string
+			assert.NoError(t, txn.ForEachBucket(func(b *Bucket) error {
+				names = append(names, b.Name())
+				return nil
+			}))
+			assert.Equal(t, names, []string{"bar", "baz", "foo"})
+
+			// Stop at the first bucket with a key.
+			names = nil
+			errFound := errors.New("found")
+			err := txn.ForEachBucket(func(b *Bucket) error {
+				names = append(names, b.Name())
+				if b.Get([]byte("x")) != nil {
+					return errFound
+				}
+				return nil
+			})
+			assert.Equal(t, err, errFound)
+			assert.Equal(t, names, []string{"bar", "baz"})
+			return nil
+		})
+	})
+}
+
 // Ensure that a Transaction retrieving a non-existent key returns nil.
 func TestTransactionGetMissing(t *testing.T) {
 	withOpenDB(func(db *DB, path string) {
@@ -45,3 +85,265 @@ func TestTransactionGetMissing(t *testing.T) {
 		})
 	})
 }
+
+// Ensure that a write transaction's id is one past the last committed one.
+func TestTransactionID(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			return txn.CreateBucket("widgets")
+		}))
+
+		var id int
+		_ = db.View(func(txn *Transaction) error {
+			id = txn.ID()
+			return nil
+		})
+		assert.True(t, id > 0)
+
+		assert.NoError(t, db.Update(func(txn *RWTransaction) error {
+			assert.Equal(t, txn.ID(), id+1)
+			return nil
+		}))
+		_ = db.View(func(txn *Transaction) error {
+			assert.Equal(t, txn.ID(), id+1)
+			return nil
+		})
+	})
+}
+
+// Ensure that only buckets changed after a given transaction are returned.
+func TestTransactionBucketsModifiedSince(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("foo")
+			txn.CreateBucket("bar")
+			txn.CreateBucket("baz")
+			return nil
+		})
+
+		// Remember the last committed transaction.
+		var baseline int
+		_ = db.View(func(txn *Transaction) error {
+			baseline = int(txn.meta.txID)
+			assert.Equal(t, len(txn.BucketsModifiedSince(baseline-1)), 3)
+			assert.Equal(t, len(txn.BucketsModifiedSince(baseline)), 0)
+			return nil
+		})
+
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.Put("foo", []byte("key"), []byte("value"))
+			txn.NextSequence("baz")
+			txn.Delete("bar", []byte("no_such_key"))
+			return nil
+		})
+
+		_ = db.View(func(txn *Transaction) error {
+			buckets := txn.BucketsModifiedSince(baseline)
+			if assert.Equal(t, len(buckets), 2) {
+				assert.Equal(t, buckets[0].Name(), "baz")
+				assert.Equal(t, buckets[1].Name(), "foo")
+			}
+			return nil
+		})
+	})
+}
+
+// Ensure that a bucket can be partitioned and scanned from multiple goroutines.
+func TestTransactionPartitionKeys(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			for i := 0; i < 10000; i++ {
+				txn.Put("widgets", []byte(fmt.Sprintf("%05d", i)), []byte("bar"))
+			}
+			return nil
+		})
+		_ = db.View(func(txn *Transaction) error {
+			splits, err := txn.PartitionKeys("widgets", 4)
+			assert.NoError(t, err)
+			assert.Equal(t, len(splits), 3)
+
+			// Scan each range in its own goroutine.
+			bounds := append([][]byte{nil}, splits...)
+			counts := make([]int, len(bounds))
+			var wg sync.WaitGroup
+			for i := range bounds {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					c := txn.Bucket("widgets").Cursor()
+					var k []byte
+					if i == 0 {
+						k, _ = c.First()
+					} else {
+						assert.NotNil(t, c.Get(bounds[i]))
+						k = bounds[i]
+					}
+					for ; k != nil; k, _ = c.Next() {
+						if i < len(splits) && bytes.Compare(k, splits[i]) >= 0 {
+							break
+						}
+						counts[i]++
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			var total int
+			for _, n := range counts {
+				assert.True(t, n > 10000/8, "unbalanced partitions: %v", counts)
+				total += n
+			}
+			assert.Equal(t, total, 10000)
+			return nil
+		})
+	})
+}
+
+// Ensure that partitioning a small or missing bucket returns what it can.
+func TestTransactionPartitionKeysSmall(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("widgets")
+			txn.Put("widgets", []byte("bar"), []byte("0"))
+			txn.Put("widgets", []byte("baz"), []byte("1"))
+			txn.Put("widgets", []byte("foo"), []byte("2"))
+			return nil
+		})
+		_ = db.View(func(txn *Transaction) error {
+			splits, err := txn.PartitionKeys("widgets", 10)
+			assert.NoError(t, err)
+			assert.Equal(t, splits, [][]byte{[]byte("baz"), []byte("foo")})
+
+			splits, err = txn.PartitionKeys("widgets", 1)
+			assert.NoError(t, err)
+			assert.Nil(t, splits)
+
+			_, err = txn.PartitionKeys("no_such_bucket", 4)
+			assert.Equal(t, err, ErrBucketNotFound)
+			return nil
+		})
+	})
+}
+
+// Ensure that the root page of each bucket can be listed.
+func TestTransactionBucketRoots(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.CreateBucket("foo")
+			txn.CreateBucket("bar")
+			return nil
+		})
+		_ = db.View(func(txn *Transaction) error {
+			roots := txn.BucketRoots()
+			assert.Equal(t, len(roots), 2)
+			assert.Equal(t, roots["foo"], txn.Bucket("foo").rootPageID)
+			assert.Equal(t, roots["bar"], txn.Bucket("bar").rootPageID)
+			assert.NotEqual(t, roots["foo"], roots["bar"])
+			return nil
+		})
+	})
+}
+
+// Ensure that buckets with the same contents hash the same regardless of layout.
+func TestTransactionBucketHash(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			for _, name := range []string{"widgets", "woojits", "other"} {
+				txn.CreateBucket(name)
+			}
+			// Insert the same keys in opposite orders so the pages differ.
+			for i := 0; i < 1000; i++ {
+				txn.Put("widgets", []byte(fmt.Sprintf("%04d", i)), []byte("bar"))
+				txn.Put("woojits", []byte(fmt.Sprintf("%04d", 999-i)), []byte("bar"))
+			}
+			txn.Put("other", []byte("ab"), []byte("c"))
+			return nil
+		})
+		_ = db.View(func(txn *Transaction) error {
+			a, err := txn.BucketHash("widgets")
+			assert.NoError(t, err)
+			b, err := txn.BucketHash("woojits")
+			assert.NoError(t, err)
+			assert.Equal(t, a, b)
+			assert.Equal(t, len(a), 32)
+			return nil
+		})
+
+		// Changing a value or moving a key/value boundary changes the hash.
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.Put("woojits", []byte("0500"), []byte("baz"))
+			txn.CreateBucket("another")
+			return txn.Put("another", []byte("a"), []byte("bc"))
+		})
+		_ = db.View(func(txn *Transaction) error {
+			a, _ := txn.BucketHash("widgets")
+			b, _ := txn.BucketHash("woojits")
+			assert.NotEqual(t, a, b)
+			a, _ = txn.BucketHash("other")
+			b, _ = txn.BucketHash("another")
+			assert.NotEqual(t, a, b)
+
+			_, err := txn.BucketHash("no_such_bucket")
+			assert.Equal(t, err, ErrBucketNotFound)
+			return nil
+		})
+	})
+}
+
+// Ensure that the changes between two transactions can be listed.
+func TestDiffBuckets(t *testing.T) {
+	withOpenDB(func(db *DB, path string) {
+		_ = db.Update(func(txn *RWTransaction) error {
+			for _, name := range []string{"widgets", "unchanged", "removed"} {
+				txn.CreateBucket(name)
+				txn.Put(name, []byte("foo"), []byte("bar"))
+			}
+			txn.Put("widgets", []byte("baz"), []byte("bat"))
+			return nil
+		})
+		older, err := db.txBegin()
+		assert.NoError(t, err)
+		defer older.Close()
+
+		_ = db.Update(func(txn *RWTransaction) error {
+			txn.Put("widgets", []byte("foo"), []byte("BAR"))
+			txn.Delete("widgets", []byte("baz"))
+			txn.Put("widgets", []byte("zzz"), []byte("new"))
+			txn.DeleteBucket("removed")
+			txn.CreateBucket("added")
+			return txn.Put("added", []byte("foo"), []byte("bar"))
+		})
+		newer, err := db.txBegin()
+		assert.NoError(t, err)
+		defer newer.Close()
+
+		var diffs []string
+		err = DiffBuckets(older, newer, func(bucket string, op DiffOp, key, value []byte) error {
+			diffs = append(diffs, fmt.Sprintf("%s %d %s=%s", bucket, op, key, value))
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, diffs, []string{
+			"added 1 foo=bar",
+			"removed 3 foo=bar",
+			"widgets 3 baz=bat",
+			"widgets 2 foo=BAR",
+			"widgets 1 zzz=new",
+		})
+
+		// Nothing differs from itself and errors stop the diff.
+		assert.NoError(t, DiffBuckets(newer, newer, func(string, DiffOp, []byte, []byte) error {
+			t.Fatal("unexpected diff")
+			return nil
+		}))
+		exp := fmt.Errorf("stop")
+		var n int
+		err = DiffBuckets(older, newer, func(string, DiffOp, []byte, []byte) error {
+			n++
+			return exp
+		})
+		assert.Equal(t, err, exp)
+		assert.Equal(t, n, 1)
+	})
+}